@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hourRange is the hours of the day from start up to end, e.g. 9-17 for
+// 9:00 to 16:59. A range whose end is before its start, e.g. 22-6, wraps past
+// midnight.
+type hourRange struct {
+	start, end int
+}
+
+// activeHours are the hours during which hosts are expected to heartbeat.
+// None means all day.
+type activeHours []hourRange
+
+// parseActiveHours parses comma-separated hour ranges, e.g. "8-12,13-18".
+func parseActiveHours(s string) (activeHours, error) {
+	var hours activeHours
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("hour range %q must be of the form start-end", part)
+		}
+		start, err := parseHour(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseHour(bounds[1])
+		if err != nil {
+			return nil, err
+		}
+		if start == end {
+			return nil, fmt.Errorf("hour range %q is empty", part)
+		}
+		hours = append(hours, hourRange{start: start, end: end})
+	}
+	return hours, nil
+}
+
+// parseHour parses an hour from 0 to 24, 24 being the end of the day.
+func parseHour(s string) (int, error) {
+	hour, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || hour < 0 || hour > 24 {
+		return 0, fmt.Errorf("%q is not an hour from 0 to 24", s)
+	}
+	return hour, nil
+}
+
+// contains reports whether t, in its own location, is within the active
+// hours.
+func (a activeHours) contains(t time.Time) bool {
+	if len(a) == 0 {
+		return true
+	}
+	hour := t.Hour()
+	for _, r := range a {
+		if r.start < r.end && hour >= r.start && hour < r.end {
+			return true
+		}
+		if r.start > r.end && (hour >= r.start || hour < r.end) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a activeHours) String() string {
+	parts := make([]string, len(a))
+	for i, r := range a {
+		parts[i] = fmt.Sprintf("%d-%d", r.start, r.end)
+	}
+	return strings.Join(parts, ",")
+}
+
+// MarshalText shows the active hours as they are configured, e.g. in
+// /status.
+func (a activeHours) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"time"
+
+	"github.com/signalfx/golib/datapoint"
+	"github.com/signalfx/golib/sfxclient"
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// lagSample is the fleet's p95 lag as of one poll.
+type lagSample struct {
+	Time time.Time `json:"time"`
+	P95  float64   `json:"p95"`
+}
+
+// lagBaseline is the fleet's p95 lag over a rolling window, to tell unusual
+// lag from the normal daily variation. It is saved to file, if set, after
+// every poll, so restarts keep it.
+type lagBaseline struct {
+	window     time.Duration
+	stddevs    float64
+	minSamples int
+	file       string
+
+	samples []lagSample
+	// anomalous is set while polls are anomalous.
+	anomalous bool
+}
+
+// loadLagBaseline returns a baseline with the samples saved to file, if any.
+// A file that doesn't exist yet is an empty baseline.
+func loadLagBaseline(window time.Duration, stddevs float64, minSamples int, file string) (*lagBaseline, error) {
+	b := &lagBaseline{window: window, stddevs: stddevs, minSamples: minSamples, file: file}
+	if file == "" {
+		return b, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return b, nil
+	} else if err != nil {
+		return b, err
+	}
+	if err := json.Unmarshal(data, &b.samples); err != nil {
+		return b, err
+	}
+	return b, nil
+}
+
+// add records p95 as of now, dropping samples older than the window.
+func (b *lagBaseline) add(now time.Time, p95 float64) {
+	b.samples = append(b.samples, lagSample{Time: now, P95: p95})
+	cutoff := now.Add(-b.window)
+	i := 0
+	for i < len(b.samples) && b.samples[i].Time.Before(cutoff) {
+		i++
+	}
+	b.samples = b.samples[i:]
+}
+
+// stats returns the mean and standard deviation of the samples.
+func (b *lagBaseline) stats() (mean, stddev float64) {
+	for _, s := range b.samples {
+		mean += s.P95
+	}
+	mean /= float64(len(b.samples))
+	for _, s := range b.samples {
+		stddev += (s.P95 - mean) * (s.P95 - mean)
+	}
+	return mean, math.Sqrt(stddev / float64(len(b.samples)))
+}
+
+// save writes the samples to file, through a temporary file so a crash
+// can't leave it half written.
+func (b *lagBaseline) save() error {
+	if b.file == "" {
+		return nil
+	}
+	data, err := json.Marshal(b.samples)
+	if err != nil {
+		return err
+	}
+	tmp := b.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.file)
+}
+
+// checkLagAnomaly compares p95, the fleet's p95 lag as of now, with the
+// baseline, then adds it to the baseline. It returns monitor.lag_anomaly, or
+// nothing until the baseline has enough samples.
+func (m *Monitor) checkLagAnomaly(ctx context.Context, now time.Time, p95 float64) []*datapoint.Datapoint {
+	b := m.lagBaseline
+	var points []*datapoint.Datapoint
+	if len(b.samples) >= b.minSamples {
+		mean, stddev := b.stats()
+		anomalous := p95 > mean+b.stddevs*stddev
+		if anomalous {
+			data := kv.M{
+				"p95_seconds":      p95,
+				"baseline_mean":    mean,
+				"baseline_stddev":  stddev,
+				"baseline_samples": len(b.samples),
+				"threshold":        mean + b.stddevs*stddev,
+			}
+			m.logger(ctx).WarnD("lag-anomaly", data)
+			if !b.anomalous {
+				m.stats.events = append(m.stats.events, pollEvent{Event: "lag-anomaly", Details: data})
+			}
+		}
+		b.anomalous = anomalous
+		points = append(points, sfxclient.Gauge("monitor.lag_anomaly", m.selfDimensions(), boolValue(anomalous)))
+	}
+
+	b.add(now, p95)
+	if err := b.save(); err != nil {
+		m.errLog.Error(ctx, "lag-baseline-save", err)
+	} else {
+		m.errLog.Clear(ctx, "lag-baseline-save")
+	}
+	return points
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// awsClients creates the AWS clients the monitor needs, each the first time
+// it is needed, from one session, so they share credentials and config. It
+// is safe for concurrent use.
+type awsClients struct {
+	sess *session.Session
+	// ec2Config overrides the session's config for the EC2 client only.
+	ec2Config *aws.Config
+
+	mu          sync.Mutex
+	ec2         ec2iface.EC2API
+	ssm         ssmiface.SSMAPI
+	sns         snsiface.SNSAPI
+	autoscaling autoscalingiface.AutoScalingAPI
+	dynamodb    dynamodbiface.DynamoDBAPI
+}
+
+// newAWSClients configures the session, sending EC2 requests to
+// AWSEndpointURL if it is set.
+func newAWSClients(cfg Config, log kv.KayveeLogger) *awsClients {
+	awsConfig := aws.NewConfig()
+	ec2Config := aws.NewConfig()
+	if cfg.AWSEndpointURL != "" {
+		awsConfig = awsConfig.WithEndpointResolver(ec2EndpointResolver(cfg.AWSEndpointURL))
+		// Local stand-ins for AWS rarely serve HTTPS, so don't insist on it
+		// for EC2. The other services still go to AWS, so they keep verifying
+		// TLS.
+		if !strings.HasPrefix(cfg.AWSEndpointURL, "https://") {
+			log.WarnD("aws-endpoint-insecure", kv.M{
+				"endpoint": cfg.AWSEndpointURL,
+				"msg":      "EC2 requests are not sent over verified TLS",
+			})
+			ec2Config = ec2Config.WithHTTPClient(&http.Client{
+				Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+			})
+		}
+	}
+	return &awsClients{sess: session.New(awsConfig), ec2Config: ec2Config}
+}
+
+func (c *awsClients) EC2() ec2iface.EC2API {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ec2 == nil {
+		c.ec2 = ec2.New(c.sess, c.ec2Config)
+	}
+	return c.ec2
+}
+
+func (c *awsClients) SSM() ssmiface.SSMAPI {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ssm == nil {
+		c.ssm = ssm.New(c.sess)
+	}
+	return c.ssm
+}
+
+func (c *awsClients) SNS() snsiface.SNSAPI {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sns == nil {
+		c.sns = sns.New(c.sess)
+	}
+	return c.sns
+}
+
+func (c *awsClients) AutoScaling() autoscalingiface.AutoScalingAPI {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.autoscaling == nil {
+		c.autoscaling = autoscaling.New(c.sess)
+	}
+	return c.autoscaling
+}
+
+func (c *awsClients) DynamoDB() dynamodbiface.DynamoDBAPI {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dynamodb == nil {
+		c.dynamodb = dynamodb.New(c.sess)
+	}
+	return c.dynamodb
+}
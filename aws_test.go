@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// insecure reports whether client skips verifying TLS.
+func insecure(client *http.Client) bool {
+	transport, ok := client.Transport.(*http.Transport)
+	return ok && transport.TLSClientConfig != nil && transport.TLSClientConfig.InsecureSkipVerify
+}
+
+func TestAWSClientsInsecureEndpoint(t *testing.T) {
+	log, _ := newTestLogger()
+	clients := newAWSClients(Config{AWSEndpointURL: "http://localhost:4566"}, log)
+
+	if !insecure(clients.EC2().(*ec2.EC2).Config.HTTPClient) {
+		t.Errorf("EC2 client verifies TLS to an http:// endpoint")
+	}
+	// Only EC2 goes to the endpoint: everything else must still verify TLS.
+	if insecure(clients.SNS().(*sns.SNS).Config.HTTPClient) {
+		t.Errorf("SNS client skips verifying TLS")
+	}
+}
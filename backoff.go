@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/signalfx/golib/datapoint"
+	"github.com/signalfx/golib/sfxclient"
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// backoffPauser pauses polling after max polls in a row fail, so a monitor
+// doesn't add to an outage of ES or SignalFX by querying it every interval.
+type backoffPauser struct {
+	max   int
+	pause time.Duration
+
+	// failures counts the polls in a row that failed since the last pause.
+	failures int
+	// until is when the pause in progress ends, or zero.
+	until time.Time
+}
+
+// record records the result of a poll, and reports whether to pause now.
+// A poll fails as for MaxConsecutiveFailures.
+func (b *backoffPauser) record(err error) bool {
+	if err == nil || err == errLeadershipLost {
+		b.failures = 0
+		return false
+	}
+	b.failures++
+	if b.max <= 0 || b.failures < b.max {
+		return false
+	}
+	b.failures = 0
+	return true
+}
+
+// paused reports whether a pause is in progress.
+func (b *backoffPauser) paused() bool {
+	return !b.until.IsZero()
+}
+
+// startBackoff logs the start of a pause, and returns when it ends.
+func (m *Monitor) startBackoff(ctx context.Context, err error) time.Time {
+	b := m.backoff
+	b.until = m.now().Add(b.pause)
+	m.log.WarnD("backoff-paused", kv.M{
+		"error":       err.Error(),
+		"failures":    b.max,
+		"pause_ms":    b.pause.Milliseconds(),
+		"resume_time": b.until.UTC().Format(time.RFC3339),
+	})
+	m.sendInBackoff(ctx, true)
+	return b.until
+}
+
+// backoffCountdown logs the time left in the pause.
+func (m *Monitor) backoffCountdown(ctx context.Context) {
+	remaining := m.backoff.until.Sub(m.now())
+	if remaining < 0 {
+		remaining = 0
+	}
+	m.log.InfoD("backoff-countdown", kv.M{
+		"remaining_ms": remaining.Milliseconds(),
+		"resume_time":  m.backoff.until.UTC().Format(time.RFC3339),
+	})
+	m.sendInBackoff(ctx, true)
+}
+
+// endBackoff logs the end of the pause.
+func (m *Monitor) endBackoff(ctx context.Context) {
+	m.backoff.until = time.Time{}
+	m.log.InfoD("backoff-resumed", kv.M{})
+	m.sendInBackoff(ctx, false)
+}
+
+// sendInBackoff reports whether polling is paused. Polls report it too,
+// since they only run while it isn't.
+func (m *Monitor) sendInBackoff(ctx context.Context, paused bool) {
+	point := sfxclient.Gauge(m.metricName("-in-backoff"), m.selfDimensions(), boolValue(paused))
+	if err := m.send(ctx, []*datapoint.Datapoint{point}); err != nil {
+		m.errLog.Error(ctx, "send-to-signalfx", err)
+	}
+}
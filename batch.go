@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/signalfx/golib/datapoint"
+)
+
+// pointBatcher sends datapoints in batches as they are built, reusing one
+// buffer, so a poll never holds all of its datapoints at once. Each batch is
+// sent before more are built, so a slow sink slows building rather than
+// letting datapoints pile up.
+type pointBatcher struct {
+	ctx  context.Context
+	send func(ctx context.Context, points []*datapoint.Datapoint) error
+	now  func() time.Time
+
+	buf []*datapoint.Datapoint
+	// err is the first error a batch was sent with.
+	err error
+	// sending is how long sending took in all.
+	sending time.Duration
+}
+
+func newPointBatcher(ctx context.Context, size int, send func(context.Context, []*datapoint.Datapoint) error, now func() time.Time) *pointBatcher {
+	return &pointBatcher{
+		ctx:  ctx,
+		send: send,
+		now:  now,
+		buf:  make([]*datapoint.Datapoint, 0, size),
+	}
+}
+
+// add buffers points, sending the buffer whenever it fills.
+func (b *pointBatcher) add(points ...*datapoint.Datapoint) {
+	for _, point := range points {
+		b.buf = append(b.buf, point)
+		if len(b.buf) == cap(b.buf) {
+			b.flush()
+		}
+	}
+}
+
+// flush sends the buffered datapoints. A failed batch doesn't stop the
+// following ones, which may reach the sinks that are up, unless the context
+// is done.
+func (b *pointBatcher) flush() {
+	if len(b.buf) == 0 {
+		return
+	}
+	if b.ctx.Err() == nil {
+		start := b.now()
+		err := b.send(b.ctx, b.buf)
+		b.sending += b.now().Sub(start)
+		if err != nil && b.err == nil {
+			b.err = err
+		}
+	} else if b.err == nil {
+		b.err = b.ctx.Err()
+	}
+	// Sinks are done with the datapoints once they return, so the buffer
+	// can be reused. Clear it so sent datapoints can be collected.
+	for i := range b.buf {
+		b.buf[i] = nil
+	}
+	b.buf = b.buf[:0]
+}
+
+// close sends any datapoints left, and returns the first error a batch was
+// sent with.
+func (b *pointBatcher) close() error {
+	b.flush()
+	return b.err
+}
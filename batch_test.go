@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/datapoint"
+	"github.com/signalfx/golib/sfxclient"
+)
+
+func TestPointBatcher(t *testing.T) {
+	sizes := []int{}
+	send := func(ctx context.Context, points []*datapoint.Datapoint) error {
+		sizes = append(sizes, len(points))
+		return nil
+	}
+	batch := newPointBatcher(context.Background(), 3, send, time.Now)
+	for i := 0; i < 7; i++ {
+		batch.add(sfxclient.Gauge("heartbeat", nil, int64(i)))
+	}
+	if err := batch.close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+	if fmt.Sprint(sizes) != "[3 3 1]" {
+		t.Errorf("sent batches of %v, want [3 3 1]", sizes)
+	}
+}
+
+// BenchmarkPointBatcher measures building and sending a large fleet's
+// datapoints through one reused buffer.
+func BenchmarkPointBatcher(b *testing.B) {
+	const hosts = 10000
+	points := make([]*datapoint.Datapoint, hosts)
+	for i := range points {
+		dimensions := map[string]string{"hostname": fmt.Sprintf("ip-10-0-%d-%d", i/256, i%256)}
+		points[i] = sfxclient.Gauge("heartbeat", dimensions, int64(i))
+	}
+	send := func(ctx context.Context, points []*datapoint.Datapoint) error { return nil }
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		batch := newPointBatcher(context.Background(), 100, send, time.Now)
+		for _, point := range points {
+			batch.add(point)
+		}
+		if err := batch.close(); err != nil {
+			b.Fatalf("close: %s", err)
+		}
+	}
+}
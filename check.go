@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/signalfx/golib/datapoint"
+	"github.com/signalfx/golib/sfxclient"
+)
+
+// runChecks runs each check once, writing a pass or fail line for it to w,
+// and reports whether they all passed. It backs the check subcommand.
+func runChecks(ctx context.Context, w io.Writer, checks []dependencyCheck) bool {
+	ok := true
+	for _, c := range checks {
+		if err := c.check(ctx); err != nil {
+			fmt.Fprintf(w, "FAIL %s: %s\n", c.name, err)
+			ok = false
+			continue
+		}
+		fmt.Fprintf(w, "PASS %s\n", c.name)
+	}
+	return ok
+}
+
+// checkIndex verifies that the configured index can be searched and that the
+// heartbeat fields are mapped in it.
+func (s *esSearcher) checkIndex(ctx context.Context) error {
+	_, err := s.getClient().Search().
+		Index(s.config.ElasticsearchIndex).
+		Size(0).
+		Timeout("30s").
+		Do(ctx)
+	if err != nil {
+		return newFailedSearchError(err)
+	}
+
+	// These are the fields of heartbeat documents the monitor queries.
+	fields := []string{"title", s.hostnameField(), s.config.ESTimestampField}
+	mappings, err := s.fieldMappings(ctx, fields...)
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, field := range fields {
+		if len(mappings[field]) == 0 {
+			missing = append(missing, field)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("fields not mapped in %s: %s",
+			s.config.ElasticsearchIndex, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkEC2 verifies that instances can be described.
+func checkEC2(ctx context.Context, ec2api ec2iface.EC2API) error {
+	_, err := ec2api.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+		MaxResults: aws.Int64(5),
+	})
+	return err
+}
+
+// checkSink verifies that a datapoint can be sent.
+func (m *Monitor) checkSink(ctx context.Context) error {
+	point := sfxclient.Gauge("monitor.check", m.selfDimensions(), 1)
+	return m.sink.AddDatapoints(ctx, []*datapoint.Datapoint{point})
+}
@@ -0,0 +1,955 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Clever/log-monitor-es/hoststate"
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// Config holds the monitor's settings, read from the environment. Fields
+// holding secrets must be tagged `secret:"true"` to be redacted.
+type Config struct {
+	ComponentName      string
+	ElasticsearchIndex string
+	ElasticsearchURI   string
+	ESPreference       string
+	// ESAggExecutionHint and ESAggCollectMode tune how ES runs the hostname
+	// terms aggregation. Empty uses the cluster's defaults.
+	ESAggExecutionHint string
+	ESAggCollectMode   string
+	Environment        string
+	SignalfxAPIKey     string `secret:"true"`
+	MetricName         string
+	MetricNamePrefix   string
+	MetricNameSuffix   string
+	HTTPPort           string
+	LogLevel           string
+	SuccessLog         string
+	PprofEnabled       bool
+	Sinks              []string
+	MemorySinkSize     int
+	DogStatsDAddr      string
+	DDMetricPrefix     string
+
+	// ESExtraFilters are term filters, as field-value pairs, that heartbeat
+	// documents must also match.
+	ESExtraFilters []map[string]interface{}
+
+	// ESSearchTemplateID, if set, is the stored search template heartbeats
+	// are searched with instead of our own query, with
+	// ESSearchTemplateParams added to its parameters.
+	ESSearchTemplateID     string
+	ESSearchTemplateParams map[string]interface{}
+
+	// ESMultiSearch searches each of several comma-separated indices
+	// separately, in one _msearch request, so one failing doesn't fail the
+	// others.
+	ESMultiSearch bool
+	// ESParallelIndexQueries instead searches each of several
+	// comma-separated indices in its own request, up to
+	// ESMaxParallelQueries at once.
+	ESParallelIndexQueries bool
+	ESMaxParallelQueries   int
+	// ESUseAsyncSearch searches through ES's async search API, waiting for
+	// the result until ESAsyncSearchMargin short of the poll interval.
+	ESUseAsyncSearch    bool
+	ESAsyncSearchMargin time.Duration
+
+	// ESTimestampField is the field heartbeat documents are timestamped by.
+	ESTimestampField string
+	// ESHostnameField is the field identifying the host that sent a
+	// heartbeat.
+	ESHostnameField string
+
+	// HeartbeatValues are the titles of heartbeat documents.
+	HeartbeatValues []string
+
+	// EventTimestamps stamps each host's timestamp datapoint with the time of
+	// its heartbeat, rather than when it is sent.
+	EventTimestamps bool
+
+	// MaxStaleCycles is how many polls in a row a host may be missing before
+	// it is forgotten. Zero remembers hosts forever.
+	MaxStaleCycles int
+
+	// MaxTrackedHosts is the most hosts reported, the least recently seen
+	// being dropped first. Zero reports every host.
+	MaxTrackedHosts int
+
+	// TrackDocCount reports how many heartbeats each host sent in the last
+	// hour, as well as the latest.
+	TrackDocCount bool
+
+	// TrackDistinctComponents counts the component/environment pairs
+	// heartbeating, by ESComponentField and ESEnvironmentField.
+	TrackDistinctComponents bool
+	ESComponentField        string
+	ESEnvironmentField      string
+
+	// HostnameAggSize is the most hosts a poll can find.
+	HostnameAggSize int
+	// ESAggShardSize is how many hosts each shard returns to be merged into
+	// the HostnameAggSize reported.
+	ESAggShardSize int
+
+	// MetricVersion is appended to metric names, e.g. "-v2", when above 1.
+	// While MetricLegacyNames is set, metrics are also sent under their
+	// unversioned names until MetricLegacyDeprecationDate (if set) passes.
+	MetricVersion               int
+	MetricLegacyNames           bool
+	MetricLegacyDeprecationDate time.Time
+
+	// DownThreshold is how long a host can go without heartbeating before it
+	// is overdue, unless its heartbeats carry an expected interval.
+	DownThreshold time.Duration
+
+	// LagAnomalyWindow, if set, is how long the fleet's p95 lag is kept as a
+	// baseline. Polls whose p95 lag exceeds its mean by LagAnomalyStddevs
+	// standard deviations are anomalies, once it has LagAnomalyMinSamples
+	// polls. It is saved to LagAnomalyStateFile, if set.
+	LagAnomalyWindow     time.Duration
+	LagAnomalyStddevs    float64
+	LagAnomalyMinSamples int
+	LagAnomalyStateFile  string
+
+	// HostIntervalsFile, if set, maps hostname patterns to expected
+	// heartbeat intervals.
+	HostIntervalsFile string
+
+	// IngestLagCompensation is taken off every host's lag, so lag measures
+	// the time from heartbeat to ingest rather than to now.
+	IngestLagCompensation time.Duration
+
+	// Hosts lagging more than LogLagThreshold are logged, up to
+	// LogLagMaxHosts per poll. Zero logs none.
+	LogLagThreshold time.Duration
+	LogLagMaxHosts  int
+
+	// MaintenanceWindows are planned maintenances during which alerting is
+	// paused, as if maintenance mode were on.
+	MaintenanceWindows []maintenanceWindow
+	// MaintenanceDatapoints is how hosts are reported in maintenance: "now"
+	// reports them as up to date, "tag" reports them as they are with a
+	// maintenance dimension, and "withhold" leaves them out.
+	MaintenanceDatapoints string
+
+	// ActiveHours, if set, are the hours of the day, in the local time zone,
+	// during which lag is reported. Outside them every host is reported as
+	// up to date.
+	ActiveHours activeHours
+
+	// HostCountDropPercent, if set, is how far the number of hosts found must
+	// fall below its mean over the last HostCountDropWindow polls to be a
+	// drop. HostCountDropSuppress holds back per-host stale alerts during a
+	// drop.
+	HostCountDropPercent  float64
+	HostCountDropWindow   int
+	HostCountDropSuppress bool
+
+	// PollDeadline bounds each poll as a whole, up to the poll interval.
+	PollDeadline time.Duration
+	// PollTimeout bounds everything a poll does, including notifying and
+	// paging after the datapoints are sent, so a hung call can't stall
+	// polling.
+	PollTimeout time.Duration
+	// WatchdogTimeout, if positive, is how long a poll may run before the
+	// monitor exits, in case it hangs despite PollTimeout.
+	WatchdogTimeout time.Duration
+
+	// PollStartJitter delays the first poll by a random part of the poll
+	// interval, and PollTickJitterPercent varies each interval by up to that
+	// percentage, so replicas don't query ES in lockstep.
+	PollStartJitter       bool
+	PollTickJitterPercent int
+	// PollJitterSeconds, if set, delays each scheduled poll by a random
+	// number of whole seconds below it.
+	PollJitterSeconds int
+
+	// FlushOnShutdown polls once more when the monitor is stopped, within
+	// ShutdownFlushTimeout.
+	FlushOnShutdown      bool
+	ShutdownFlushTimeout time.Duration
+
+	// LagByAZ reports each availability zone's worst and median lag.
+	LagByAZ bool
+
+	// HostStateStalePolls and HostStateRecoverPolls are how many polls in a
+	// row a host must be overdue to go stale, and on time to recover.
+	// HostStateFile, if set, keeps the hosts' states across restarts.
+	HostStateStalePolls   int
+	HostStateRecoverPolls int
+	HostStateFile         string
+	// NewHostGrace, if positive, is how long hosts new since the first poll
+	// can't go stale for, unless they send NewHostGraceHeartbeats first.
+	NewHostGrace           time.Duration
+	NewHostGraceHeartbeats int
+
+	// MaxConsecutiveFailures is how many polls in a row may fail before the
+	// monitor exits. Zero never exits.
+	MaxConsecutiveFailures int
+
+	// MaxConsecutiveErrors is how many polls in a row may fail before
+	// polling pauses for BackoffPauseDuration. Zero never pauses.
+	MaxConsecutiveErrors int
+	BackoffPauseDuration time.Duration
+
+	// MaxPanics is how many polls may panic within PanicWindow before the
+	// monitor exits. Zero never exits.
+	MaxPanics   int
+	PanicWindow time.Duration
+
+	// LogSuppressWindow is how often an error that repeats every poll is
+	// logged. Zero logs every error.
+	LogSuppressWindow time.Duration
+
+	// MappingCheck is what to do when the index's mappings don't suit the
+	// monitor at startup: "warn", "fail" or "off".
+	MappingCheck string
+
+	// StartupMaxRetries is how many times each dependency is checked at
+	// startup before the monitor gives up. Zero skips the checks.
+	StartupMaxRetries int
+
+	// LambdaRuntimeAPI is set when running in AWS Lambda, which then invokes
+	// one poll at a time.
+	LambdaRuntimeAPI string
+
+	// LeaderLockTable, if set, is the DynamoDB table used to elect the one
+	// replica that polls and sends datapoints.
+	LeaderLockTable    string
+	LeaderID           string
+	LeaderLease        time.Duration
+	LeaderMaxClockSkew time.Duration
+
+	// TerminatedMode is how hosts whose instances aren't running are reported:
+	// "now" reports them as up to date, "omit" leaves them out.
+	TerminatedMode string
+
+	// HostnameIPRegex, if set, parses the IP addresses of EC2-backed hosts
+	// out of their names instead of the ip-10-0-0-1 scheme: its capture group
+	// is the IP address, with octets separated by HostnameIPSeparator.
+	HostnameIPRegex     string
+	HostnameIPSeparator string
+
+	// EC2SuppressTagKey and EC2SuppressTagValue identify instances, e.g. ones
+	// under planned maintenance, whose lag should not be reported.
+	EC2SuppressTagKey   string
+	EC2SuppressTagValue string
+
+	// EC2CheckStatus treats instances failing their EC2 status checks as not
+	// running.
+	EC2CheckStatus bool
+
+	// EC2FilterTags limit the instances checked to those carrying all of them.
+	EC2FilterTags []Tag
+
+	// AWSEndpointURL, if set, is where EC2 requests are sent instead of AWS,
+	// e.g. a LocalStack endpoint.
+	AWSEndpointURL string
+
+	// SinkClientCert and SinkClientKey are the client certificate the sinks
+	// present to proxies requiring mutual TLS. SinkCACert, if set, verifies
+	// the proxy instead of the system roots.
+	SinkClientCert string
+	SinkClientKey  string
+	SinkCACert     string
+
+	// SignalfxAPIKeySSMPath, if set and SignalfxAPIKey isn't, is the SSM
+	// parameter the SignalFX API key is read from, every
+	// SignalfxAPIKeySSMRefresh.
+	SignalfxAPIKeySSMPath    string
+	SignalfxAPIKeySSMRefresh time.Duration
+
+	// SFXBatchSize is the most datapoints sent at once.
+	SFXBatchSize int
+
+	// SFXSampleRate is the share of hosts whose datapoints are sent each
+	// minute. Overdue hosts are always sent.
+	SFXSampleRate float64
+
+	// SignalfxEndpoint, if set, is where datapoints are sent instead of
+	// SignalFX's ingest API, e.g. a local stand-in.
+	SignalfxEndpoint string
+
+	// ControlPort, if set, serves the control API, which requires
+	// ControlAPIToken.
+	ControlPort     string
+	ControlAPIToken string `secret:"true"`
+	// SFXKeyRotationEndpoint is the control API path the SignalFX API key is
+	// rotated at.
+	SFXKeyRotationEndpoint string
+
+	// SlackWebhookURL, if set, is posted to when hosts go stale or recover,
+	// in SlackChannel instead of the webhook's channel if that is set.
+	// SlackLinkTemplate links each host, with "{hostname}" replaced.
+	SlackWebhookURL   string `secret:"true"`
+	SlackChannel      string
+	SlackLinkTemplate string
+
+	// SFXCreateDetector creates a SignalFX detector at startup, through the
+	// API at SFXAPIURL, alerting when a host lags more than
+	// SFXDetectorLagThreshold.
+	SFXCreateDetector       bool
+	SFXAPIURL               string
+	SFXDetectorLagThreshold time.Duration
+
+	// PagerDutyRoutingKey, if set, pages through PagerDutyEventsURL for hosts
+	// stale for more than PagerDutyStaleAfter.
+	PagerDutyRoutingKey string `secret:"true"`
+	PagerDutyEventsURL  string
+	PagerDutyStaleAfter time.Duration
+
+	// ExpectedHosts, ExpectedHostsFile or ExpectedHostsASG, if set, list the
+	// hosts that should be heartbeating, which are alerted on once missing
+	// for ExpectedHostsGrace.
+	ExpectedHosts      []string
+	ExpectedHostsFile  string
+	ExpectedHostsASG   string
+	ExpectedHostsGrace time.Duration
+
+	// WebhookURL, if set, is posted each host transition and poll event,
+	// with WebhookHeaders, and signed with WebhookSecret if it is set. Each
+	// post is tried up to WebhookMaxAttempts times, each within
+	// WebhookTimeout.
+	WebhookURL         string            `secret:"true"`
+	WebhookHeaders     map[string]string `secret:"true"`
+	WebhookSecret      string            `secret:"true"`
+	WebhookMaxAttempts int
+	WebhookTimeout     time.Duration
+
+	// SNSTopicARN, if set, is the SNS topic host transitions are published
+	// to.
+	SNSTopicARN string
+
+	// DigestChannels are the notification channels, of "slack", "sns" and
+	// "webhook", whose transitions are sent together every DigestInterval,
+	// or once DigestMaxTransitions hosts are waiting. Hosts matching
+	// DigestCriticalHosts are sent right away.
+	DigestChannels       []string
+	DigestInterval       time.Duration
+	DigestMaxTransitions int
+	DigestCriticalHosts  []string
+
+	// NotifyCooldown, if positive, is how long after notifying about a host
+	// each channel holds back its further transitions.
+	NotifyCooldown time.Duration
+}
+
+// Tag is an EC2 instance tag.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Redacted returns a copy of the config with every field tagged
+// `secret:"true"` redacted, so it can be logged or served.
+func (c Config) Redacted() Config {
+	redactSecrets(&c)
+	return c
+}
+
+// redactSecrets redacts, in place, every field tagged `secret:"true"` of the
+// struct ptr points to.
+func redactSecrets(ptr interface{}) {
+	v := reflect.ValueOf(ptr).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("secret") != "true" {
+			continue
+		}
+		field := v.Field(i)
+		if field.Kind() == reflect.String {
+			field.SetString(redact(field.String()))
+		} else {
+			// Only strings can be partly shown.
+			field.Set(reflect.Zero(field.Type()))
+		}
+	}
+}
+
+// redact hides all but the last 4 characters of secret, to tell keys apart,
+// or all of it if it is too short for that to be safe.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	if len(secret) < 12 {
+		return "[redacted]"
+	}
+	return "****" + secret[len(secret)-4:]
+}
+
+// hostStateConfig is how hosts move between states under config.
+func hostStateConfig(config Config) hoststate.Config {
+	return hoststate.Config{
+		StalePolls:      config.HostStateStalePolls,
+		RecoverPolls:    config.HostStateRecoverPolls,
+		Grace:           config.NewHostGrace,
+		GraceHeartbeats: int64(config.NewHostGraceHeartbeats),
+		File:            config.HostStateFile,
+	}
+}
+
+// logFields returns the config's fields by name, for logging. Redact the
+// config first.
+func (c Config) logFields() kv.M {
+	fields := kv.M{}
+	v := reflect.ValueOf(c)
+	for i := 0; i < v.NumField(); i++ {
+		fields[v.Type().Field(i).Name] = v.Field(i).Interface()
+	}
+	return fields
+}
+
+// getEnv looks up an environment variable given and exits if it does not exist.
+func getEnv(envVar string) string {
+	val := os.Getenv(envVar)
+	if val == "" {
+		log.Fatalf("Must specify env variable %s", envVar)
+	}
+	return val
+}
+
+// getEnvDefault looks up an environment variable given and falls back to
+// defaultVal if it does not exist.
+func getEnvDefault(envVar, defaultVal string) string {
+	val := os.Getenv(envVar)
+	if val == "" {
+		return defaultVal
+	}
+	return val
+}
+
+// getEnvInt looks up an integer environment variable given and falls back to
+// defaultVal if it does not exist. It exits if the value is not an integer.
+func getEnvInt(envVar string, defaultVal int) int {
+	val := os.Getenv(envVar)
+	if val == "" {
+		return defaultVal
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		log.Fatalf("Env variable %s must be an integer: %s", envVar, err)
+	}
+	return i
+}
+
+// getEnvFloat looks up a float environment variable given and falls back to
+// defaultVal if it does not exist. It exits if the value is not a number.
+func getEnvFloat(envVar string, defaultVal float64) float64 {
+	val := os.Getenv(envVar)
+	if val == "" {
+		return defaultVal
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		log.Fatalf("Env variable %s must be a number: %s", envVar, err)
+	}
+	return f
+}
+
+// getEnvBool looks up a boolean environment variable given and falls back to
+// defaultVal if it does not exist. It exits if the value is not a boolean.
+func getEnvBool(envVar string, defaultVal bool) bool {
+	val := os.Getenv(envVar)
+	if val == "" {
+		return defaultVal
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		log.Fatalf("Env variable %s must be a boolean: %s", envVar, err)
+	}
+	return b
+}
+
+// getEnvDuration looks up a duration environment variable given and falls
+// back to defaultVal if it does not exist. It exits if the value is not a
+// duration.
+func getEnvDuration(envVar string, defaultVal time.Duration) time.Duration {
+	val := os.Getenv(envVar)
+	if val == "" {
+		return defaultVal
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		log.Fatalf("Env variable %s must be a duration: %s", envVar, err)
+	}
+	return d
+}
+
+// parseTag splits a tag given as key=value.
+func parseTag(tag string) (key, value string, ok bool) {
+	parts := strings.SplitN(tag, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// loadConfig reads the Config from the environment and exits if it is invalid.
+func loadConfig() Config {
+	cfg := Config{
+		ElasticsearchURI:   getEnv("ELASTICSEARCH_URI"),
+		ElasticsearchIndex: getEnv("ELASTICSEARCH_INDEX"),
+		ESPreference:       os.Getenv("ES_PREFERENCE"),
+		MetricName:         getEnv("METRIC_NAME"),
+		MetricNamePrefix:   os.Getenv("METRIC_NAME_PREFIX"),
+		MetricNameSuffix:   os.Getenv("METRIC_NAME_SUFFIX"),
+		ComponentName:      getEnv("COMPONENT_NAME"),
+		Environment:        getEnv("DEPLOY_ENV"),
+		HTTPPort:           getEnvDefault("HTTP_PORT", "8080"),
+		LogLevel:           getEnvDefault("LOG_LEVEL", "debug"),
+		SuccessLog:         getEnvDefault("SUCCESS_LOG", "info"),
+		PprofEnabled:       getEnvBool("PPROF_ENABLED", false),
+		MemorySinkSize:     getEnvInt("MEMORY_SINK_SIZE", 1000),
+		MetricVersion:      getEnvInt("METRIC_VERSION", 1),
+		MetricLegacyNames:  getEnvBool("METRIC_LEGACY_NAMES", false),
+		LogSuppressWindow:  getEnvDuration("LOG_SUPPRESS_WINDOW", 5*time.Minute),
+		DownThreshold:      getEnvDuration("DOWN_THRESHOLD", 5*time.Minute),
+		LogLagThreshold:    getEnvDuration("LOG_LAG_THRESHOLD", 0),
+		LogLagMaxHosts:     getEnvInt("LOG_LAG_MAX_HOSTS", 50),
+
+		IngestLagCompensation: getEnvDuration("INGEST_LAG_COMPENSATION", 0),
+		HostIntervalsFile:     os.Getenv("HOST_INTERVALS_FILE"),
+
+		LagByAZ: getEnvBool("LAG_BY_AZ", false),
+
+		HostStateStalePolls:   getEnvInt("HOST_STATE_STALE_POLLS", 1),
+		HostStateRecoverPolls: getEnvInt("HOST_STATE_RECOVER_POLLS", 1),
+		HostStateFile:         os.Getenv("HOST_STATE_FILE"),
+
+		NewHostGrace:           getEnvDuration("NEW_HOST_GRACE", 0),
+		NewHostGraceHeartbeats: getEnvInt("NEW_HOST_GRACE_HEARTBEATS", 0),
+
+		MaxConsecutiveFailures: getEnvInt("MAX_CONSECUTIVE_FAILURES", 0),
+		MaxConsecutiveErrors:   getEnvInt("MAX_CONSECUTIVE_ERRORS", 10),
+		BackoffPauseDuration:   getEnvDuration("BACKOFF_PAUSE_DURATION", 5*time.Minute),
+		MaxPanics:              getEnvInt("MAX_PANICS", 5),
+		PanicWindow:            getEnvDuration("PANIC_WINDOW", 10*time.Minute),
+	}
+
+	if cfg.HostStateStalePolls < 1 || cfg.HostStateRecoverPolls < 1 {
+		log.Fatalf("HOST_STATE_STALE_POLLS and HOST_STATE_RECOVER_POLLS must be at least 1, got %d and %d",
+			cfg.HostStateStalePolls, cfg.HostStateRecoverPolls)
+	}
+	if cfg.MaxConsecutiveErrors > 0 && cfg.BackoffPauseDuration <= 0 {
+		log.Fatalf("BACKOFF_PAUSE_DURATION must be positive, got %s", cfg.BackoffPauseDuration)
+	}
+
+	if _, ok := logLevels[cfg.LogLevel]; !ok {
+		log.Fatalf("Unknown LOG_LEVEL %s", cfg.LogLevel)
+	}
+	switch cfg.SuccessLog {
+	case "trace", "debug", "info", "off":
+	default:
+		log.Fatalf("SUCCESS_LOG must be trace, debug, info or off, got %s", cfg.SuccessLog)
+	}
+	if cfg.IngestLagCompensation < 0 {
+		log.Fatalf("INGEST_LAG_COMPENSATION must not be negative, got %s", cfg.IngestLagCompensation)
+	}
+	if cfg.MemorySinkSize < 0 {
+		log.Fatalf("MEMORY_SINK_SIZE must not be negative, got %d", cfg.MemorySinkSize)
+	}
+	if cfg.MetricVersion < 1 {
+		log.Fatalf("METRIC_VERSION must be at least 1, got %d", cfg.MetricVersion)
+	}
+	if date := os.Getenv("METRIC_LEGACY_DEPRECATION_DATE"); date != "" {
+		var err error
+		cfg.MetricLegacyDeprecationDate, err = time.Parse("2006-01-02", date)
+		if err != nil {
+			log.Fatalf("METRIC_LEGACY_DEPRECATION_DATE must be a date like 2006-01-02: %s", err)
+		}
+	}
+
+	// METRICS_SINK lists the sinks datapoints are sent to. SFX_SINK is the
+	// older name for it. The "memory" sink (also selected by the "dev" API
+	// key) keeps datapoints in-process so the monitor can be developed without
+	// SignalFX credentials.
+	sinks := getEnvDefault("METRICS_SINK", getEnvDefault("SFX_SINK", "signalfx"))
+	for _, sink := range strings.Split(sinks, ",") {
+		sink = strings.TrimSpace(sink)
+		switch sink {
+		case "signalfx":
+			// SIGNALFX_API_KEY overrides the SSM parameter, e.g. for local
+			// development.
+			cfg.SignalfxAPIKey = os.Getenv("SIGNALFX_API_KEY")
+			if cfg.SignalfxAPIKey == "" {
+				cfg.SignalfxAPIKeySSMPath = os.Getenv("SIGNALFX_API_KEY_SSM_PATH")
+				if cfg.SignalfxAPIKeySSMPath == "" {
+					log.Fatalf("Must specify env variable SIGNALFX_API_KEY or SIGNALFX_API_KEY_SSM_PATH")
+				}
+				cfg.SignalfxAPIKeySSMRefresh = getEnvDuration("SIGNALFX_API_KEY_SSM_REFRESH", time.Hour)
+				if cfg.SignalfxAPIKeySSMRefresh <= 0 {
+					log.Fatalf("SIGNALFX_API_KEY_SSM_REFRESH must be positive, got %s", cfg.SignalfxAPIKeySSMRefresh)
+				}
+			}
+			cfg.SignalfxEndpoint = os.Getenv("SIGNALFX_ENDPOINT")
+			if cfg.SignalfxAPIKey == "dev" {
+				sink = "memory"
+			}
+		case "memory", "datadog":
+		default:
+			log.Fatalf("Unknown metrics sink %s, must be signalfx, memory or datadog", sink)
+		}
+		cfg.Sinks = append(cfg.Sinks, sink)
+	}
+	// Setting DOGSTATSD_ADDR adds the datadog sink, alongside any others.
+	cfg.DogStatsDAddr = os.Getenv("DOGSTATSD_ADDR")
+	cfg.DDMetricPrefix = os.Getenv("DD_METRIC_PREFIX")
+	hasDatadog := false
+	for _, sink := range cfg.Sinks {
+		hasDatadog = hasDatadog || sink == "datadog"
+	}
+	if cfg.DogStatsDAddr != "" && !hasDatadog {
+		cfg.Sinks = append(cfg.Sinks, "datadog")
+	} else if cfg.DogStatsDAddr == "" && hasDatadog {
+		log.Fatalf("Must specify env variable DOGSTATSD_ADDR for the datadog sink")
+	}
+
+	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") != "" {
+		cfg.LambdaRuntimeAPI = getEnv("AWS_LAMBDA_RUNTIME_API")
+	}
+
+	if windows := os.Getenv("MAINTENANCE_WINDOWS"); windows != "" {
+		var err error
+		cfg.MaintenanceWindows, err = parseMaintenanceWindows(windows)
+		if err != nil {
+			log.Fatalf("Invalid MAINTENANCE_WINDOWS: %s", err)
+		}
+	}
+	cfg.MaintenanceDatapoints = getEnvDefault("MAINTENANCE_DATAPOINTS", maintenanceReportNow)
+	switch cfg.MaintenanceDatapoints {
+	case maintenanceReportNow, maintenanceTag, maintenanceWithhold:
+	default:
+		log.Fatalf("Unknown MAINTENANCE_DATAPOINTS %s, must be now, tag or withhold", cfg.MaintenanceDatapoints)
+	}
+
+	cfg.HostnameIPRegex = os.Getenv("HOSTNAME_IP_REGEX")
+	cfg.HostnameIPSeparator = getEnvDefault("HOSTNAME_IP_SEPARATOR", ".")
+	if _, err := newHostIPParser(cfg.HostnameIPRegex, cfg.HostnameIPSeparator); err != nil {
+		log.Fatalf("Invalid HOSTNAME_IP_REGEX: %s", err)
+	}
+
+	cfg.TerminatedMode = getEnvDefault("TERMINATED_MODE", "now")
+	if cfg.TerminatedMode != "now" && cfg.TerminatedMode != "omit" {
+		log.Fatalf("Unknown TERMINATED_MODE %s, must be now or omit", cfg.TerminatedMode)
+	}
+
+	cfg.LeaderLockTable = os.Getenv("LEADER_LOCK_TABLE")
+	if cfg.LeaderLockTable != "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.LeaderID = getEnvDefault("LEADER_ID", fmt.Sprintf("%s-%d", hostname, os.Getpid()))
+		cfg.LeaderLease = getEnvDuration("LEADER_LEASE", 90*time.Second)
+		cfg.LeaderMaxClockSkew = getEnvDuration("LEADER_MAX_CLOCK_SKEW", 5*time.Second)
+		if cfg.LeaderLease <= 2*cfg.LeaderMaxClockSkew {
+			log.Fatalf("LEADER_LEASE must be more than twice LEADER_MAX_CLOCK_SKEW")
+		}
+	}
+
+	if tag := os.Getenv("EC2_SUPPRESS_TAG"); tag != "" {
+		var ok bool
+		cfg.EC2SuppressTagKey, cfg.EC2SuppressTagValue, ok = parseTag(tag)
+		if !ok {
+			log.Fatalf("EC2_SUPPRESS_TAG must be of the form key=value, got %s", tag)
+		}
+	}
+
+	cfg.EC2CheckStatus = getEnvBool("EC2_CHECK_STATUS", false)
+
+	filterTags := os.Getenv("EC2_FILTER_TAGS")
+	if tag := os.Getenv("EC2_FILTER_TAG"); tag != "" {
+		filterTags = tag + "," + filterTags
+	}
+	for _, tag := range strings.Split(filterTags, ",") {
+		if tag = strings.TrimSpace(tag); tag == "" {
+			continue
+		}
+		key, value, ok := parseTag(tag)
+		if !ok {
+			log.Fatalf("EC2 filter tags must be of the form key=value, got %s", tag)
+		}
+		cfg.EC2FilterTags = append(cfg.EC2FilterTags, Tag{Key: key, Value: value})
+	}
+
+	cfg.AWSEndpointURL = os.Getenv("AWS_ENDPOINT_URL")
+	if cfg.AWSEndpointURL != "" {
+		u, err := url.Parse(cfg.AWSEndpointURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			log.Fatalf("AWS_ENDPOINT_URL must be an absolute URL, got %s", cfg.AWSEndpointURL)
+		}
+	}
+
+	cfg.ControlPort = os.Getenv("CONTROL_PORT")
+	if cfg.ControlPort != "" {
+		cfg.ControlAPIToken = getEnv("CONTROL_API_TOKEN")
+		cfg.SFXKeyRotationEndpoint = getEnvDefault("SFX_KEY_ROTATION_ENDPOINT", "/control/rotate-sfx-key")
+		if !strings.HasPrefix(cfg.SFXKeyRotationEndpoint, "/") {
+			log.Fatalf("SFX_KEY_ROTATION_ENDPOINT must be a path, got %s", cfg.SFXKeyRotationEndpoint)
+		}
+		if cfg.ControlPort == cfg.HTTPPort {
+			log.Fatalf("CONTROL_PORT must differ from HTTP_PORT (%s)", cfg.HTTPPort)
+		}
+	}
+
+	cfg.SlackWebhookURL = os.Getenv("SLACK_WEBHOOK_URL")
+	cfg.SlackChannel = os.Getenv("SLACK_CHANNEL")
+	cfg.SlackLinkTemplate = os.Getenv("SLACK_LINK_TEMPLATE")
+
+	cfg.PagerDutyRoutingKey = os.Getenv("PAGERDUTY_ROUTING_KEY")
+	if cfg.PagerDutyRoutingKey != "" {
+		cfg.PagerDutyEventsURL = getEnvDefault("PAGERDUTY_EVENTS_URL", "https://events.pagerduty.com/v2/enqueue")
+		cfg.PagerDutyStaleAfter = getEnvDuration("PAGERDUTY_STALE_AFTER", 15*time.Minute)
+	}
+
+	cfg.SNSTopicARN = os.Getenv("SNS_TOPIC_ARN")
+
+	cfg.WebhookURL = os.Getenv("WEBHOOK_URL")
+	if cfg.WebhookURL != "" {
+		cfg.WebhookHeaders = map[string]string{}
+		for _, header := range strings.Split(os.Getenv("WEBHOOK_HEADERS"), ",") {
+			if header = strings.TrimSpace(header); header == "" {
+				continue
+			}
+			parts := strings.SplitN(header, "=", 2)
+			if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+				log.Fatalf("WEBHOOK_HEADERS must be comma-separated Name=value pairs, got %q", header)
+			}
+			cfg.WebhookHeaders[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+		cfg.WebhookSecret = os.Getenv("WEBHOOK_SECRET")
+		cfg.WebhookMaxAttempts = getEnvInt("WEBHOOK_MAX_ATTEMPTS", 4)
+		if cfg.WebhookMaxAttempts < 1 {
+			log.Fatalf("WEBHOOK_MAX_ATTEMPTS must be at least 1, got %d", cfg.WebhookMaxAttempts)
+		}
+		cfg.WebhookTimeout = getEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second)
+	}
+
+	cfg.NotifyCooldown = getEnvDuration("NOTIFY_COOLDOWN", 0)
+
+	for _, channel := range strings.Split(os.Getenv("DIGEST_CHANNELS"), ",") {
+		switch channel = strings.TrimSpace(channel); channel {
+		case "":
+		case "slack", "sns", "webhook":
+			cfg.DigestChannels = append(cfg.DigestChannels, channel)
+		default:
+			log.Fatalf("DIGEST_CHANNELS must list slack, sns or webhook, got %q", channel)
+		}
+	}
+	if len(cfg.DigestChannels) > 0 {
+		cfg.DigestInterval = getEnvDuration("DIGEST_INTERVAL", 30*time.Minute)
+		if cfg.DigestInterval <= 0 {
+			log.Fatalf("DIGEST_INTERVAL must be positive, got %s", cfg.DigestInterval)
+		}
+		cfg.DigestMaxTransitions = getEnvInt("DIGEST_MAX_TRANSITIONS", 50)
+		for _, pattern := range strings.Split(os.Getenv("DIGEST_CRITICAL_HOSTS"), ",") {
+			if pattern = strings.TrimSpace(pattern); pattern == "" {
+				continue
+			}
+			if _, err := hostMatcher(pattern); err != nil {
+				log.Fatalf("Invalid DIGEST_CRITICAL_HOSTS pattern %q: %s", pattern, err)
+			}
+			cfg.DigestCriticalHosts = append(cfg.DigestCriticalHosts, pattern)
+		}
+	}
+
+	for _, host := range strings.Split(os.Getenv("EXPECTED_HOSTS"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			cfg.ExpectedHosts = append(cfg.ExpectedHosts, host)
+		}
+	}
+	cfg.ExpectedHostsFile = os.Getenv("EXPECTED_HOSTS_FILE")
+	cfg.ExpectedHostsASG = os.Getenv("EXPECTED_HOSTS_ASG")
+	sources := 0
+	for _, set := range []bool{len(cfg.ExpectedHosts) > 0, cfg.ExpectedHostsFile != "", cfg.ExpectedHostsASG != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		log.Fatalf("Only one of EXPECTED_HOSTS, EXPECTED_HOSTS_FILE and EXPECTED_HOSTS_ASG may be set")
+	}
+	cfg.ExpectedHostsGrace = getEnvDuration("EXPECTED_HOSTS_GRACE", 5*time.Minute)
+
+	cfg.SFXBatchSize = getEnvInt("SFX_BATCH_SIZE", 1000)
+	if cfg.SFXBatchSize < 1 {
+		log.Fatalf("SFX_BATCH_SIZE must be at least 1, got %d", cfg.SFXBatchSize)
+	}
+	cfg.LagAnomalyWindow = getEnvDuration("LAG_ANOMALY_WINDOW", 0)
+	if cfg.LagAnomalyWindow > 0 {
+		cfg.LagAnomalyStddevs = getEnvFloat("LAG_ANOMALY_STDDEVS", 3)
+		if cfg.LagAnomalyStddevs <= 0 {
+			log.Fatalf("LAG_ANOMALY_STDDEVS must be positive, got %g", cfg.LagAnomalyStddevs)
+		}
+		cfg.LagAnomalyMinSamples = getEnvInt("LAG_ANOMALY_MIN_SAMPLES", 30)
+		if cfg.LagAnomalyMinSamples < 2 {
+			log.Fatalf("LAG_ANOMALY_MIN_SAMPLES must be at least 2, got %d", cfg.LagAnomalyMinSamples)
+		}
+		cfg.LagAnomalyStateFile = os.Getenv("LAG_ANOMALY_STATE_FILE")
+	}
+	cfg.SFXSampleRate = getEnvFloat("SFX_SAMPLE_RATE", 1)
+	if cfg.SFXSampleRate < 0 || cfg.SFXSampleRate > 1 {
+		log.Fatalf("SFX_SAMPLE_RATE must be from 0 to 1, got %g", cfg.SFXSampleRate)
+	}
+
+	cfg.SFXCreateDetector = getEnvBool("SFX_CREATE_DETECTOR", false)
+	if cfg.SFXCreateDetector {
+		if cfg.SignalfxAPIKey == "" && cfg.SignalfxAPIKeySSMPath == "" {
+			log.Fatalf("SFX_CREATE_DETECTOR requires the signalfx sink")
+		}
+		cfg.SFXAPIURL = getEnvDefault("SFX_API_URL", "https://api.signalfx.com")
+		threshold := getEnvInt("SFX_DETECTOR_LAG_THRESHOLD_SECONDS", 300)
+		if threshold < 1 {
+			log.Fatalf("SFX_DETECTOR_LAG_THRESHOLD_SECONDS must be at least 1, got %d", threshold)
+		}
+		cfg.SFXDetectorLagThreshold = time.Duration(threshold) * time.Second
+	}
+
+	cfg.ESTimestampField = getEnvDefault("ES_TIMESTAMP_FIELD", "timestamp")
+	cfg.ESHostnameField = getEnvDefault("ES_HOSTNAME_FIELD", "hostname")
+
+	if filters := os.Getenv("ES_EXTRA_FILTERS"); filters != "" {
+		if err := json.Unmarshal([]byte(filters), &cfg.ESExtraFilters); err != nil {
+			log.Fatalf("ES_EXTRA_FILTERS must be a JSON array of objects, e.g. [{\"datacenter\":\"us-east-1\"}]: %s", err)
+		}
+	}
+
+	cfg.ESMultiSearch = getEnvBool("ES_MULTI_SEARCH", false)
+	cfg.ESParallelIndexQueries = getEnvBool("ES_PARALLEL_INDEX_QUERIES", false)
+	if cfg.ESParallelIndexQueries {
+		if cfg.ESMultiSearch {
+			log.Fatalf("ES_PARALLEL_INDEX_QUERIES and ES_MULTI_SEARCH can't both be set")
+		}
+		cfg.ESMaxParallelQueries = getEnvInt("ES_MAX_PARALLEL_QUERIES", 3)
+		if cfg.ESMaxParallelQueries < 1 {
+			log.Fatalf("ES_MAX_PARALLEL_QUERIES must be at least 1, got %d", cfg.ESMaxParallelQueries)
+		}
+	}
+	cfg.ESSearchTemplateID = os.Getenv("ES_SEARCH_TEMPLATE_ID")
+	if params := os.Getenv("ES_SEARCH_TEMPLATE_PARAMS"); params != "" {
+		if err := json.Unmarshal([]byte(params), &cfg.ESSearchTemplateParams); err != nil {
+			log.Fatalf("ES_SEARCH_TEMPLATE_PARAMS must be a JSON object, e.g. {\"region\":\"us-east-1\"}: %s", err)
+		}
+	}
+	cfg.ESUseAsyncSearch = getEnvBool("ES_USE_ASYNC_SEARCH", false)
+	if cfg.ESUseAsyncSearch {
+		if cfg.ESMultiSearch || cfg.ESParallelIndexQueries || cfg.ESSearchTemplateID != "" {
+			log.Fatalf("ES_USE_ASYNC_SEARCH can't be combined with ES_MULTI_SEARCH, ES_PARALLEL_INDEX_QUERIES or ES_SEARCH_TEMPLATE_ID")
+		}
+		cfg.ESAsyncSearchMargin = getEnvDuration("ES_ASYNC_SEARCH_MARGIN", 5*time.Second)
+		if cfg.ESAsyncSearchMargin < 0 || cfg.ESAsyncSearchMargin >= pollInterval {
+			log.Fatalf("ES_ASYNC_SEARCH_MARGIN must be from 0 to under the %s poll interval, got %s", pollInterval, cfg.ESAsyncSearchMargin)
+		}
+	}
+
+	for _, value := range strings.Split(getEnvDefault("HEARTBEAT_VALUES", "heartbeat"), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			cfg.HeartbeatValues = append(cfg.HeartbeatValues, value)
+		}
+	}
+	if len(cfg.HeartbeatValues) == 0 {
+		log.Fatalf("HEARTBEAT_VALUES must list at least one title")
+	}
+
+	cfg.TrackDocCount = getEnvBool("TRACK_DOC_COUNT", false)
+	cfg.TrackDistinctComponents = getEnvBool("TRACK_DISTINCT_COMPONENTS", false)
+	cfg.ESComponentField = getEnvDefault("ES_COMPONENT_FIELD", "component")
+	cfg.ESEnvironmentField = getEnvDefault("ES_ENVIRONMENT_FIELD", "environment")
+	cfg.MaxStaleCycles = getEnvInt("MAX_STALE_CYCLES", 0)
+	cfg.MaxTrackedHosts = getEnvInt("MAX_TRACKED_HOSTS", 0)
+	cfg.EventTimestamps = getEnvBool("EVENT_TIMESTAMPS", false)
+
+	cfg.HostnameAggSize = getEnvInt("HOSTNAME_AGG_SIZE", 500)
+	if cfg.HostnameAggSize < 1 {
+		log.Fatalf("HOSTNAME_AGG_SIZE must be at least 1, got %d", cfg.HostnameAggSize)
+	}
+	cfg.ESAggShardSize = getEnvInt("ES_AGG_SHARD_SIZE", 3*cfg.HostnameAggSize)
+	if cfg.ESAggShardSize < cfg.HostnameAggSize {
+		log.Fatalf("ES_AGG_SHARD_SIZE must be at least HOSTNAME_AGG_SIZE (%d), got %d",
+			cfg.HostnameAggSize, cfg.ESAggShardSize)
+	}
+	cfg.ESAggExecutionHint = os.Getenv("ES_AGG_EXECUTION_HINT")
+	switch cfg.ESAggExecutionHint {
+	case "", "map", "global_ordinals", "global_ordinals_hash", "global_ordinals_low_cardinality":
+	default:
+		log.Fatalf("Unknown ES_AGG_EXECUTION_HINT %s", cfg.ESAggExecutionHint)
+	}
+	cfg.ESAggCollectMode = os.Getenv("ES_AGG_COLLECT_MODE")
+	switch cfg.ESAggCollectMode {
+	case "", "depth_first", "breadth_first":
+	default:
+		log.Fatalf("Unknown ES_AGG_COLLECT_MODE %s, must be depth_first or breadth_first", cfg.ESAggCollectMode)
+	}
+
+	cfg.PollDeadline = getEnvDuration("POLL_DEADLINE", pollInterval)
+	cfg.HostCountDropPercent = getEnvFloat("HOST_COUNT_DROP_PERCENT", 0)
+	if cfg.HostCountDropPercent < 0 || cfg.HostCountDropPercent >= 100 {
+		log.Fatalf("HOST_COUNT_DROP_PERCENT must be from 0 to under 100, got %g", cfg.HostCountDropPercent)
+	}
+	if cfg.HostCountDropPercent > 0 {
+		cfg.HostCountDropWindow = getEnvInt("HOST_COUNT_DROP_WINDOW", 5)
+		if cfg.HostCountDropWindow < 1 {
+			log.Fatalf("HOST_COUNT_DROP_WINDOW must be at least 1, got %d", cfg.HostCountDropWindow)
+		}
+		cfg.HostCountDropSuppress = getEnvBool("HOST_COUNT_DROP_SUPPRESS", false)
+	}
+	cfg.PollTimeout = getEnvDuration("POLL_TIMEOUT", time.Minute)
+	if cfg.PollTimeout <= 0 {
+		log.Fatalf("POLL_TIMEOUT must be positive, got %s", cfg.PollTimeout)
+	}
+	// Polls are only cut short at PollTimeout, so leave them an interval
+	// more to summarize.
+	watchdogDefault := 2 * pollInterval
+	if cfg.PollTimeout+pollInterval > watchdogDefault {
+		watchdogDefault = cfg.PollTimeout + pollInterval
+	}
+	cfg.WatchdogTimeout = getEnvDuration("WATCHDOG_TIMEOUT", watchdogDefault)
+	if cfg.WatchdogTimeout > 0 && cfg.WatchdogTimeout <= cfg.PollTimeout {
+		log.Fatalf("WATCHDOG_TIMEOUT must be longer than POLL_TIMEOUT (%s), got %s", cfg.PollTimeout, cfg.WatchdogTimeout)
+	}
+	if hours := os.Getenv("ACTIVE_HOURS"); hours != "" {
+		var err error
+		cfg.ActiveHours, err = parseActiveHours(hours)
+		if err != nil {
+			log.Fatalf("ACTIVE_HOURS must be comma-separated hour ranges, e.g. 9-17: %s", err)
+		}
+	}
+
+	cfg.FlushOnShutdown = getEnvBool("FLUSH_ON_SHUTDOWN", true)
+	cfg.ShutdownFlushTimeout = getEnvDuration("SHUTDOWN_FLUSH_TIMEOUT", 10*time.Second)
+	cfg.PollStartJitter = getEnvBool("POLL_START_JITTER", false)
+	cfg.PollTickJitterPercent = getEnvInt("POLL_TICK_JITTER_PERCENT", 0)
+	if cfg.PollTickJitterPercent < 0 || cfg.PollTickJitterPercent > 50 {
+		log.Fatalf("POLL_TICK_JITTER_PERCENT must be between 0 and 50, got %d", cfg.PollTickJitterPercent)
+	}
+	cfg.PollJitterSeconds = getEnvInt("POLL_JITTER_SECONDS", 0)
+	if cfg.PollJitterSeconds < 0 || time.Duration(cfg.PollJitterSeconds)*time.Second >= pollInterval {
+		log.Fatalf("POLL_JITTER_SECONDS must be from 0 to under the %s poll interval, got %d", pollInterval, cfg.PollJitterSeconds)
+	}
+
+	cfg.MappingCheck = getEnvDefault("MAPPING_CHECK", "warn")
+	if cfg.MappingCheck != "warn" && cfg.MappingCheck != "fail" && cfg.MappingCheck != "off" {
+		log.Fatalf("Unknown MAPPING_CHECK %s, must be warn, fail or off", cfg.MappingCheck)
+	}
+
+	cfg.StartupMaxRetries = getEnvInt("STARTUP_MAX_RETRIES", 5)
+
+	cfg.SinkClientCert = os.Getenv("SINK_CLIENT_CERT")
+	cfg.SinkClientKey = os.Getenv("SINK_CLIENT_KEY")
+	cfg.SinkCACert = os.Getenv("SINK_CA_CERT")
+	if (cfg.SinkClientCert == "") != (cfg.SinkClientKey == "") {
+		log.Fatalf("SINK_CLIENT_CERT and SINK_CLIENT_KEY must be set together")
+	}
+
+	return cfg
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeSecret is a secret that must never be output.
+const fakeSecret = "fake-secret-0123456789abcdef"
+
+func TestRedactSecrets(t *testing.T) {
+	settings := struct {
+		Name    string
+		Token   string            `secret:"true"`
+		Short   string            `secret:"true"`
+		Headers map[string]string `secret:"true"`
+	}{
+		Name:    "public",
+		Token:   fakeSecret,
+		Short:   "abc",
+		Headers: map[string]string{"Authorization": fakeSecret},
+	}
+	redactSecrets(&settings)
+
+	if settings.Name != "public" {
+		t.Errorf("Name = %q, want it untouched", settings.Name)
+	}
+	if want := "****cdef"; settings.Token != want {
+		t.Errorf("Token = %q, want %q", settings.Token, want)
+	}
+	if want := "[redacted]"; settings.Short != want {
+		t.Errorf("Short = %q, want %q", settings.Short, want)
+	}
+	if settings.Headers != nil {
+		t.Errorf("Headers = %v, want nil", settings.Headers)
+	}
+}
+
+// TestConfigRedacted checks that no secret in the config reaches its JSON
+// or its log fields.
+func TestConfigRedacted(t *testing.T) {
+	config := testConfig()
+	v := reflect.ValueOf(&config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("secret") != "true" {
+			continue
+		}
+		switch field := v.Field(i); field.Kind() {
+		case reflect.String:
+			field.SetString(fakeSecret)
+		case reflect.Map:
+			field.Set(reflect.ValueOf(map[string]string{"X-Token": fakeSecret}))
+		default:
+			t.Fatalf("no fake secret for %s", v.Type().Field(i).Name)
+		}
+	}
+
+	body, err := json.Marshal(config.Redacted())
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	if strings.Contains(string(body), fakeSecret) {
+		t.Errorf("secret in the redacted config's JSON: %s", body)
+	}
+	if fields := fmt.Sprint(config.Redacted().logFields()); strings.Contains(fields, fakeSecret) {
+		t.Errorf("secret in the redacted config's log fields: %s", fields)
+	}
+	if config.SignalfxAPIKey != fakeSecret {
+		t.Errorf("Redacted changed the original config")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// cacheInvalidator is implemented by RunningCheckers whose cache can be
+// dropped, so the next poll reloads it.
+type cacheInvalidator interface {
+	invalidateCache()
+}
+
+// newControlHandler returns the control API, for operators to act on the
+// running monitor. Every request must carry token as a bearer token. The
+// SignalFX API key is rotated at rotatePath, if there is a SignalFX sink, and
+// the log level is served by logLevel, if set.
+func newControlHandler(m *Monitor, token, rotatePath string, keys *tokenSink, logLevel http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/control/poll", m.handleControlPoll)
+	mux.HandleFunc("/control/hosts", m.handleControlHosts)
+	mux.HandleFunc("/control/cache/ec2", m.handleControlEC2Cache)
+	mux.HandleFunc("/control/config", m.handleControlConfig)
+	mux.Handle("/control/maintenance", m.maintenance)
+	if logLevel != nil {
+		mux.Handle("/control/loglevel", logLevel)
+	}
+	if keys != nil {
+		mux.Handle(rotatePath, &keyRotator{keys: keys, log: m.log})
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// handleControlPoll starts a poll outside the schedule. Like a tick, it is
+// skipped if a poll is already in progress.
+func (m *Monitor) handleControlPoll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !m.triggerPoll() {
+		http.Error(w, "a poll is already pending", http.StatusConflict)
+		return
+	}
+	m.log.InfoD("control-poll", kv.M{"remote_addr": r.RemoteAddr})
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleControlHosts serves each host found by the last poll, as JSON.
+func (m *Monitor) handleControlHosts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, m.Status().LastPoll.Hosts)
+}
+
+// handleControlEC2Cache drops the EC2 cache, e.g. after instances were
+// replaced, so the next poll reloads it.
+func (m *Monitor) handleControlEC2Cache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c, ok := m.checker.(cacheInvalidator)
+	if !ok {
+		http.Error(w, "the EC2 checker has no cache", http.StatusNotFound)
+		return
+	}
+	c.invalidateCache()
+	m.log.InfoD("control-ec2-cache-invalidated", kv.M{"remote_addr": r.RemoteAddr})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleControlConfig serves the configuration, with secrets redacted.
+func (m *Monitor) handleControlConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, m.config.Redacted())
+}
+
+// keyRotator swaps the SignalFX API key, e.g. when pushed a new one by a
+// secret manager.
+type keyRotator struct {
+	keys *tokenSink
+	log  kv.KayveeLogger
+}
+
+// ServeHTTP sets the key to the api_key of a POSTed JSON object. Only the
+// key's last 4 characters are logged.
+func (k *keyRotator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		APIKey string `json:"api_key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "body must be a JSON object with an api_key", http.StatusBadRequest)
+		return
+	}
+	if body.APIKey == "" {
+		http.Error(w, "missing api_key", http.StatusBadRequest)
+		return
+	}
+	k.keys.setToken(body.APIKey)
+	k.log.InfoD("sfx-key-rotated", kv.M{
+		"remote_addr": r.RemoteAddr,
+		"key":         redact(body.APIKey),
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
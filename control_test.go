@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+func TestControlMaintenance(t *testing.T) {
+	m, _ := newTestMonitor(testConfig(), &fakeSearcher{}, &fakeChecker{}, &fakeSink{})
+	control := newControlHandler(m, "secret-token", "/control/rotate-sfx-key", nil, nil)
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+		on     bool
+	}{
+		{name: "no token", status: http.StatusUnauthorized},
+		{name: "wrong token", token: "wrong", status: http.StatusUnauthorized},
+		{name: "token", token: "secret-token", status: http.StatusOK, on: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/control/maintenance", nil)
+			if test.token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			w := httptest.NewRecorder()
+			control.ServeHTTP(w, r)
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if on := m.maintenance.active(); on != test.on {
+				t.Errorf("maintenance on = %t, want %t", on, test.on)
+			}
+		})
+	}
+}
+
+func TestControlLogLevel(t *testing.T) {
+	m, _ := newTestMonitor(testConfig(), &fakeSearcher{}, &fakeChecker{}, &fakeSink{})
+	logLevel := newLogLevelHandler(m.log, kv.Info)
+	control := newControlHandler(m, "secret-token", "/control/rotate-sfx-key", nil, logLevel)
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+		level  string
+	}{
+		{name: "no token", status: http.StatusUnauthorized, level: "info"},
+		{name: "token", token: "secret-token", status: http.StatusOK, level: "debug"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/control/loglevel?level=debug", nil)
+			if test.token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			w := httptest.NewRecorder()
+			control.ServeHTTP(w, r)
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if level := logLevel.level.String(); level != test.level {
+				t.Errorf("log level = %s, want %s", level, test.level)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/Clever/log-monitor-es/hoststate"
+)
+
+// cooldownNotifier passes a host's transitions on to a Notifier at most once
+// per cooldown, so a host flapping around its threshold doesn't spam the
+// channel. Transitions held back are counted, and the count is passed on
+// with the host's next transition. The latest held back is passed on once
+// the cooldown ends, unless the host is back where it was last notified
+// about, so a recovery isn't lost. The cooldowns are kept with the hosts'
+// states, so they are saved with them.
+type cooldownNotifier struct {
+	channel  string
+	next     Notifier
+	cooldown time.Duration
+	states   *hoststate.Store
+	now      func() time.Time
+}
+
+// transitionHolder is implemented by Notifiers that hold transitions back,
+// to pass on by a later poll.
+type transitionHolder interface {
+	// release passes on the transitions held back long enough.
+	release(ctx context.Context) error
+}
+
+func (c *cooldownNotifier) setClock(now func() time.Time) {
+	c.now = now
+	if next, ok := c.next.(clockSetter); ok {
+		next.setClock(now)
+	}
+}
+
+// Notify passes on the transitions of hosts not cooling down, and holds the
+// others back. Transitions that fail to pass on are held back too, for the
+// next release to try again.
+func (c *cooldownNotifier) Notify(ctx context.Context, transitions []hostTransition) error {
+	now := c.now()
+	allowed := []hostTransition{}
+	// cooldowns are those of the allowed transitions, nil for forgotten
+	// hosts.
+	cooldowns := []*hoststate.Cooldown{}
+	for _, t := range transitions {
+		r, ok := c.states.Record(t.Host)
+		if !ok {
+			// Forgotten hosts have no more transitions to spam.
+			allowed = append(allowed, t)
+			cooldowns = append(cooldowns, nil)
+			continue
+		}
+		cd := r.Cooldown(c.channel)
+		if now.Before(cd.Until) {
+			c.hold(cd, t.Event)
+			continue
+		}
+		t.Suppressed = cd.Suppressed
+		allowed = append(allowed, t)
+		cooldowns = append(cooldowns, cd)
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+	err := c.next.Notify(ctx, allowed)
+	for i, cd := range cooldowns {
+		if cd == nil {
+			continue
+		}
+		if err != nil {
+			c.hold(cd, allowed[i].Event)
+		} else {
+			c.passed(now, cd, allowed[i].Event)
+		}
+	}
+	return err
+}
+
+// release passes on the latest transition held back for each host whose
+// cooldown has ended, as of the host's last poll. If that fails, they stay
+// held back for the next release.
+func (c *cooldownNotifier) release(ctx context.Context) error {
+	now := c.now()
+	released := []hostTransition{}
+	cooldowns := []*hoststate.Cooldown{}
+	for _, host := range c.states.Hosts() {
+		r, _ := c.states.Record(host)
+		cd, ok := r.Cooldowns[c.channel]
+		if !ok || cd.Held == "" || now.Before(cd.Until) {
+			continue
+		}
+		if cd.Held == cd.Notified {
+			// The channel already has the host's state; the flaps are
+			// counted with its next transition.
+			cd.Held = ""
+			continue
+		}
+		// The transition passed on isn't counted as held back.
+		released = append(released, hostTransition{
+			Host: host, Event: cd.Held, Lag: r.Lag, Latest: r.Latest, Suppressed: cd.Suppressed - 1,
+		})
+		cooldowns = append(cooldowns, cd)
+	}
+	if len(released) == 0 {
+		return nil
+	}
+	if err := c.next.Notify(ctx, released); err != nil {
+		return err
+	}
+	for i, cd := range cooldowns {
+		c.passed(now, cd, released[i].Event)
+	}
+	return nil
+}
+
+// hold counts a transition to event as held back.
+func (c *cooldownNotifier) hold(cd *hoststate.Cooldown, event string) {
+	cd.Suppressed++
+	cd.Held = event
+}
+
+// passed starts a cooldown for a transition to event passed on.
+func (c *cooldownNotifier) passed(now time.Time, cd *hoststate.Cooldown, event string) {
+	cd.Suppressed = 0
+	cd.Notified = event
+	cd.Held = ""
+	cd.Until = now.Add(c.cooldown)
+}
+
+// NotifyPoll passes poll events straight on, since they aren't per host.
+func (c *cooldownNotifier) NotifyPoll(ctx context.Context, events []pollEvent) error {
+	if p, ok := c.next.(pollEventNotifier); ok {
+		return p.NotifyPoll(ctx, events)
+	}
+	return nil
+}
+
+func (c *cooldownNotifier) takePublishFailures() int64 {
+	if f, ok := c.next.(publishFailureCounter); ok {
+		return f.takePublishFailures()
+	}
+	return 0
+}
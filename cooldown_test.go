@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Clever/log-monitor-es/hoststate"
+)
+
+// recordingNotifier records the transitions it is notified of, or fails
+// with err, if set.
+type recordingNotifier struct {
+	mu          sync.Mutex
+	transitions []hostTransition
+	err         error
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, transitions []hostTransition) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.err != nil {
+		return n.err
+	}
+	n.transitions = append(n.transitions, transitions...)
+	return nil
+}
+
+func (n *recordingNotifier) setErr(err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.err = err
+}
+
+// take returns the transitions notified since it was last called.
+func (n *recordingNotifier) take() []hostTransition {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	transitions := n.transitions
+	n.transitions = nil
+	return transitions
+}
+
+// newTestCooldown returns a cooldownNotifier with a 30m cooldown on a store
+// tracking ip-10-0-0-1, what it notifies, and its clock.
+func newTestCooldown() (*cooldownNotifier, *recordingNotifier, *fakeClock) {
+	states := hoststate.New(hoststate.Config{StalePolls: 1, RecoverPolls: 1})
+	states.Found(testNow, "ip-10-0-0-1", false, time.Second, testNow, 1)
+	next := &recordingNotifier{}
+	clock := newFakeClock()
+	c := &cooldownNotifier{channel: "slack", next: next, cooldown: 30 * time.Minute, states: states, now: clock.now}
+	return c, next, clock
+}
+
+// checkNotified fails t unless got is want, as events and suppressed counts.
+func checkNotified(t *testing.T, step string, got []hostTransition, want ...hostTransition) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s: notified %+v, want %+v", step, got, want)
+		return
+	}
+	for i := range want {
+		if got[i].Event != want[i].Event || got[i].Suppressed != want[i].Suppressed {
+			t.Errorf("%s: notified %+v, want %+v", step, got, want)
+			return
+		}
+	}
+}
+
+func TestCooldownNotifier(t *testing.T) {
+	c, next, clock := newTestCooldown()
+	ctx := context.Background()
+	stale := hostTransition{Host: "ip-10-0-0-1", Event: transitionStale}
+	recovered := hostTransition{Host: "ip-10-0-0-1", Event: transitionRecovered}
+
+	c.Notify(ctx, []hostTransition{stale})
+	checkNotified(t, "first transition", next.take(), stale)
+
+	clock.advance(time.Minute)
+	c.Notify(ctx, []hostTransition{recovered})
+	c.release(ctx)
+	checkNotified(t, "during the cooldown", next.take())
+
+	// The recovery isn't lost.
+	clock.advance(30 * time.Minute)
+	c.release(ctx)
+	checkNotified(t, "after the cooldown", next.take(), recovered)
+	c.release(ctx)
+	checkNotified(t, "released again", next.take())
+
+	// Flapping back to where the channel last heard isn't notified, but is
+	// counted.
+	clock.advance(time.Minute)
+	c.Notify(ctx, []hostTransition{stale})
+	c.Notify(ctx, []hostTransition{recovered})
+	clock.advance(30 * time.Minute)
+	c.release(ctx)
+	checkNotified(t, "back where notified", next.take())
+	c.Notify(ctx, []hostTransition{stale})
+	checkNotified(t, "next transition", next.take(), hostTransition{Event: transitionStale, Suppressed: 2})
+}
+
+func TestCooldownNotifierNewTransition(t *testing.T) {
+	c, next, clock := newTestCooldown()
+	ctx := context.Background()
+
+	c.Notify(ctx, []hostTransition{{Host: "ip-10-0-0-1", Event: transitionStale}})
+	clock.advance(time.Minute)
+	c.Notify(ctx, []hostTransition{{Host: "ip-10-0-0-1", Event: transitionRecovered}})
+	next.take()
+
+	// A transition after the cooldown supersedes the one held back.
+	clock.advance(30 * time.Minute)
+	c.Notify(ctx, []hostTransition{{Host: "ip-10-0-0-1", Event: transitionTerminated}})
+	c.release(ctx)
+	checkNotified(t, "after the cooldown", next.take(), hostTransition{Event: transitionTerminated, Suppressed: 1})
+}
+
+func TestCooldownNotifierFailure(t *testing.T) {
+	c, next, clock := newTestCooldown()
+	ctx := context.Background()
+	stale := hostTransition{Host: "ip-10-0-0-1", Event: transitionStale}
+	recovered := hostTransition{Host: "ip-10-0-0-1", Event: transitionRecovered}
+
+	next.setErr(errors.New("slack is down"))
+	if err := c.Notify(ctx, []hostTransition{stale}); err == nil {
+		t.Errorf("Notify with the channel down succeeded")
+	}
+	if err := c.release(ctx); err == nil {
+		t.Errorf("release with the channel down succeeded")
+	}
+
+	// The failed transition is sent once the channel is back, rather than
+	// the host being muted for a cooldown.
+	next.setErr(nil)
+	clock.advance(time.Minute)
+	c.release(ctx)
+	checkNotified(t, "channel back", next.take(), stale)
+
+	// And the cooldown starts from then.
+	clock.advance(time.Minute)
+	c.Notify(ctx, []hostTransition{recovered})
+	checkNotified(t, "during the cooldown", next.take())
+	next.setErr(errors.New("slack is down"))
+	clock.advance(30 * time.Minute)
+	c.release(ctx)
+	next.setErr(nil)
+	clock.advance(time.Minute)
+	c.release(ctx)
+	checkNotified(t, "released once the channel is back", next.take(), recovered)
+}
+
+func TestCooldownSavedAfterNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cooldown")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	config := testConfig()
+	config.HostStateFile = filepath.Join(dir, "states.json")
+	es := &fakeSearcher{heartbeats: map[string]Heartbeat{"ip-10-0-0-1": {Latest: testNow.Add(-10 * time.Minute)}}}
+	m, _ := newTestMonitor(config, es, &fakeChecker{}, &fakeSink{})
+	m.notifiers = append(m.notifiers, &cooldownNotifier{
+		channel: "slack", next: &recordingNotifier{}, cooldown: 30 * time.Minute, states: m.states, now: m.now,
+	})
+
+	if err := m.RunOnce(context.Background()); err != nil {
+		t.Fatalf("RunOnce: %s", err)
+	}
+
+	saved, err := hoststate.Load(hostStateConfig(config))
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	r, ok := saved.Record("ip-10-0-0-1")
+	if !ok || r.Cooldowns["slack"] == nil {
+		t.Fatalf("saved record = %+v, want the slack cooldown", r)
+	}
+	if want := testNow.Add(30 * time.Minute); !r.Cooldowns["slack"].Until.Equal(want) {
+		t.Errorf("saved cooldown until %s, want %s", r.Cooldowns["slack"].Until, want)
+	}
+}
+
+// pdReceiver records the PagerDuty events it receives.
+type pdReceiver struct {
+	mu     sync.Mutex
+	events []pdEvent
+}
+
+func (r *pdReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var event pdEvent
+	json.NewDecoder(req.Body).Decode(&event)
+	r.mu.Lock()
+	r.events = append(r.events, event)
+	r.mu.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// take returns the events received since it was last called.
+func (r *pdReceiver) take() []pdEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := r.events
+	r.events = nil
+	return events
+}
+
+func TestPagerDutyCooldown(t *testing.T) {
+	receiver := &pdReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	config := testConfig()
+	config.PagerDutyEventsURL = server.URL
+	config.PagerDutyStaleAfter = 15 * time.Minute
+	config.NotifyCooldown = 30 * time.Minute
+	log, _ := newTestLogger()
+	p := newPagerDuty(config, log)
+	p.states = hoststate.New(hoststate.Config{StalePolls: 1, RecoverPolls: 1})
+	p.states.Found(testNow, "ip-10-0-0-1", false, time.Second, testNow, 1)
+	clock := newFakeClock()
+	p.setClock(clock.now)
+	ctx := context.Background()
+
+	// update polls with the host lag behind.
+	update := func(lag time.Duration) []pdEvent {
+		t.Helper()
+		heartbeats := map[string]Heartbeat{"ip-10-0-0-1": {Latest: clock.now().Add(-lag)}}
+		if err := p.update(ctx, heartbeats, nil); err != nil {
+			t.Fatalf("update: %s", err)
+		}
+		return receiver.take()
+	}
+	actions := func(events []pdEvent) []string {
+		actions := []string{}
+		for _, event := range events {
+			actions = append(actions, event.EventAction)
+		}
+		return actions
+	}
+
+	if got := actions(update(time.Hour)); len(got) != 1 || got[0] != "trigger" {
+		t.Fatalf("stale host sent %v, want a trigger", got)
+	}
+	clock.advance(time.Minute)
+	if got := actions(update(time.Second)); len(got) != 1 || got[0] != "resolve" {
+		t.Fatalf("recovered host sent %v, want a resolve, never held back", got)
+	}
+	// Two flaps in the cooldown, found stale by several polls each.
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 2; j++ {
+			clock.advance(time.Minute)
+			if got := actions(update(time.Hour)); len(got) != 0 {
+				t.Fatalf("stale host in its cooldown sent %v, want it held back", got)
+			}
+		}
+		clock.advance(time.Minute)
+		update(time.Second)
+	}
+	clock.advance(time.Minute)
+	update(time.Hour)
+
+	clock.advance(30 * time.Minute)
+	events := update(time.Hour)
+	if got := actions(events); len(got) != 1 || got[0] != "trigger" {
+		t.Fatalf("stale host after its cooldown sent %v, want a trigger", got)
+	}
+	if flaps := events[0].Payload.CustomDetails["flaps"]; flaps != float64(3) {
+		t.Errorf("trigger flaps = %v, want 3", flaps)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/signalfx/golib/datapoint"
+)
+
+// DatadogSink sends datapoints to a DogStatsD agent over UDP, with their
+// dimensions as tags.
+type DatadogSink struct {
+	conn   net.Conn
+	prefix string
+}
+
+// NewDatadogSink returns a DatadogSink sending to the agent at addr, with
+// prefix prepended to every metric name.
+func NewDatadogSink(addr, prefix string) (*DatadogSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &DatadogSink{conn: conn, prefix: prefix}, nil
+}
+
+// AddDatapoints sends each of points in its own packet. Counters are sent as
+// DogStatsD counts, everything else as gauges.
+func (d *DatadogSink) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint) error {
+	for _, point := range points {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := d.conn.Write([]byte(d.format(point))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// format serializes point as <metric>:<value>|g|#tag1:val1,tag2:val2.
+func (d *DatadogSink) format(point *datapoint.Datapoint) string {
+	metricType := "g"
+	if point.MetricType == datapoint.Counter || point.MetricType == datapoint.Count {
+		metricType = "c"
+	}
+	line := d.prefix + point.Metric + ":" + point.Value.String() + "|" + metricType
+
+	tags := make([]string, 0, len(point.Dimensions))
+	for key, value := range point.Dimensions {
+		tags = append(tags, sanitizeTag(key)+":"+sanitizeTag(value))
+	}
+	if len(tags) > 0 {
+		sort.Strings(tags)
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+// tagReplacer replaces the characters that delimit tags in DogStatsD.
+var tagReplacer = strings.NewReplacer(",", "_", "|", "_", "#", "_")
+
+func sanitizeTag(s string) string {
+	return tagReplacer.Replace(s)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// sfxDetectors manages detectors through the SignalFX REST API.
+type sfxDetectors struct {
+	apiURL string
+	token  string
+	client *http.Client
+}
+
+// sfxDetector is the part of a SignalFX detector the monitor sets.
+type sfxDetector struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	ProgramText string            `json:"programText"`
+	Rules       []sfxDetectorRule `json:"rules"`
+}
+
+type sfxDetectorRule struct {
+	DetectLabel string `json:"detectLabel"`
+	Severity    string `json:"severity"`
+}
+
+// lagDetector alerts when any host's lag stays above threshold.
+func (m *Monitor) lagDetector(threshold time.Duration) sfxDetector {
+	name := m.config.ComponentName + "-heartbeat-lag"
+	program := fmt.Sprintf(
+		"detect(when(data('%s', filter=filter('component', '%s') and filter('environment', '%s')).max(by=['hostname']) > %d, '5m')).publish('%s')",
+		m.metricName("-lag"), m.config.ComponentName, m.config.Environment, int64(threshold.Seconds()), name)
+	return sfxDetector{
+		Name:        name,
+		Description: "Created by log-monitor-es: a host's heartbeats are lagging.",
+		ProgramText: program,
+		Rules:       []sfxDetectorRule{{DetectLabel: name, Severity: "Critical"}},
+	}
+}
+
+// ensure creates detector unless one with its name already exists, and
+// reports whether it did. An existing detector is left as it is, in case it
+// was tuned by hand.
+func (d *sfxDetectors) ensure(ctx context.Context, detector sfxDetector) (bool, error) {
+	var found struct {
+		Count int `json:"count"`
+	}
+	query := url.Values{"name": {detector.Name}, "limit": {"1"}}
+	if err := d.do(ctx, http.MethodGet, "/v2/detector?"+query.Encode(), nil, &found); err != nil {
+		return false, fmt.Errorf("looking up detector %s: %w", detector.Name, err)
+	}
+	if found.Count > 0 {
+		return false, nil
+	}
+	if err := d.do(ctx, http.MethodPost, "/v2/detector", detector, nil); err != nil {
+		return false, fmt.Errorf("creating detector %s: %w", detector.Name, err)
+	}
+	return true, nil
+}
+
+func (d *sfxDetectors) do(ctx context.Context, method, path string, body, result interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(d.apiURL, "/")+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-SF-Token", d.token)
+	resp, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
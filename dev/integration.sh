@@ -0,0 +1,23 @@
+#!/usr/bin/env bash
+# Runs the monitor against the dev Docker Compose stack and checks that it
+# reports the seeded hosts.
+set -euo pipefail
+
+COMPOSE="docker-compose -f docker-compose.dev.yml"
+trap '$COMPOSE down -v' EXIT
+
+$COMPOSE up -d elasticsearch sfx
+./dev/seed.sh
+$COMPOSE up -d --build monitor
+
+for i in $(seq 30); do
+  metrics=$(curl -sf http://localhost:8080/debug/metrics || true)
+  if grep -q dev-host-1 <<< "$metrics" && grep -q dev-host-2 <<< "$metrics"; then
+    echo "PASS: the monitor reported both seeded hosts"
+    exit 0
+  fi
+  sleep 3
+done
+$COMPOSE logs monitor
+echo "FAIL: the monitor didn't report the seeded hosts"
+exit 1
@@ -0,0 +1,17 @@
+"""A stand-in for SignalFX ingest: logs each request and answers like SignalFX does."""
+from http.server import BaseHTTPRequestHandler, HTTPServer
+
+
+class Handler(BaseHTTPRequestHandler):
+    def do_POST(self):
+        body = self.rfile.read(int(self.headers.get("Content-Length", 0)))
+        print("%s %s token=%s type=%s bytes=%d" % (
+            self.command, self.path, self.headers.get("X-SF-Token"),
+            self.headers.get("Content-Type"), len(body)), flush=True)
+        self.send_response(200)
+        self.send_header("Content-Type", "application/json")
+        self.end_headers()
+        self.wfile.write(b'"OK"')
+
+
+HTTPServer(("", 8080), Handler).serve_forever()
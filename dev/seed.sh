@@ -0,0 +1,31 @@
+#!/usr/bin/env bash
+# Waits for the dev ES cluster, then indexes synthetic heartbeats: dev-host-1
+# is up to date and dev-host-2 last heartbeat 10 minutes ago.
+set -euo pipefail
+
+ES=${ES:-http://localhost:9200}
+INDEX=${INDEX:-logs-dev}
+
+for i in $(seq 60); do
+  curl -sf "$ES/_cluster/health?wait_for_status=yellow&timeout=1s" > /dev/null && break
+  echo "waiting for elasticsearch..."
+  sleep 2
+done
+
+curl -sf -XDELETE "$ES/$INDEX" > /dev/null || true
+curl -sf -XPUT "$ES/$INDEX" -H 'Content-Type: application/json' -d '{
+  "mappings": {"doc": {"properties": {
+    "title": {"type": "keyword"},
+    "hostname": {"type": "keyword"},
+    "timestamp": {"type": "date"}
+  }}}
+}' > /dev/null
+
+now=$(date +%s)
+heartbeat() {
+  curl -sf -XPOST "$ES/$INDEX/doc?refresh=true" -H 'Content-Type: application/json' \
+    -d "{\"title\": \"heartbeat\", \"hostname\": \"$1\", \"timestamp\": $2}" > /dev/null
+}
+heartbeat dev-host-1 "${now}000"
+heartbeat dev-host-2 "$((now - 600))000"
+echo "seeded $INDEX with heartbeats from dev-host-1 and dev-host-2"
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// digestNotifier holds back a Notifier's transitions and passes them on
+// together every interval, as one summary, rather than after every poll.
+// Transitions of hosts matching a critical pattern aren't held back. It is
+// safe for concurrent use.
+type digestNotifier struct {
+	channel  string
+	next     Notifier
+	log      kv.KayveeLogger
+	interval time.Duration
+	// maxPending, if positive, is how many hosts can be held back before
+	// they are passed on early.
+	maxPending int
+	critical   []func(host string) bool
+
+	mu sync.Mutex
+	// pending is the latest transition of each host held back. They are
+	// kept until passed on successfully, so an unreachable notifier only
+	// delays them.
+	pending map[string]hostTransition
+}
+
+// setClock sets the clock of the notifier it passes transitions on to.
+func (d *digestNotifier) setClock(now func() time.Time) {
+	if next, ok := d.next.(clockSetter); ok {
+		next.setClock(now)
+	}
+}
+
+func newDigestNotifier(channel string, next Notifier, config Config, log kv.KayveeLogger) *digestNotifier {
+	d := &digestNotifier{
+		channel:    channel,
+		next:       next,
+		log:        log,
+		interval:   config.DigestInterval,
+		maxPending: config.DigestMaxTransitions,
+		pending:    map[string]hostTransition{},
+	}
+	for _, pattern := range config.DigestCriticalHosts {
+		// loadConfig checked the patterns already.
+		match, _ := hostMatcher(pattern)
+		d.critical = append(d.critical, match)
+	}
+	return d
+}
+
+// Notify passes on the transitions of critical hosts, and holds back the
+// rest, passing them all on if there are now too many held back.
+func (d *digestNotifier) Notify(ctx context.Context, transitions []hostTransition) error {
+	critical := []hostTransition{}
+	d.mu.Lock()
+	for _, t := range transitions {
+		if d.isCritical(t.Host) {
+			critical = append(critical, t)
+			continue
+		}
+		d.pending[t.Host] = t
+	}
+	full := d.maxPending > 0 && len(d.pending) >= d.maxPending
+	d.mu.Unlock()
+
+	if len(critical) > 0 {
+		if err := d.next.Notify(ctx, critical); err != nil {
+			return err
+		}
+	}
+	if full {
+		return d.flush(ctx)
+	}
+	return nil
+}
+
+func (d *digestNotifier) isCritical(host string) bool {
+	for _, match := range d.critical {
+		if match(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// NotifyPoll passes poll events straight on, since there are few of them.
+func (d *digestNotifier) NotifyPoll(ctx context.Context, events []pollEvent) error {
+	if p, ok := d.next.(pollEventNotifier); ok {
+		return p.NotifyPoll(ctx, events)
+	}
+	return nil
+}
+
+func (d *digestNotifier) takePublishFailures() int64 {
+	if c, ok := d.next.(publishFailureCounter); ok {
+		return c.takePublishFailures()
+	}
+	return 0
+}
+
+// flush passes on the transitions held back, sorted by host. If that fails
+// they are held back again, unless a newer transition of the same host came
+// meanwhile.
+func (d *digestNotifier) flush(ctx context.Context) error {
+	d.mu.Lock()
+	pending := d.pending
+	d.pending = map[string]hostTransition{}
+	d.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	transitions := make([]hostTransition, 0, len(pending))
+	for _, t := range pending {
+		transitions = append(transitions, t)
+	}
+	sort.Slice(transitions, func(i, j int) bool { return transitions[i].Host < transitions[j].Host })
+	err := d.next.Notify(ctx, transitions)
+	if err != nil {
+		d.mu.Lock()
+		for host, t := range pending {
+			if _, ok := d.pending[host]; !ok {
+				d.pending[host] = t
+			}
+		}
+		d.mu.Unlock()
+		return err
+	}
+	d.log.DebugD("digest-sent", kv.M{"channel": d.channel, "hosts": len(transitions)})
+	return nil
+}
+
+// Run passes on the transitions held back every interval until ctx is done.
+func (d *digestNotifier) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.flush(ctx); err != nil {
+				d.log.ErrorD("digest", kv.M{"channel": d.channel, "error": err.Error()})
+			}
+		}
+	}
+}
+
+// flushDigests passes on every digest's transitions held back, e.g. so
+// none are lost when the monitor is stopped.
+func (m *Monitor) flushDigests(ctx context.Context) {
+	for _, n := range m.notifiers {
+		if c, ok := n.(*cooldownNotifier); ok {
+			n = c.next
+		}
+		if d, ok := n.(*digestNotifier); ok {
+			if err := d.flush(ctx); err != nil {
+				m.log.ErrorD("digest", kv.M{"channel": d.channel, "error": err.Error()})
+			}
+		}
+	}
+}
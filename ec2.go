@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// errEC2Throttled is returned while EC2 is throttling our requests.
+var errEC2Throttled = errors.New("EC2 requests are being throttled")
+
+const (
+	minThrottleBackoff = 30 * time.Second
+	maxThrottleBackoff = 5 * time.Minute
+)
+
+// RunningChecker reports on the state of the instance with a private IP.
+type RunningChecker interface {
+	// IsRunning reports whether the instance is running.
+	IsRunning(ctx context.Context, ip string) (bool, error)
+	// IsSuppressed reports whether the instance is tagged to have its lag
+	// suppressed, e.g. during planned maintenance.
+	IsSuppressed(ctx context.Context, ip string) (bool, error)
+}
+
+// instanceTyper is implemented by RunningCheckers that know the instance
+// types of the instances they check.
+type instanceTyper interface {
+	instanceType(ip string) (string, bool)
+}
+
+// zoner is implemented by RunningCheckers that know the availability zones
+// of the instances they check.
+type zoner interface {
+	availabilityZone(ip string) (string, bool)
+}
+
+// prefetcher is implemented by RunningCheckers that can load their state
+// ahead of the checks.
+type prefetcher interface {
+	prefetch(ctx context.Context) error
+}
+
+// ec2IPChecker is a RunningChecker backed by a cache of EC2's instances. It
+// is safe for concurrent use: reads of the cache don't lock, and refreshes
+// update it in place.
+type ec2IPChecker struct {
+	// lastCheck is when the cache was last refreshed, in Unix nanoseconds, or
+	// zero before the first refresh and once invalidated. It is accessed
+	// atomically, so it comes first to be 64-bit aligned.
+	lastCheck int64
+
+	ec2api            ec2iface.EC2API
+	log               kv.KayveeLogger
+	privateIPsRunning sync.Map
+
+	// Instances tagged suppressTagKey=suppressTagValue are suppressed. No
+	// instances are suppressed when suppressTagKey is empty.
+	suppressTagKey       string
+	suppressTagValue     string
+	privateIPsSuppressed sync.Map
+
+	// instanceTypes maps the private IPs of running instances to their
+	// instance types.
+	instanceTypes sync.Map
+	// availabilityZones maps the private IPs of running instances to their
+	// availability zones.
+	availabilityZones sync.Map
+
+	// filterTags limit the instances described to those carrying all of them.
+	filterTags []Tag
+
+	// checkStatus treats instances failing their EC2 status checks as not
+	// running.
+	checkStatus bool
+
+	// now is the clock the cache's age and throttling backoff are measured
+	// by.
+	now func() time.Time
+
+	// refreshMu serializes refreshes and guards the fields below.
+	refreshMu sync.Mutex
+
+	// After being throttled, no requests are made until backoffUntil. The
+	// backoff doubles each time we're throttled in a row.
+	backoff      time.Duration
+	backoffUntil time.Time
+}
+
+func (e *ec2IPChecker) setClock(now func() time.Time) {
+	e.now = now
+}
+
+// fresh reports whether the cache was refreshed in the last minute.
+func (e *ec2IPChecker) fresh() bool {
+	lastCheck := atomic.LoadInt64(&e.lastCheck)
+	return lastCheck != 0 && e.now().Sub(time.Unix(0, lastCheck)) < 1*time.Minute
+}
+
+// invalidateCache makes the next check refresh the cache. The cache is kept
+// until then.
+func (e *ec2IPChecker) invalidateCache() {
+	atomic.StoreInt64(&e.lastCheck, 0)
+}
+
+// prefetch refreshes the cache if it is stale.
+func (e *ec2IPChecker) prefetch(ctx context.Context) error {
+	return e.updateCache(ctx)
+}
+
+func (e *ec2IPChecker) updateCache(ctx context.Context) error {
+	if e.fresh() {
+		return nil
+	}
+
+	e.refreshMu.Lock()
+	defer e.refreshMu.Unlock()
+
+	// Another caller may have refreshed the cache while we waited.
+	if e.fresh() {
+		return nil
+	}
+	if e.now().Before(e.backoffUntil) {
+		// Make do with the stale cache, if any, rather than make throttling
+		// worse.
+		if atomic.LoadInt64(&e.lastCheck) != 0 {
+			return nil
+		}
+		return errEC2Throttled
+	}
+
+	err := e.refresh(ctx)
+	if request.IsErrorThrottle(err) {
+		e.backoff *= 2
+		if e.backoff < minThrottleBackoff {
+			e.backoff = minThrottleBackoff
+		} else if e.backoff > maxThrottleBackoff {
+			e.backoff = maxThrottleBackoff
+		}
+		e.backoffUntil = e.now().Add(e.backoff)
+		return fmt.Errorf("%w: %s", errEC2Throttled, err)
+	}
+	if err == nil {
+		e.backoff = 0
+	}
+	return err
+}
+
+// refresh replaces the cache with the current state of EC2.
+func (e *ec2IPChecker) refresh(ctx context.Context) error {
+	start := e.now()
+	pageCount, instanceCount := 0, 0
+	privateIPsRunning := map[string]struct{}{}
+	privateIPsSuppressed := map[string]struct{}{}
+	privateIPsByID := map[string]string{}
+	instanceTypes := map[string]string{}
+	availabilityZones := map[string]string{}
+	filters := []*ec2.Filter{{
+		Name:   aws.String("instance-state-name"),
+		Values: []*string{aws.String("running")},
+	}}
+	for _, tag := range e.filterTags {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("tag:" + tag.Key),
+			Values: []*string{aws.String(tag.Value)},
+		})
+	}
+
+	if err := e.ec2api.DescribeInstancesPagesWithContext(ctx, &ec2.DescribeInstancesInput{
+		Filters: filters,
+	}, func(output *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		pageCount++
+		for _, res := range output.Reservations {
+			for _, instance := range res.Instances {
+				instanceCount++
+				if instance.PrivateIpAddress == nil {
+					continue
+				}
+				privateIPsRunning[*instance.PrivateIpAddress] = struct{}{}
+				privateIPsByID[aws.StringValue(instance.InstanceId)] = *instance.PrivateIpAddress
+				instanceTypes[*instance.PrivateIpAddress] = aws.StringValue(instance.InstanceType)
+				if instance.Placement != nil {
+					availabilityZones[*instance.PrivateIpAddress] = aws.StringValue(instance.Placement.AvailabilityZone)
+				}
+				if e.hasSuppressTag(instance) {
+					privateIPsSuppressed[*instance.PrivateIpAddress] = struct{}{}
+				}
+			}
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+
+	if e.checkStatus {
+		if err := e.removeImpaired(ctx, privateIPsRunning, privateIPsByID); err != nil {
+			return err
+		}
+	}
+	loggerFrom(ctx, e.log).DebugD("ec2-cache-refreshed", kv.M{
+		"pages":       pageCount,
+		"instances":   instanceCount,
+		"duration_ms": e.now().Sub(start).Milliseconds(),
+	})
+
+	replaceAll(&e.privateIPsRunning, privateIPsRunning)
+	replaceAll(&e.privateIPsSuppressed, privateIPsSuppressed)
+	replaceAllValues(&e.instanceTypes, instanceTypes)
+	replaceAllValues(&e.availabilityZones, availabilityZones)
+	atomic.StoreInt64(&e.lastCheck, e.now().UnixNano())
+	return nil
+}
+
+// replaceAll updates cache in place to hold exactly ips, so concurrent
+// readers never see it empty.
+func replaceAll(cache *sync.Map, ips map[string]struct{}) {
+	for ip := range ips {
+		cache.Store(ip, struct{}{})
+	}
+	cache.Range(func(ip, _ interface{}) bool {
+		if _, ok := ips[ip.(string)]; !ok {
+			cache.Delete(ip)
+		}
+		return true
+	})
+}
+
+// replaceAllValues is replaceAll for caches holding a value for each IP.
+func replaceAllValues(cache *sync.Map, values map[string]string) {
+	for ip, value := range values {
+		cache.Store(ip, value)
+	}
+	cache.Range(func(ip, _ interface{}) bool {
+		if _, ok := values[ip.(string)]; !ok {
+			cache.Delete(ip)
+		}
+		return true
+	})
+}
+
+// removeImpaired removes the instances whose system or instance status checks
+// aren't ok from privateIPsRunning. Such instances may be "running" while
+// e.g. an OS-level failure stops them heartbeating.
+func (e *ec2IPChecker) removeImpaired(ctx context.Context, privateIPsRunning map[string]struct{}, privateIPsByID map[string]string) error {
+	return e.ec2api.DescribeInstanceStatusPagesWithContext(ctx, &ec2.DescribeInstanceStatusInput{},
+		func(output *ec2.DescribeInstanceStatusOutput, lastPage bool) bool {
+			for _, status := range output.InstanceStatuses {
+				ip, ok := privateIPsByID[aws.StringValue(status.InstanceId)]
+				if !ok {
+					continue
+				}
+				if !statusOK(status.SystemStatus) || !statusOK(status.InstanceStatus) {
+					delete(privateIPsRunning, ip)
+				}
+			}
+			return true
+		})
+}
+
+func statusOK(summary *ec2.InstanceStatusSummary) bool {
+	return summary != nil && aws.StringValue(summary.Status) == ec2.SummaryStatusOk
+}
+
+func (e *ec2IPChecker) hasSuppressTag(instance *ec2.Instance) bool {
+	if e.suppressTagKey == "" {
+		return false
+	}
+	for _, tag := range instance.Tags {
+		if aws.StringValue(tag.Key) == e.suppressTagKey && aws.StringValue(tag.Value) == e.suppressTagValue {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *ec2IPChecker) IsRunning(ctx context.Context, ip string) (bool, error) {
+	if err := e.updateCache(ctx); err != nil {
+		return false, err
+	}
+	_, ok := e.privateIPsRunning.Load(ip)
+	return ok, nil
+}
+
+func (e *ec2IPChecker) IsSuppressed(ctx context.Context, ip string) (bool, error) {
+	if err := e.updateCache(ctx); err != nil {
+		return false, err
+	}
+	_, ok := e.privateIPsSuppressed.Load(ip)
+	return ok, nil
+}
+
+// instanceType returns the instance type of the running instance with the
+// private IP, as of the last refresh.
+func (e *ec2IPChecker) instanceType(ip string) (string, bool) {
+	instanceType, ok := e.instanceTypes.Load(ip)
+	if !ok {
+		return "", false
+	}
+	return instanceType.(string), instanceType != ""
+}
+
+// availabilityZone returns the availability zone of the running instance
+// with the private IP, as of the last refresh.
+func (e *ec2IPChecker) availabilityZone(ip string) (string, bool) {
+	zone, ok := e.availabilityZones.Load(ip)
+	if !ok {
+		return "", false
+	}
+	return zone.(string), zone != ""
+}
+
+func (e *ec2IPChecker) cacheStatus() (lastRefresh time.Time, size int) {
+	if lastCheck := atomic.LoadInt64(&e.lastCheck); lastCheck != 0 {
+		lastRefresh = time.Unix(0, lastCheck)
+	}
+	e.privateIPsRunning.Range(func(_, _ interface{}) bool {
+		size++
+		return true
+	})
+	return lastRefresh, size
+}
+
+// ec2EndpointResolver sends EC2 requests to endpoint, e.g. LocalStack's, and
+// resolves other services as usual.
+func ec2EndpointResolver(endpoint string) endpoints.ResolverFunc {
+	return func(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		if service == ec2.EndpointsID {
+			return endpoints.ResolvedEndpoint{URL: endpoint, SigningRegion: region}, nil
+		}
+		return endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+	}
+}
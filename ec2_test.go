@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// fakeEC2 is an EC2API describing the running instances with the private IPs
+// in ips. Other methods panic.
+type fakeEC2 struct {
+	ec2iface.EC2API
+
+	mu    sync.Mutex
+	ips   []string
+	calls int
+	// block, if set, holds each describe until it is closed, failing it
+	// after a second.
+	block <-chan struct{}
+}
+
+func (f *fakeEC2) setIPs(ips ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ips = ips
+}
+
+func (f *fakeEC2) describeCalls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+func (f *fakeEC2) DescribeInstancesPagesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool, opts ...request.Option) error {
+	f.mu.Lock()
+	f.calls++
+	f.mu.Unlock()
+	if f.block != nil {
+		select {
+		case <-f.block:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+			return errors.New("describe blocked")
+		}
+	}
+	f.mu.Lock()
+	instances := []*ec2.Instance{}
+	for _, ip := range f.ips {
+		instances = append(instances, &ec2.Instance{
+			InstanceId:       aws.String("i-" + ip),
+			PrivateIpAddress: aws.String(ip),
+		})
+	}
+	f.mu.Unlock()
+	fn(&ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{{Instances: instances}},
+	}, true)
+	return nil
+}
+
+func newTestEC2Checker(api ec2iface.EC2API) *ec2IPChecker {
+	log, _ := newTestLogger()
+	return &ec2IPChecker{ec2api: api, log: log, now: time.Now}
+}
+
+// TestEC2IsRunningDuringRefresh checks that a refresh never makes an
+// instance that stays running look terminated to concurrent checks. Run it
+// with -race.
+func TestEC2IsRunningDuringRefresh(t *testing.T) {
+	api := &fakeEC2{ips: []string{"10.0.0.1", "10.0.0.2"}}
+	checker := newTestEC2Checker(api)
+	ctx := context.Background()
+	if _, err := checker.IsRunning(ctx, "10.0.0.1"); err != nil {
+		t.Fatalf("IsRunning: %s", err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				running, err := checker.IsRunning(ctx, "10.0.0.1")
+				if err != nil {
+					t.Errorf("IsRunning: %s", err)
+					return
+				}
+				if !running {
+					t.Errorf("10.0.0.1 not running during a refresh")
+					return
+				}
+			}
+		}()
+	}
+
+	// Churn the other instance so every refresh both adds and deletes.
+	for i := 0; i < 200; i++ {
+		if i%2 == 0 {
+			api.setIPs("10.0.0.1")
+		} else {
+			api.setIPs("10.0.0.1", "10.0.0.2")
+		}
+		checker.invalidateCache()
+		if err := checker.updateCache(ctx); err != nil {
+			t.Fatalf("updateCache: %s", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+// TestEC2RefreshDuringSearch checks that the EC2 cache is refreshed while
+// Elasticsearch is queried, not before: the refresh can't finish until the
+// search has started.
+func TestEC2RefreshDuringSearch(t *testing.T) {
+	searching := make(chan struct{})
+	es := &fakeSearcher{
+		heartbeats: map[string]Heartbeat{"ip-10-0-0-1": {Latest: testNow.Add(-10 * time.Minute)}},
+		onSearch:   func() { close(searching) },
+	}
+	api := &fakeEC2{ips: []string{"10.0.0.1"}, block: searching}
+	checker := newTestEC2Checker(api)
+	sink := &fakeSink{}
+	m, _ := newTestMonitor(testConfig(), es, checker, sink)
+
+	if err := m.RunOnce(context.Background()); err != nil {
+		t.Fatalf("RunOnce: %s", err)
+	}
+	// A second describe means the first failed, waiting for the search.
+	if calls := api.describeCalls(); calls != 1 {
+		t.Fatalf("described instances %d times, want 1", calls)
+	}
+	if got := value(sink.point("heartbeat-lag", "ip-10-0-0-1")); got != 600 {
+		t.Errorf("heartbeat-lag = %v, want 600", got)
+	}
+}
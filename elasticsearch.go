@@ -0,0 +1,701 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+	elastic "gopkg.in/olivere/elastic.v5"
+)
+
+var errNoResultsFound = errors.New("No search results found")
+
+// Kinds of FailedSearchError.
+var (
+	errESTimeout       = errors.New("Elasticsearch search timed out")
+	errESQueryRejected = errors.New("Elasticsearch rejected the search")
+)
+
+type FailedSearchError struct {
+	originalErr error
+	// kind, if set, is errESTimeout or errESQueryRejected.
+	kind error
+}
+
+// newFailedSearchError classifies the error a search failed with.
+func newFailedSearchError(err error) FailedSearchError {
+	var esErr *elastic.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || elastic.IsTimeout(err):
+		return FailedSearchError{originalErr: err, kind: errESTimeout}
+	case errors.As(err, &esErr) && esErr.Status >= 400 && esErr.Status < 500:
+		return FailedSearchError{originalErr: err, kind: errESQueryRejected}
+	}
+	return FailedSearchError{originalErr: err}
+}
+
+func (e FailedSearchError) Error() string {
+	return "error while searching: " + e.originalErr.Error()
+}
+
+// Is reports whether target is the kind of e.
+func (e FailedSearchError) Is(target error) bool {
+	return e.kind != nil && target == e.kind
+}
+
+func (e FailedSearchError) Unwrap() error {
+	return e.originalErr
+}
+
+// Heartbeat summarizes the recent heartbeats of a host.
+type Heartbeat struct {
+	// Latest is when the host last heartbeat.
+	Latest time.Time
+	// ExpectedInterval is how often the host heartbeats, if its heartbeat
+	// documents carry an expected_interval field (in seconds).
+	ExpectedInterval time.Duration
+	// Count is the number of heartbeats the host sent.
+	Count int64
+	// Indices are the indices the host's heartbeats were found in, when
+	// several are searched.
+	Indices []string
+}
+
+// HeartbeatSearcher looks up heartbeat documents.
+type HeartbeatSearcher interface {
+	// LatestHeartbeats summarizes the heartbeats of every host that sent one
+	// in the last hour.
+	LatestHeartbeats(ctx context.Context) (map[string]Heartbeat, error)
+	// LatestSample returns the raw _source of the most recent heartbeat
+	// document for host.
+	LatestSample(ctx context.Context, host string) (*json.RawMessage, error)
+}
+
+const (
+	// esRebuildAfter is how many searches in a row must fail to connect
+	// before the client is rebuilt.
+	esRebuildAfter = 3
+	// esMinRebuildInterval limits how often the client is rebuilt.
+	esMinRebuildInterval = 5 * time.Minute
+)
+
+// distinctComponentsAggSize is the most components, and environments of
+// each, counted.
+const distinctComponentsAggSize = 1000
+
+// newESClient returns a client for the configured cluster.
+func newESClient(config Config) (*elastic.Client, error) {
+	// For AWS logs-* clusters, access is controlled by IP address so no signing is needed,
+	// but since AWS blocks some APIs, sniffing and healthchecks are disabled.
+	return elastic.NewClient(
+		elastic.SetURL(config.ElasticsearchURI),
+		elastic.SetScheme("https"),
+		elastic.SetSniff(false),
+		elastic.SetHealthcheck(false),
+	)
+}
+
+// esSearcher is a HeartbeatSearcher backed by Elasticsearch.
+//
+// Without healthchecks, the client never revives connections it marked dead,
+// so it stays broken after the cluster's IPs change (AWS does this during
+// blue/green domain updates). esSearcher rebuilds it after esRebuildAfter
+// searches in a row fail to connect, at most once per esMinRebuildInterval.
+type esSearcher struct {
+	config Config
+	log    kv.KayveeLogger
+	now    func() time.Time
+
+	// hostField, if set, replaces the hostname field, e.g. with its keyword
+	// sub-field. It is set by checkMappings before searching.
+	hostField string
+
+	mu           sync.Mutex
+	client       *elastic.Client
+	connFailures int
+	lastRebuild  time.Time
+	rebuilds     int64
+	// components is the number of component/environment pairs found by the
+	// last search, with TrackDistinctComponents.
+	components int
+}
+
+func (s *esSearcher) setClock(now func() time.Time) {
+	s.now = now
+}
+
+// clientRebuilder is implemented by HeartbeatSearchers that rebuild their
+// client after persistent connection failures.
+type clientRebuilder interface {
+	// takeClientRebuilds returns the number of rebuilds since it was last
+	// called.
+	takeClientRebuilds() int64
+}
+
+func (s *esSearcher) getClient() *elastic.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.client
+}
+
+// observe records the outcome of a search, rebuilding the client if searches
+// keep failing to connect.
+func (s *esSearcher) observe(ctx context.Context, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !isConnFailure(err) {
+		s.connFailures = 0
+		return
+	}
+	s.connFailures++
+	if s.connFailures < esRebuildAfter || s.now().Sub(s.lastRebuild) < esMinRebuildInterval {
+		return
+	}
+
+	client, err := newESClient(s.config)
+	if err != nil {
+		loggerFrom(ctx, s.log).ErrorD("es-client-rebuild", kv.M{"error": err.Error()})
+		return
+	}
+	loggerFrom(ctx, s.log).WarnD("es-client-rebuilt", kv.M{"failures": s.connFailures})
+	s.client.Stop()
+	s.client = client
+	s.connFailures = 0
+	s.lastRebuild = s.now()
+	s.rebuilds++
+}
+
+func (s *esSearcher) takeClientRebuilds() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rebuilds := s.rebuilds
+	s.rebuilds = 0
+	return rebuilds
+}
+
+// componentCounter is implemented by HeartbeatSearchers that count the
+// components reporting.
+type componentCounter interface {
+	// distinctComponents returns the number of component/environment pairs
+	// found by the last search.
+	distinctComponents() int
+}
+
+func (s *esSearcher) distinctComponents() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.components
+}
+
+// isIndexNotFound reports whether err is ES not finding the index searched.
+func isIndexNotFound(err error) bool {
+	var esErr *elastic.Error
+	return errors.As(err, &esErr) && esErr.Details != nil && esErr.Details.Type == "index_not_found_exception"
+}
+
+// isConnFailure reports whether err means the cluster couldn't be reached at
+// all, as opposed to a search failing.
+func isConnFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var opErr *net.OpError
+	return elastic.IsConnErr(err) || errors.As(err, &opErr)
+}
+
+func (s *esSearcher) LatestHeartbeats(ctx context.Context) (map[string]Heartbeat, error) {
+	if len(s.indices()) > 1 && s.config.ESSearchTemplateID == "" {
+		if s.config.ESMultiSearch {
+			return s.multiSearchHeartbeats(ctx)
+		}
+		if s.config.ESParallelIndexQueries {
+			return s.parallelHeartbeats(ctx)
+		}
+	}
+
+	var searchResult *elastic.SearchResult
+	var err error
+	if s.config.ESSearchTemplateID != "" {
+		searchResult, err = s.templateSearch(ctx)
+	} else if s.config.ESUseAsyncSearch {
+		searchResult, err = s.asyncSearch(ctx)
+	} else {
+		searchResult, err = s.heartbeatSearch().Do(ctx)
+	}
+	s.observe(ctx, err)
+	if isIndexNotFound(err) {
+		// A time-based index may have rolled over and been deleted; that's
+		// no data rather than a failure.
+		loggerFrom(ctx, s.log).WarnD("index-not-found", kv.M{
+			"index": s.config.ElasticsearchIndex,
+			"error": err.Error(),
+		})
+		return map[string]Heartbeat{}, nil
+	}
+	if err != nil {
+		return nil, newFailedSearchError(err)
+	}
+
+	results, err := heartbeatsFrom(searchResult)
+	if err != nil {
+		return nil, err
+	}
+	if s.config.TrackDistinctComponents {
+		s.mu.Lock()
+		s.components = len(componentsFrom(searchResult))
+		s.mu.Unlock()
+	}
+	return results, nil
+}
+
+// multiSearchHeartbeats searches each of the configured indices, in one
+// _msearch request, and merges the hosts found. An index whose search fails
+// is logged and left out, so only every search failing fails the poll.
+func (s *esSearcher) multiSearchHeartbeats(ctx context.Context) (map[string]Heartbeat, error) {
+	indices := s.indices()
+	msearch := s.getClient().MultiSearch().Pretty(true)
+	for _, index := range indices {
+		request := elastic.NewSearchRequest().
+			Index(index).
+			SearchSource(s.heartbeatSource(index)).
+			IgnoreUnavailable(true).
+			AllowNoIndices(true)
+		if s.config.ESPreference != "" {
+			request = request.Preference(s.config.ESPreference)
+		}
+		msearch = msearch.Add(request)
+	}
+	multiResult, err := msearch.Do(ctx)
+	s.observe(ctx, err)
+	if err != nil {
+		return nil, newFailedSearchError(err)
+	}
+	if len(multiResult.Responses) != len(indices) {
+		return nil, newFailedSearchError(fmt.Errorf("_msearch returned %d responses to %d searches",
+			len(multiResult.Responses), len(indices)))
+	}
+	errs := make([]error, len(indices))
+	for i, searchResult := range multiResult.Responses {
+		if searchResult.Error != nil {
+			errs[i] = &elastic.Error{Details: searchResult.Error}
+		}
+	}
+	return s.mergeIndexResults(ctx, indices, multiResult.Responses, errs)
+}
+
+// parallelHeartbeats searches each of the configured indices in its own
+// request, up to ESMaxParallelQueries at once, and merges the hosts found.
+// An index whose search fails is logged and left out, so only every search
+// failing fails the poll.
+func (s *esSearcher) parallelHeartbeats(ctx context.Context) (map[string]Heartbeat, error) {
+	indices := s.indices()
+	results := make([]*elastic.SearchResult, len(indices))
+	errs := make([]error, len(indices))
+	slots := make(chan struct{}, s.config.ESMaxParallelQueries)
+	var wg sync.WaitGroup
+	for i, index := range indices {
+		wg.Add(1)
+		go func(i int, index string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			results[i], errs[i] = s.indexSearch(index).Do(ctx)
+		}(i, index)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		s.observe(ctx, err)
+	}
+	return s.mergeIndexResults(ctx, indices, results, errs)
+}
+
+// mergeIndexResults merges the hosts found by searching each of indices,
+// whose searches returned results or failed with errs. Failures are logged,
+// and only fail the poll if every search failed.
+func (s *esSearcher) mergeIndexResults(ctx context.Context, indices []string, searchResults []*elastic.SearchResult, errs []error) (map[string]Heartbeat, error) {
+	results := map[string]Heartbeat{}
+	// A pair may be found in several indices, e.g. daily ones.
+	components := map[[2]string]bool{}
+	succeeded := 0
+	var lastErr error
+	for i, index := range indices {
+		err := errs[i]
+		var heartbeats map[string]Heartbeat
+		if err == nil {
+			heartbeats, err = heartbeatsFrom(searchResults[i])
+		}
+		if isIndexNotFound(err) {
+			loggerFrom(ctx, s.log).WarnD("index-not-found", kv.M{"index": index, "error": err.Error()})
+			succeeded++
+			continue
+		}
+		if err != nil {
+			loggerFrom(ctx, s.log).ErrorD("index-search-failed", kv.M{"index": index, "error": err.Error()})
+			lastErr = err
+			continue
+		}
+		succeeded++
+		for host, heartbeat := range heartbeats {
+			if heartbeat.Indices == nil {
+				heartbeat.Indices = []string{index}
+			}
+			results[host] = mergeHeartbeats(results[host], heartbeat)
+		}
+		for pair := range componentsFrom(searchResults[i]) {
+			components[pair] = true
+		}
+	}
+	if succeeded == 0 && lastErr != nil {
+		if lastErr == errNoResultsFound {
+			return nil, lastErr
+		}
+		return nil, newFailedSearchError(lastErr)
+	}
+	if s.config.TrackDistinctComponents {
+		s.mu.Lock()
+		s.components = len(components)
+		s.mu.Unlock()
+	}
+	return results, nil
+}
+
+// mergeHeartbeats combines a host's heartbeats found in different indices,
+// resolving it by the latest.
+func mergeHeartbeats(a, b Heartbeat) Heartbeat {
+	merged := b
+	if a.Latest.After(b.Latest) {
+		merged = a
+	}
+	merged.Count = a.Count + b.Count
+	merged.Indices = append(append([]string{}, a.Indices...), b.Indices...)
+	return merged
+}
+
+// heartbeatsFrom reads the hosts out of a heartbeat search's result.
+func heartbeatsFrom(searchResult *elastic.SearchResult) (map[string]Heartbeat, error) {
+	agg, found := searchResult.Aggregations.Terms("hosts")
+	if !found {
+		return nil, errNoResultsFound
+	}
+
+	results := map[string]Heartbeat{}
+	for _, hostBucket := range agg.Buckets {
+		// Every bucket should have the hostname field as key.
+		host := hostBucket.Key.(string)
+
+		// The sub-aggregation latestTimes
+		maxTime, found := hostBucket.Max("latestTimes")
+		if !found {
+			continue
+		}
+		// Convert from milliseconds (as returned by Elasticsearch) to
+		// seconds (as needed by time.Unix()). Sub-second resolution
+		// does not matter for this monitor.
+		heartbeat := Heartbeat{
+			Latest: time.Unix(int64(*maxTime.Value)/1000, 0),
+			Count:  hostBucket.DocCount,
+		}
+
+		// The value is null for hosts whose documents lack the field.
+		interval, found := hostBucket.Max("expectedIntervals")
+		if found && interval.Value != nil {
+			heartbeat.ExpectedInterval = time.Duration(*interval.Value * float64(time.Second))
+		}
+		if indices, found := hostBucket.Terms("indices"); found {
+			for _, index := range indices.Buckets {
+				heartbeat.Indices = append(heartbeat.Indices, fmt.Sprint(index.Key))
+			}
+		}
+		results[host] = heartbeat
+	}
+	return results, nil
+}
+
+// componentsFrom returns the component/environment pairs in a heartbeat
+// search's result, with TrackDistinctComponents.
+func componentsFrom(searchResult *elastic.SearchResult) map[[2]string]bool {
+	components := map[[2]string]bool{}
+	if agg, found := searchResult.Aggregations.Terms("components"); found {
+		for _, component := range agg.Buckets {
+			if environments, found := component.Terms("environments"); found {
+				for _, environment := range environments.Buckets {
+					components[[2]string{fmt.Sprint(component.Key), fmt.Sprint(environment.Key)}] = true
+				}
+			}
+		}
+	}
+	return components
+}
+
+// heartbeatSearch aggregates the last hour's heartbeats by host.
+func (s *esSearcher) heartbeatSearch() *elastic.SearchService {
+	return s.indexSearch(s.config.ElasticsearchIndex)
+}
+
+// indexSearch is the heartbeat search of index.
+func (s *esSearcher) indexSearch(index string) *elastic.SearchService {
+	search := s.getClient().Search().
+		Index(index).
+		SearchSource(s.heartbeatSource(index)).
+		Pretty(true).
+		IgnoreUnavailable(true).
+		AllowNoIndices(true)
+	// A fixed preference sends every poll to the same shard copies, so
+	// replica lag doesn't make timestamps jitter between polls.
+	if s.config.ESPreference != "" {
+		search = search.Preference(s.config.ESPreference)
+	}
+	return search
+}
+
+// heartbeatSource is the query and aggregations of the heartbeat search of
+// index.
+func (s *esSearcher) heartbeatSource(index string) *elastic.SearchSource {
+	hostname := elastic.NewTermsAggregation().Field(s.hostnameField()).Size(s.config.HostnameAggSize)
+	timestamp := elastic.NewMaxAggregation().Field(s.config.ESTimestampField)
+	expectedInterval := elastic.NewMaxAggregation().Field("expected_interval")
+	// Increasing ShardSize should increase accuracy:
+	hostname = hostname.SubAggregation("latestTimes", timestamp).
+		SubAggregation("expectedIntervals", expectedInterval).
+		ShardSize(s.config.ESAggShardSize)
+	// A host found in several indices is resolved by its latest timestamp
+	// across them, but is worth knowing about.
+	if isMultiIndex(index) {
+		hostname = hostname.SubAggregation("indices", elastic.NewTermsAggregation().Field("_index").Size(10))
+	}
+	if s.config.ESAggExecutionHint != "" {
+		hostname = hostname.ExecutionHint(s.config.ESAggExecutionHint)
+	}
+	if s.config.ESAggCollectMode != "" {
+		hostname = hostname.CollectionMode(s.config.ESAggCollectMode)
+	}
+
+	q := elastic.NewBoolQuery()
+	q = q.Must(s.titleQuery())
+	q = q.Must(s.extraFilters()...)
+	q = q.Must(elastic.NewRangeQuery(s.config.ESTimestampField).Gte("now-1h").Lte("now"))
+
+	source := elastic.NewSearchSource().
+		Query(q).
+		Size(0).
+		Aggregation("hosts", hostname).
+		Timeout("30s")
+	// When one index serves many components, a component going quiet
+	// altogether is its bucket disappearing.
+	if s.config.TrackDistinctComponents {
+		environments := elastic.NewTermsAggregation().Field(s.config.ESEnvironmentField).Size(distinctComponentsAggSize)
+		components := elastic.NewTermsAggregation().Field(s.config.ESComponentField).Size(distinctComponentsAggSize).
+			SubAggregation("environments", environments)
+		source = source.Aggregation("components", components)
+	}
+	return source
+}
+
+// templateSearch searches with the stored search template
+// ESSearchTemplateID, for clusters that only allow predefined searches. Its
+// result must have the same "hosts" aggregation as heartbeatSearch's.
+// elastic.v5 has no search template service, so it is requested directly.
+func (s *esSearcher) templateSearch(ctx context.Context) (*elastic.SearchResult, error) {
+	params := map[string]interface{}{}
+	for name, value := range s.config.ESSearchTemplateParams {
+		params[name] = value
+	}
+	// Ours take precedence, so a stray parameter can't search the wrong
+	// index.
+	params["index"] = s.config.ElasticsearchIndex
+	params["titles"] = s.config.HeartbeatValues
+	params["timestamp_field"] = s.config.ESTimestampField
+	params["hostname_field"] = s.hostnameField()
+	params["from"] = "now-1h"
+	params["to"] = "now"
+
+	query := url.Values{}
+	query.Set("ignore_unavailable", "true")
+	query.Set("allow_no_indices", "true")
+	if s.config.ESPreference != "" {
+		query.Set("preference", s.config.ESPreference)
+	}
+	path := "/" + s.config.ElasticsearchIndex + "/_search/template"
+	body := map[string]interface{}{"id": s.config.ESSearchTemplateID, "params": params}
+	res, err := s.getClient().PerformRequest(ctx, "POST", path, query, body)
+	if err != nil {
+		return nil, err
+	}
+	result := &elastic.SearchResult{}
+	if err := json.Unmarshal(res.Body, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// asyncSearchWait is how long each async search request waits for the search
+// to complete before returning.
+const asyncSearchWait = 5 * time.Second
+
+// asyncSearchResponse is a response of the async search API.
+type asyncSearchResponse struct {
+	ID        string `json:"id"`
+	IsRunning bool   `json:"is_running"`
+	// IsPartial is set while the search runs, and once it is done if it
+	// timed out or shards failed.
+	IsPartial bool                  `json:"is_partial"`
+	Response  *elastic.SearchResult `json:"response"`
+}
+
+// asyncSearch runs the heartbeat search through the async search API
+// (Elasticsearch 7.7+), for clusters too loaded to answer it within a
+// request's timeout. It waits for the result until ESAsyncSearchMargin short
+// of the poll interval. A search stored by the cluster is deleted once done
+// with, whether it completed or not. Partial results fail the search, since
+// the hosts left out would look disappeared. elastic.v5 has no async search
+// service, so it is requested directly.
+func (s *esSearcher) asyncSearch(ctx context.Context) (*elastic.SearchResult, error) {
+	wait := pollInterval - s.config.ESAsyncSearchMargin
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	source, err := s.heartbeatSource(s.config.ElasticsearchIndex).
+		Timeout(fmt.Sprintf("%dms", wait.Milliseconds())).
+		Source()
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	query.Set("wait_for_completion_timeout", fmt.Sprintf("%dms", asyncSearchWait.Milliseconds()))
+	// Searches abandoned without being deleted expire soon after.
+	query.Set("keep_alive", fmt.Sprintf("%dms", (2*pollInterval).Milliseconds()))
+	query.Set("rest_total_hits_as_int", "true")
+	query.Set("ignore_unavailable", "true")
+	query.Set("allow_no_indices", "true")
+	if s.config.ESPreference != "" {
+		query.Set("preference", s.config.ESPreference)
+	}
+	client := s.getClient()
+	res, err := client.PerformRequest(ctx, "POST", "/"+s.config.ElasticsearchIndex+"/_async_search", query, source)
+	if err != nil {
+		return nil, err
+	}
+	search := &asyncSearchResponse{}
+	if err := json.Unmarshal(res.Body, search); err != nil {
+		return nil, err
+	}
+
+	// Searches that don't complete within the submit are stored.
+	path := "/_async_search/" + url.PathEscape(search.ID)
+	if search.IsRunning {
+		defer s.deleteAsyncSearch(ctx, client, path)
+	}
+	poll := url.Values{}
+	poll.Set("wait_for_completion_timeout", query.Get("wait_for_completion_timeout"))
+	poll.Set("rest_total_hits_as_int", "true")
+	for search.IsRunning {
+		res, err := client.PerformRequest(ctx, "GET", path, poll, nil)
+		if err != nil {
+			return nil, err
+		}
+		search = &asyncSearchResponse{}
+		if err := json.Unmarshal(res.Body, search); err != nil {
+			return nil, err
+		}
+	}
+	if search.Response == nil {
+		return nil, errors.New("async search completed without a response")
+	}
+	if result := search.Response; search.IsPartial {
+		failed := 0
+		if result.Shards != nil {
+			failed = result.Shards.Failed
+		}
+		return nil, fmt.Errorf("async search returned partial results (timed out: %t, shards failed: %d)", result.TimedOut, failed)
+	}
+	return search.Response, nil
+}
+
+// deleteAsyncSearch deletes the async search at path, done with by the poll
+// running under ctx, so it stops loading the cluster.
+func (s *esSearcher) deleteAsyncSearch(ctx context.Context, client *elastic.Client, path string) {
+	deleteCtx, cancel := context.WithTimeout(context.Background(), asyncSearchWait)
+	defer cancel()
+	if _, err := client.PerformRequest(deleteCtx, "DELETE", path, nil, nil); err != nil {
+		loggerFrom(ctx, s.log).WarnD("async-search-delete", kv.M{"error": err.Error()})
+	}
+}
+
+// isMultiIndex reports whether index names several indices.
+func isMultiIndex(index string) bool {
+	return strings.ContainsAny(index, ",*")
+}
+
+// indices are the comma-separated indices of the configured index.
+func (s *esSearcher) indices() []string {
+	indices := []string{}
+	for _, index := range strings.Split(s.config.ElasticsearchIndex, ",") {
+		if index = strings.TrimSpace(index); index != "" {
+			indices = append(indices, index)
+		}
+	}
+	return indices
+}
+
+// hostnameField is the field hosts are identified by.
+func (s *esSearcher) hostnameField() string {
+	if s.hostField != "" {
+		return s.hostField
+	}
+	return s.config.ESHostnameField
+}
+
+// titleQuery matches heartbeat documents by their title.
+func (s *esSearcher) titleQuery() elastic.Query {
+	values := make([]interface{}, len(s.config.HeartbeatValues))
+	for i, value := range s.config.HeartbeatValues {
+		values[i] = value
+	}
+	return elastic.NewTermsQuery("title", values...)
+}
+
+// extraFilters are the configured term queries heartbeat documents must also
+// match, e.g. on their region.
+func (s *esSearcher) extraFilters() []elastic.Query {
+	queries := []elastic.Query{}
+	for _, filter := range s.config.ESExtraFilters {
+		for field, value := range filter {
+			queries = append(queries, elastic.NewTermQuery(field, value))
+		}
+	}
+	return queries
+}
+
+func (s *esSearcher) LatestSample(ctx context.Context, host string) (*json.RawMessage, error) {
+	q := elastic.NewBoolQuery()
+	q = q.Must(s.titleQuery())
+	q = q.Must(s.extraFilters()...)
+	q = q.Must(elastic.NewTermQuery(s.hostnameField(), host))
+
+	searchResult, err := s.getClient().Search().
+		Index(s.config.ElasticsearchIndex).
+		Query(q).
+		Sort(s.config.ESTimestampField, false).
+		Size(1).
+		Timeout("30s").
+		IgnoreUnavailable(true).
+		AllowNoIndices(true).
+		Do(ctx)
+
+	if err != nil {
+		return nil, newFailedSearchError(err)
+	}
+
+	if searchResult.Hits == nil || len(searchResult.Hits.Hits) == 0 {
+		return nil, errNoResultsFound
+	}
+	return searchResult.Hits.Hits[0].Source, nil
+}
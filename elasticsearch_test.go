@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v5"
+)
+
+// sourceJSON returns the DSL of source, decoded.
+func sourceJSON(t *testing.T, source *elastic.SearchSource) map[string]interface{} {
+	t.Helper()
+	src, err := source.Source()
+	if err != nil {
+		t.Fatalf("Source: %s", err)
+	}
+	body, err := json.Marshal(src)
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	dsl := map[string]interface{}{}
+	if err := json.Unmarshal(body, &dsl); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	return dsl
+}
+
+// findKey returns every value under key anywhere in v.
+func findKey(v interface{}, key string) []interface{} {
+	found := []interface{}{}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if k == key {
+				found = append(found, child)
+			}
+			found = append(found, findKey(child, key)...)
+		}
+	case []interface{}:
+		for _, child := range v {
+			found = append(found, findKey(child, key)...)
+		}
+	}
+	return found
+}
+
+func TestHeartbeatSourceTitles(t *testing.T) {
+	config := testConfig()
+	config.ESTimestampField = "timestamp"
+	config.ESHostnameField = "hostname"
+	config.HeartbeatValues = []string{"heartbeat", "heartbeat-v2", "still-alive"}
+	dsl := sourceJSON(t, (&esSearcher{config: config}).heartbeatSource("logs"))
+
+	terms := findKey(dsl["query"], "terms")
+	if len(terms) != 1 {
+		t.Fatalf("query has %d terms queries, want 1: %v", len(terms), dsl["query"])
+	}
+	got := terms[0].(map[string]interface{})["title"]
+	want := []interface{}{"heartbeat", "heartbeat-v2", "still-alive"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("title terms = %v, want %v", got, want)
+	}
+}
+
+func TestHeartbeatSourceTimestampField(t *testing.T) {
+	config := testConfig()
+	config.ESTimestampField = "@timestamp"
+	config.ESHostnameField = "hostname"
+	config.HeartbeatValues = []string{"heartbeat"}
+	dsl := sourceJSON(t, (&esSearcher{config: config}).heartbeatSource("logs"))
+
+	ranges := findKey(dsl["query"], "range")
+	if len(ranges) != 1 {
+		t.Fatalf("query has %d range queries, want 1: %v", len(ranges), dsl["query"])
+	}
+	if _, ok := ranges[0].(map[string]interface{})["@timestamp"]; !ok {
+		t.Errorf("range query = %v, want it on @timestamp", ranges[0])
+	}
+
+	maxes := findKey(dsl["aggregations"], "max")
+	fields := map[interface{}]bool{}
+	for _, max := range maxes {
+		fields[max.(map[string]interface{})["field"]] = true
+	}
+	if !fields["@timestamp"] || fields["timestamp"] {
+		t.Errorf("max aggregations on %v, want one on @timestamp instead of timestamp", fields)
+	}
+}
+
+// fakeAsyncSearch is an ES cluster serving async searches, that run for
+// polls checks before completing, or forever if negative. Completed searches
+// are partial if partial is set, and garbled if garbled is.
+type fakeAsyncSearch struct {
+	mu       sync.Mutex
+	polls    int
+	partial  bool
+	garbled  bool
+	requests []string
+	params   []url.Values
+}
+
+func (f *fakeAsyncSearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	f.params = append(f.params, r.URL.Query())
+	if r.Method == http.MethodDelete {
+		fmt.Fprint(w, `{"acknowledged": true}`)
+		return
+	}
+	if r.Method == http.MethodGet {
+		f.polls--
+	}
+	if r.Method == http.MethodPost || f.polls != 0 {
+		fmt.Fprint(w, `{"id": "search/1", "is_running": true, "is_partial": true}`)
+		return
+	}
+	if f.garbled {
+		fmt.Fprint(w, `{"id": "search/1", "is_running": false, "response": [`)
+		return
+	}
+	fmt.Fprintf(w, `{"id": "search/1", "is_running": false, "is_partial": %t, "response": {"hits": {"total": 3},
+		"timed_out": %t, "aggregations": {"hosts": {"buckets": [{"key": "ip-10-0-0-1", "doc_count": 3,
+			"latestTimes": {"value": 1580472000000}, "expectedIntervals": {"value": null}}]}}}}`, f.partial, f.partial)
+}
+
+func (f *fakeAsyncSearch) seen() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.requests...)
+}
+
+// newTestAsyncSearcher returns an esSearcher using the async search API of
+// the cluster at uri, waiting up to wait.
+func newTestAsyncSearcher(t *testing.T, uri string, wait time.Duration) *esSearcher {
+	t.Helper()
+	client, err := elastic.NewClient(elastic.SetURL(uri), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatalf("NewClient: %s", err)
+	}
+	config := testConfig()
+	config.ElasticsearchIndex = "logs"
+	config.ESUseAsyncSearch = true
+	config.ESAsyncSearchMargin = pollInterval - wait
+	log, _ := newTestLogger()
+	return &esSearcher{client: client, config: config, log: log, now: time.Now}
+}
+
+func TestAsyncSearch(t *testing.T) {
+	cluster := &fakeAsyncSearch{polls: 2}
+	server := httptest.NewServer(cluster)
+	defer server.Close()
+	s := newTestAsyncSearcher(t, server.URL, 5*time.Second)
+
+	heartbeats, err := s.LatestHeartbeats(context.Background())
+	if err != nil {
+		t.Fatalf("LatestHeartbeats: %s", err)
+	}
+	want := map[string]Heartbeat{"ip-10-0-0-1": {Latest: time.Unix(1580472000, 0), Count: 3}}
+	if !reflect.DeepEqual(heartbeats, want) {
+		t.Errorf("heartbeats = %v, want %v", heartbeats, want)
+	}
+	// The stored result is deleted once read.
+	wantRequests := []string{
+		"POST /logs/_async_search",
+		"GET /_async_search/search/1",
+		"GET /_async_search/search/1",
+		"DELETE /_async_search/search/1",
+	}
+	if got := cluster.seen(); !reflect.DeepEqual(got, wantRequests) {
+		t.Errorf("requests = %v, want %v", got, wantRequests)
+	}
+	for i, params := range cluster.params[:3] {
+		if params.Get("rest_total_hits_as_int") != "true" {
+			t.Errorf("request %d params = %v, want rest_total_hits_as_int", i, params)
+		}
+	}
+}
+
+func TestAsyncSearchFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		cluster *fakeAsyncSearch
+	}{
+		{name: "partial", cluster: &fakeAsyncSearch{polls: 1, partial: true}},
+		{name: "garbled", cluster: &fakeAsyncSearch{polls: 1, garbled: true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(test.cluster)
+			defer server.Close()
+			s := newTestAsyncSearcher(t, server.URL, 5*time.Second)
+
+			heartbeats, err := s.LatestHeartbeats(context.Background())
+			var failed FailedSearchError
+			if !errors.As(err, &failed) {
+				t.Errorf("LatestHeartbeats = %v, %v, want a FailedSearchError", heartbeats, err)
+			}
+			requests := test.cluster.seen()
+			if last := requests[len(requests)-1]; last != "DELETE /_async_search/search/1" {
+				t.Errorf("last request = %q, want the search deleted", last)
+			}
+		})
+	}
+}
+
+func TestAsyncSearchDeadline(t *testing.T) {
+	cluster := &fakeAsyncSearch{polls: -1}
+	server := httptest.NewServer(cluster)
+	defer server.Close()
+	s := newTestAsyncSearcher(t, server.URL, 100*time.Millisecond)
+
+	start := time.Now()
+	_, err := s.LatestHeartbeats(context.Background())
+	if !errors.Is(err, errESTimeout) {
+		t.Errorf("LatestHeartbeats error = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("search took %s, want it cut off by ES_ASYNC_SEARCH_MARGIN", elapsed)
+	}
+	requests := cluster.seen()
+	if last := requests[len(requests)-1]; last != "DELETE /_async_search/search/1" {
+		t.Errorf("last request = %q, want the search deleted", last)
+	}
+}
+
+func TestMergeIndexResultsPollID(t *testing.T) {
+	log, logs := newTestLogger()
+	s := &esSearcher{config: testConfig(), log: log, now: time.Now}
+	ctx := withPollLogger(context.Background(), log)
+
+	errs := []error{errors.New("shard failure"), &elastic.Error{Details: &elastic.ErrorDetails{Type: "index_not_found_exception"}}}
+	s.mergeIndexResults(ctx, []string{"logs-a", "logs-b"}, make([]*elastic.SearchResult, 2), errs)
+
+	for _, title := range []string{"index-search-failed", "index-not-found"} {
+		lines := logLines(t, logs, title)
+		if len(lines) != 1 || lines[0]["poll_id"] == nil {
+			t.Errorf("%s lines = %v, want one with a poll_id", title, lines)
+		}
+	}
+}
+
+// componentsResult returns a search result finding ip-10-0-0-1 and the
+// component/environment pairs components, as "component/environment".
+func componentsResult(t *testing.T, components ...string) *elastic.SearchResult {
+	t.Helper()
+	byComponent := map[string][]interface{}{}
+	order := []string{}
+	for _, pair := range components {
+		parts := strings.SplitN(pair, "/", 2)
+		if _, ok := byComponent[parts[0]]; !ok {
+			order = append(order, parts[0])
+		}
+		byComponent[parts[0]] = append(byComponent[parts[0]], map[string]interface{}{"key": parts[1], "doc_count": 1})
+	}
+	buckets := []interface{}{}
+	for _, component := range order {
+		buckets = append(buckets, map[string]interface{}{
+			"key": component, "doc_count": 1,
+			"environments": map[string]interface{}{"buckets": byComponent[component]},
+		})
+	}
+	body, _ := json.Marshal(map[string]interface{}{"aggregations": map[string]interface{}{
+		"hosts": map[string]interface{}{"buckets": []interface{}{map[string]interface{}{
+			"key": "ip-10-0-0-1", "doc_count": 1, "latestTimes": map[string]interface{}{"value": 1580472000000},
+		}}},
+		"components": map[string]interface{}{"buckets": buckets},
+	}})
+	result := &elastic.SearchResult{}
+	if err := json.Unmarshal(body, result); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	return result
+}
+
+func TestMergeIndexResultsDistinctComponents(t *testing.T) {
+	config := testConfig()
+	config.TrackDistinctComponents = true
+	log, _ := newTestLogger()
+	s := &esSearcher{config: config, log: log, now: time.Now}
+
+	results := []*elastic.SearchResult{
+		componentsResult(t, "api/production", "api/staging", "worker/production"),
+		componentsResult(t, "api/production", "worker/production", "worker/staging"),
+	}
+	if _, err := s.mergeIndexResults(context.Background(), []string{"logs-2024.01.01", "logs-2024.01.02"}, results, make([]error, 2)); err != nil {
+		t.Fatalf("mergeIndexResults: %s", err)
+	}
+	if got := s.distinctComponents(); got != 4 {
+		t.Errorf("distinct components = %d, want 4, each pair counted once", got)
+	}
+}
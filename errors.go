@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// errorType classifies err by the dependency that failed and how, so that
+// log-based alerting can key off the error_type field rather than messages.
+func errorType(err error) string {
+	switch {
+	case errors.Is(err, errESTimeout):
+		return "es-timeout"
+	case errors.Is(err, errESQueryRejected):
+		return "es-query-rejected"
+	case errors.As(err, new(FailedSearchError)):
+		return "es-search-failed"
+	case errors.Is(err, errNoResultsFound):
+		return "es-no-results"
+	case errors.Is(err, errEC2Throttled):
+		return "ec2-throttled"
+	case isAuthFailure(err):
+		return "sink-auth-failed"
+	case errors.Is(err, errSinkRejected):
+		return "sink-rejected"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	}
+	return "other"
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/signalfx/golib/sfxclient"
+	elastic "gopkg.in/olivere/elastic.v5"
+)
+
+func TestErrorType(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"search deadline", newFailedSearchError(context.DeadlineExceeded), "es-timeout"},
+		{"search rejected", newFailedSearchError(&elastic.Error{Status: http.StatusBadRequest}), "es-query-rejected"},
+		{"search server error", newFailedSearchError(&elastic.Error{Status: http.StatusServiceUnavailable}), "es-search-failed"},
+		{"search failed", newFailedSearchError(errors.New("connection refused")), "es-search-failed"},
+		{"no results", errNoResultsFound, "es-no-results"},
+		{"ec2 throttled", fmt.Errorf("%w: Throttling", errEC2Throttled), "ec2-throttled"},
+		{"sink unauthorized", sfxclient.SFXAPIError{StatusCode: http.StatusUnauthorized}, "sink-auth-failed"},
+		{"sink forbidden", classifySinkError(sfxclient.SFXAPIError{StatusCode: http.StatusForbidden}), "sink-auth-failed"},
+		{"sink rejected", classifySinkError(sfxclient.SFXAPIError{StatusCode: http.StatusBadRequest}), "sink-rejected"},
+		{"deadline", fmt.Errorf("sending: %w", context.DeadlineExceeded), "timeout"},
+		{"other", errors.New("boom"), "other"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := errorType(test.err); got != test.want {
+				t.Errorf("errorType(%v) = %q, want %q", test.err, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/signalfx/golib/datapoint"
+	"github.com/signalfx/golib/sfxclient"
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// transitionMissing is an expected host not heartbeating for the grace
+// period.
+const transitionMissing = "missing"
+
+// expectedHostSource lists the hosts that should be heartbeating.
+type expectedHostSource interface {
+	expectedHosts(ctx context.Context) ([]string, error)
+}
+
+// staticHosts are expected hosts listed in the config.
+type staticHosts []string
+
+func (s staticHosts) expectedHosts(ctx context.Context) ([]string, error) {
+	return s, nil
+}
+
+// fileHosts is a file listing expected hosts one per line, ignoring blank
+// lines and lines starting with "#". It is read every poll, so it can be
+// changed without a restart.
+type fileHosts string
+
+func (f fileHosts) expectedHosts(ctx context.Context) ([]string, error) {
+	file, err := os.Open(string(f))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hosts := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hosts = append(hosts, line)
+	}
+	return hosts, scanner.Err()
+}
+
+// asgRefreshInterval is how often an ASG's instances are described.
+const asgRefreshInterval = time.Minute
+
+// asgHosts are the in-service instances of an auto scaling group, named like
+// ip-10-0-0-1 after their private IPs.
+type asgHosts struct {
+	autoscaling autoscalingiface.AutoScalingAPI
+	ec2api      ec2iface.EC2API
+	name        string
+	now         func() time.Time
+
+	mu          sync.Mutex
+	hosts       []string
+	lastRefresh time.Time
+}
+
+func (a *asgHosts) setClock(now func() time.Time) {
+	a.now = now
+}
+
+func (a *asgHosts) expectedHosts(ctx context.Context) ([]string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.hosts != nil && a.now().Sub(a.lastRefresh) < asgRefreshInterval {
+		return a.hosts, nil
+	}
+
+	groups, err := a.autoscaling.DescribeAutoScalingGroupsWithContext(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []*string{aws.String(a.name)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(groups.AutoScalingGroups) == 0 {
+		return nil, fmt.Errorf("auto scaling group %s not found", a.name)
+	}
+	ids := []*string{}
+	for _, instance := range groups.AutoScalingGroups[0].Instances {
+		if aws.StringValue(instance.LifecycleState) == autoscaling.LifecycleStateInService {
+			ids = append(ids, instance.InstanceId)
+		}
+	}
+
+	hosts := []string{}
+	if len(ids) > 0 {
+		err = a.ec2api.DescribeInstancesPagesWithContext(ctx, &ec2.DescribeInstancesInput{InstanceIds: ids},
+			func(output *ec2.DescribeInstancesOutput, lastPage bool) bool {
+				for _, res := range output.Reservations {
+					for _, instance := range res.Instances {
+						if ip := aws.StringValue(instance.PrivateIpAddress); ip != "" {
+							hosts = append(hosts, "ip-"+strings.Replace(ip, ".", "-", -1))
+						}
+					}
+				}
+				return true
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+	a.hosts = hosts
+	a.lastRefresh = a.now()
+	return hosts, nil
+}
+
+// expectedHosts alerts on hosts that should be heartbeating but aren't found
+// at all, once they have been missing for grace.
+type expectedHosts struct {
+	source expectedHostSource
+	grace  time.Duration
+
+	// missingSince is when each expected host was first found missing.
+	missingSince map[string]time.Time
+	// alerted are the missing hosts past their grace period.
+	alerted map[string]bool
+}
+
+func newExpectedHosts(source expectedHostSource, grace time.Duration) *expectedHosts {
+	return &expectedHosts{
+		source:       source,
+		grace:        grace,
+		missingSince: map[string]time.Time{},
+		alerted:      map[string]bool{},
+	}
+}
+
+// checkExpectedHosts compares the expected hosts with those found, sends the
+// number missing for longer than the grace period, and returns a transition
+// for each host newly past it. Hosts whose instances EC2 says aren't running
+// were terminated on purpose, so aren't missing.
+func (m *Monitor) checkExpectedHosts(ctx context.Context, heartbeats map[string]Heartbeat) []hostTransition {
+	e := m.expected
+	hosts, err := e.source.expectedHosts(ctx)
+	if err != nil {
+		m.errLog.Error(ctx, "expected-hosts", err)
+		return nil
+	}
+	m.errLog.Clear(ctx, "expected-hosts")
+
+	now := m.now()
+	missing := map[string]bool{}
+	for _, host := range hosts {
+		if _, found := heartbeats[host]; found {
+			continue
+		}
+		if ip, ok := m.hostIPs.ip(host); ok {
+			isRunning, err := m.checker.IsRunning(ctx, ip)
+			if err == nil && !isRunning {
+				continue
+			}
+		}
+		missing[host] = true
+	}
+	for host := range e.missingSince {
+		if !missing[host] {
+			delete(e.missingSince, host)
+			delete(e.alerted, host)
+		}
+	}
+
+	transitions := []hostTransition{}
+	for host := range missing {
+		since, ok := e.missingSince[host]
+		if !ok {
+			since = now
+			e.missingSince[host] = now
+		}
+		if e.alerted[host] || now.Sub(since) < e.grace {
+			continue
+		}
+		e.alerted[host] = true
+		m.logger(ctx).WarnD("expected-host-missing", kv.M{
+			"hostname":      host,
+			"missing_since": since.Format(time.RFC3339),
+		})
+		transitions = append(transitions, hostTransition{Host: host, Event: transitionMissing, Lag: now.Sub(since)})
+	}
+	sort.Slice(transitions, func(i, j int) bool { return transitions[i].Host < transitions[j].Host })
+
+	gauge := sfxclient.Gauge("monitor.expected_hosts_missing", m.selfDimensions(), int64(len(e.alerted)))
+	if err := m.send(ctx, []*datapoint.Datapoint{gauge}); err != nil {
+		m.errLog.Error(ctx, "send-to-signalfx", err)
+	}
+	return transitions
+}
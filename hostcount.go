@@ -0,0 +1,55 @@
+package main
+
+import (
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// hostCountWatch tells a sudden drop in the number of hosts found, which
+// almost always means the log pipeline broke rather than that many hosts
+// failed at once, from hosts going stale one by one.
+type hostCountWatch struct {
+	// percent is how far below the baseline the count must fall to be a
+	// drop.
+	percent float64
+	// window is how many polls the baseline is the mean of.
+	window int
+
+	counts  []int
+	dropped bool
+}
+
+// observe records the number of hosts a poll found, logging when it drops
+// below the baseline of the previous polls and when it recovers, and reports
+// whether it is dropped, and the event if that changed. A fleet that stays
+// smaller becomes the new baseline once it fills the window.
+func (w *hostCountWatch) observe(log kv.KayveeLogger, count int) (bool, *pollEvent) {
+	var event *pollEvent
+	if len(w.counts) > 0 {
+		sum := 0
+		for _, c := range w.counts {
+			sum += c
+		}
+		baseline := float64(sum) / float64(len(w.counts))
+		threshold := baseline * (1 - w.percent/100)
+		dropped := float64(count) < threshold
+		data := kv.M{
+			"before":    baseline,
+			"after":     count,
+			"threshold": threshold,
+		}
+		if dropped && !w.dropped {
+			log.ErrorD("host-count-drop", data)
+			event = &pollEvent{Event: "host-count-drop", Details: data}
+		} else if !dropped && w.dropped {
+			log.InfoD("host-count-recovered", data)
+			event = &pollEvent{Event: "host-count-recovered", Details: data}
+		}
+		w.dropped = dropped
+	}
+
+	w.counts = append(w.counts, count)
+	if len(w.counts) > w.window {
+		w.counts = w.counts[1:]
+	}
+	return w.dropped, event
+}
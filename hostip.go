@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// hostIPParser parses IP addresses out of hostnames. By default it parses
+// AWS's ip-10-0-0-1; otherwise the first capture group of a regular
+// expression is the IP address, with its octets separated by separator, e.g.
+// `^node-(.+)$` and "_" for node-10_0_0_1.
+type hostIPParser struct {
+	re        *regexp.Regexp
+	separator string
+}
+
+// newHostIPParser returns a parser for pattern, or for the AWS scheme if
+// pattern is empty. pattern must have one capture group.
+func newHostIPParser(pattern, separator string) (*hostIPParser, error) {
+	if pattern == "" {
+		return &hostIPParser{}, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if re.NumSubexp() != 1 {
+		return nil, fmt.Errorf("%q must have one capture group, has %d", pattern, re.NumSubexp())
+	}
+	return &hostIPParser{re: re, separator: separator}, nil
+}
+
+// ip returns the IP address in hostname, if it has one.
+func (p *hostIPParser) ip(hostname string) (string, bool) {
+	if p.re == nil {
+		if !strings.HasPrefix(hostname, "ip-") {
+			return "", false
+		}
+		return strings.Replace(strings.TrimPrefix(hostname, "ip-"), "-", ".", -1), true
+	}
+	match := p.re.FindStringSubmatch(hostname)
+	if match == nil {
+		return "", false
+	}
+	ip := match[1]
+	if p.separator != "" {
+		ip = strings.Replace(ip, p.separator, ".", -1)
+	}
+	if net.ParseIP(ip) == nil {
+		return "", false
+	}
+	return ip, true
+}
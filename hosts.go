@@ -0,0 +1,76 @@
+package main
+
+import "container/list"
+
+// hostTracker remembers the hosts seen since the monitor started, in the
+// order they were last seen, and how many polls in a row each has been
+// missing from.
+type hostTracker struct {
+	// order holds *trackedHosts, most recently seen first.
+	order *list.List
+	hosts map[string]*list.Element
+}
+
+type trackedHost struct {
+	name        string
+	staleCycles int
+}
+
+func newHostTracker() *hostTracker {
+	return &hostTracker{order: list.New(), hosts: map[string]*list.Element{}}
+}
+
+// seen records that host was found by the current poll.
+func (t *hostTracker) seen(host string) {
+	if e, ok := t.hosts[host]; ok {
+		e.Value.(*trackedHost).staleCycles = 0
+		t.order.MoveToFront(e)
+		return
+	}
+	t.hosts[host] = t.order.PushFront(&trackedHost{name: host})
+}
+
+// missed records that host wasn't found by the current poll, and returns the
+// number of polls in a row it has been missing from.
+func (t *hostTracker) missed(host string) int {
+	h := t.hosts[host].Value.(*trackedHost)
+	h.staleCycles++
+	return h.staleCycles
+}
+
+// tracked reports whether host is tracked.
+func (t *hostTracker) tracked(host string) bool {
+	_, ok := t.hosts[host]
+	return ok
+}
+
+// forget stops tracking host.
+func (t *hostTracker) forget(host string) {
+	if e, ok := t.hosts[host]; ok {
+		t.order.Remove(e)
+		delete(t.hosts, host)
+	}
+}
+
+// evict forgets the least recently seen hosts beyond the first max, and
+// returns them.
+func (t *hostTracker) evict(max int) []string {
+	evicted := []string{}
+	for t.order.Len() > max {
+		h := t.order.Back().Value.(*trackedHost)
+		t.forget(h.name)
+		evicted = append(evicted, h.name)
+	}
+	return evicted
+}
+
+// staleCycles returns the number of polls in a row each tracked host has
+// been missing from.
+func (t *hostTracker) staleCycles() map[string]int {
+	cycles := make(map[string]int, len(t.hosts))
+	for e := t.order.Front(); e != nil; e = e.Next() {
+		h := e.Value.(*trackedHost)
+		cycles[h.name] = h.staleCycles
+	}
+	return cycles
+}
@@ -0,0 +1,327 @@
+// Package hoststate tracks where each host is in its lifecycle, as far as a
+// monitor polling for its heartbeats can tell, and saves it across restarts.
+package hoststate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+// State is where a host is in its lifecycle.
+type State int
+
+const (
+	// Unknown is a host not seen yet.
+	Unknown State = iota
+	// Healthy is a host heartbeating on time.
+	Healthy
+	// Stale is a host overdue for StalePolls polls in a row.
+	Stale
+	// Recovered is a stale, terminated or disappeared host heartbeating on
+	// time again, until its next poll on time makes it healthy.
+	Recovered
+	// Terminated is a host whose EC2 instance isn't running.
+	Terminated
+	// Disappeared is a host no longer found in ES.
+	Disappeared
+)
+
+var stateNames = []string{"unknown", "healthy", "stale", "recovered", "terminated", "disappeared"}
+
+func (s State) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+	return stateNames[s]
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *State) UnmarshalText(text []byte) error {
+	for i, name := range stateNames {
+		if name == string(text) {
+			*s = State(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown host state %q", text)
+}
+
+// Cooldown is a host's notification cooldown on one channel.
+type Cooldown struct {
+	// Until is when the host can be notified about again.
+	Until time.Time `json:"until"`
+	// Suppressed counts the transitions held back since the host was last
+	// notified about.
+	Suppressed int `json:"suppressed"`
+	// Notified is the event the host was last notified about, and Held the
+	// latest held back since, if any, to notify about once Until passes.
+	Notified string `json:"notified,omitempty"`
+	Held     string `json:"held,omitempty"`
+}
+
+// Record is a host's state and what it was as of the last poll to find it.
+type Record struct {
+	State State `json:"state"`
+	// Since is when the host entered State.
+	Since  time.Time     `json:"since"`
+	Lag    time.Duration `json:"lag"`
+	Latest time.Time     `json:"latest"`
+	// FirstSeen is when the host was first found, or zero if it was found
+	// by the first poll, since it may have been around for long.
+	FirstSeen time.Time `json:"first_seen"`
+	// Overdue and OnTime count the polls in a row the host was found overdue
+	// and on time.
+	Overdue int `json:"overdue"`
+	OnTime  int `json:"on_time"`
+	// Cooldowns are the host's notification cooldowns, by channel.
+	Cooldowns map[string]*Cooldown `json:"cooldowns,omitempty"`
+	// Incident is whether the host has a PagerDuty incident open.
+	Incident bool `json:"incident,omitempty"`
+}
+
+// Cooldown returns the host's cooldown on channel, adding it if it has none.
+func (r *Record) Cooldown(channel string) *Cooldown {
+	if r.Cooldowns == nil {
+		r.Cooldowns = map[string]*Cooldown{}
+	}
+	cd, ok := r.Cooldowns[channel]
+	if !ok {
+		cd = &Cooldown{}
+		r.Cooldowns[channel] = cd
+	}
+	return cd
+}
+
+// Transition is a host changing state.
+type Transition struct {
+	Host     string
+	From, To State
+	// Lag and Latest are as of the last poll to find the host.
+	Lag    time.Duration
+	Latest time.Time
+}
+
+// Config is how hosts move between states.
+type Config struct {
+	// StalePolls and RecoverPolls are how many polls in a row hosts must be
+	// overdue to go stale, and on time to recover.
+	StalePolls   int
+	RecoverPolls int
+	// Grace, if positive, is how long hosts new since the first poll can't
+	// go stale for, unless they send GraceHeartbeats first.
+	Grace           time.Duration
+	GraceHeartbeats int64
+	// File, if set, is where the states are saved.
+	File string
+}
+
+// Store holds the state of each host, moving hosts between states as polls
+// find them. Hosts must be overdue for StalePolls polls in a row to go
+// stale, and on time for RecoverPolls polls in a row to recover, so hosts
+// hovering around their threshold don't flap. Hosts new since the first poll
+// can't go stale until they have been around for Grace, or have sent
+// GraceHeartbeats, since a newly launched host's first heartbeats are often
+// late while its agent starts. It isn't safe for concurrent use.
+type Store struct {
+	config Config
+
+	hosts map[string]*Record
+	// primed is set once the first poll is done.
+	primed bool
+}
+
+// New returns a Store with no hosts.
+func New(config Config) *Store {
+	return &Store{config: config, hosts: map[string]*Record{}}
+}
+
+// Load returns a Store with the states saved to config.File, if any. A file
+// that doesn't exist yet is no hosts. On error, the Store returned has no
+// hosts, so the caller can start afresh. Loaded states count as a first poll,
+// so hosts not in them are new.
+func Load(config Config) (*Store, error) {
+	s := New(config)
+	data, err := ioutil.ReadFile(config.File)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(data, &s.hosts); err != nil {
+		s.hosts = map[string]*Record{}
+		return s, err
+	}
+	s.primed = true
+	return s, nil
+}
+
+// Save writes the states to config.File, if set, through a temporary file
+// so a crash can't leave it half written.
+func (s *Store) Save() error {
+	if s.config.File == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.hosts)
+	if err != nil {
+		return err
+	}
+	tmp := s.config.File + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.config.File)
+}
+
+// State returns the state of host.
+func (s *Store) State(host string) State {
+	if r, ok := s.hosts[host]; ok {
+		return r.State
+	}
+	return Unknown
+}
+
+// Record returns the record of host, for its cooldowns to be updated.
+func (s *Store) Record(host string) (*Record, bool) {
+	r, ok := s.hosts[host]
+	return r, ok
+}
+
+// Hosts returns the hosts tracked, sorted.
+func (s *Store) Hosts() []string {
+	hosts := make([]string, 0, len(s.hosts))
+	for host := range s.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// Polled records that a poll is done, so that hosts first found from now on
+// are new.
+func (s *Store) Polled() {
+	s.primed = true
+}
+
+// Found records a poll finding host, overdue or not, with count heartbeats,
+// and returns its transition, if any.
+func (s *Store) Found(now time.Time, host string, overdue bool, lag time.Duration, latest time.Time, count int64) *Transition {
+	r := s.record(now, host)
+	r.Lag, r.Latest = lag, latest
+	if overdue && s.inGrace(now, r, count) {
+		return nil
+	}
+	if overdue {
+		r.Overdue++
+		r.OnTime = 0
+	} else {
+		r.OnTime++
+		r.Overdue = 0
+	}
+
+	next := r.State
+	switch r.State {
+	case Unknown, Healthy, Recovered:
+		// A host stale when first seen has gone stale as far as we know.
+		if r.Overdue >= s.config.StalePolls {
+			next = Stale
+		} else if !overdue {
+			next = Healthy
+		}
+	case Stale, Terminated, Disappeared:
+		if r.OnTime >= s.config.RecoverPolls {
+			next = Recovered
+		} else if r.State != Stale && r.Overdue >= s.config.StalePolls {
+			next = Stale
+		}
+	}
+	return s.move(now, host, r, next)
+}
+
+// Terminated records a poll finding that host's instance isn't running, and
+// returns its transition, if any. The host's lag is kept as of the last poll
+// to find it running.
+func (s *Store) Terminated(now time.Time, host string) *Transition {
+	r := s.record(now, host)
+	r.Overdue, r.OnTime = 0, 0
+	return s.move(now, host, r, Terminated)
+}
+
+// Missing records a poll not finding host, and returns its transition, if
+// any. Terminated hosts are expected to go missing.
+func (s *Store) Missing(now time.Time, host string) *Transition {
+	r, ok := s.hosts[host]
+	if !ok || r.State == Terminated {
+		return nil
+	}
+	r.Overdue, r.OnTime = 0, 0
+	return s.move(now, host, r, Disappeared)
+}
+
+// Cooldowns returns when each channel cooling down as of now can next
+// notify about host, or nil if none is.
+func (s *Store) Cooldowns(now time.Time, host string) map[string]time.Time {
+	r, ok := s.hosts[host]
+	if !ok {
+		return nil
+	}
+	var until map[string]time.Time
+	for channel, cd := range r.Cooldowns {
+		if now.Before(cd.Until) {
+			if until == nil {
+				until = map[string]time.Time{}
+			}
+			until[channel] = cd.Until
+		}
+	}
+	return until
+}
+
+// Forget stops tracking host, and returns its last record.
+func (s *Store) Forget(host string) (Record, bool) {
+	r, ok := s.hosts[host]
+	if !ok {
+		return Record{}, false
+	}
+	delete(s.hosts, host)
+	return *r, true
+}
+
+// inGrace reports whether a host with count heartbeats is too new to go
+// stale.
+func (s *Store) inGrace(now time.Time, r *Record, count int64) bool {
+	if s.config.Grace <= 0 || r.FirstSeen.IsZero() || now.Sub(r.FirstSeen) >= s.config.Grace {
+		return false
+	}
+	return s.config.GraceHeartbeats <= 0 || count < s.config.GraceHeartbeats
+}
+
+func (s *Store) record(now time.Time, host string) *Record {
+	r, ok := s.hosts[host]
+	if !ok {
+		r = &Record{}
+		if s.primed {
+			r.FirstSeen = now
+		}
+		s.hosts[host] = r
+	}
+	return r
+}
+
+// move puts host in state next, returning its transition if that is a
+// change.
+func (s *Store) move(now time.Time, host string, r *Record, next State) *Transition {
+	if next == r.State {
+		return nil
+	}
+	t := &Transition{Host: host, From: r.State, To: next, Lag: r.Lag, Latest: r.Latest}
+	r.State = next
+	r.Since = now
+	return t
+}
@@ -0,0 +1,242 @@
+package hoststate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2020, 1, 31, 12, 0, 0, 0, time.UTC)
+
+// step is an event a poll finds about the host, and the state it must leave
+// the host in.
+type step struct {
+	event string
+	want  State
+	// moved is whether the event is a transition.
+	moved bool
+}
+
+func TestTransitions(t *testing.T) {
+	tests := []struct {
+		name         string
+		stalePolls   int
+		recoverPolls int
+		steps        []step
+	}{
+		{
+			name:       "stale after stalePolls",
+			stalePolls: 2, recoverPolls: 1,
+			steps: []step{
+				{"on-time", Healthy, true},
+				{"overdue", Healthy, false},
+				{"on-time", Healthy, false},
+				{"overdue", Healthy, false},
+				{"overdue", Stale, true},
+				{"overdue", Stale, false},
+			},
+		},
+		{
+			name:       "stale when first seen",
+			stalePolls: 1, recoverPolls: 1,
+			steps: []step{
+				{"overdue", Stale, true},
+			},
+		},
+		{
+			name:       "recovered after recoverPolls",
+			stalePolls: 1, recoverPolls: 2,
+			steps: []step{
+				{"overdue", Stale, true},
+				{"on-time", Stale, false},
+				{"overdue", Stale, false},
+				{"on-time", Stale, false},
+				{"on-time", Recovered, true},
+				{"on-time", Healthy, true},
+			},
+		},
+		{
+			name:       "recovered goes stale again",
+			stalePolls: 1, recoverPolls: 1,
+			steps: []step{
+				{"overdue", Stale, true},
+				{"on-time", Recovered, true},
+				{"overdue", Stale, true},
+			},
+		},
+		{
+			name:       "terminated",
+			stalePolls: 1, recoverPolls: 1,
+			steps: []step{
+				{"on-time", Healthy, true},
+				{"terminated", Terminated, true},
+				{"terminated", Terminated, false},
+				// Terminated hosts are expected to go missing.
+				{"missing", Terminated, false},
+				{"on-time", Recovered, true},
+			},
+		},
+		{
+			name:       "terminated then overdue",
+			stalePolls: 1, recoverPolls: 1,
+			steps: []step{
+				{"terminated", Terminated, true},
+				{"overdue", Stale, true},
+			},
+		},
+		{
+			name:       "disappeared",
+			stalePolls: 1, recoverPolls: 1,
+			steps: []step{
+				{"on-time", Healthy, true},
+				{"missing", Disappeared, true},
+				{"missing", Disappeared, false},
+				{"on-time", Recovered, true},
+			},
+		},
+		{
+			name:       "disappeared then overdue",
+			stalePolls: 2, recoverPolls: 1,
+			steps: []step{
+				{"on-time", Healthy, true},
+				{"missing", Disappeared, true},
+				{"overdue", Disappeared, false},
+				{"overdue", Stale, true},
+			},
+		},
+		{
+			name:       "missing before seen",
+			stalePolls: 1, recoverPolls: 1,
+			steps: []step{
+				{"missing", Unknown, false},
+			},
+		},
+		{
+			name:       "forget",
+			stalePolls: 1, recoverPolls: 1,
+			steps: []step{
+				{"overdue", Stale, true},
+				{"forget", Unknown, false},
+				// Forgotten hosts start afresh.
+				{"missing", Unknown, false},
+				{"on-time", Healthy, true},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := New(Config{StalePolls: test.stalePolls, RecoverPolls: test.recoverPolls})
+			now := testNow
+			for i, step := range test.steps {
+				now = now.Add(30 * time.Second)
+				from := s.State("ip-10-0-0-1")
+				var moved *Transition
+				switch step.event {
+				case "on-time":
+					moved = s.Found(now, "ip-10-0-0-1", false, 10*time.Second, now.Add(-10*time.Second), 1)
+				case "overdue":
+					moved = s.Found(now, "ip-10-0-0-1", true, 10*time.Minute, now.Add(-10*time.Minute), 1)
+				case "terminated":
+					moved = s.Terminated(now, "ip-10-0-0-1")
+				case "missing":
+					moved = s.Missing(now, "ip-10-0-0-1")
+				case "forget":
+					if r, ok := s.Forget("ip-10-0-0-1"); !ok || r.State != from {
+						t.Fatalf("step %d: Forget = %v, %t, want the %s record", i, r.State, ok, from)
+					}
+				default:
+					t.Fatalf("step %d: unknown event %q", i, step.event)
+				}
+
+				if got := s.State("ip-10-0-0-1"); got != step.want {
+					t.Errorf("step %d (%s): state = %s, want %s", i, step.event, got, step.want)
+				}
+				if (moved != nil) != step.moved {
+					t.Errorf("step %d (%s): transition = %+v, want one: %t", i, step.event, moved, step.moved)
+				} else if moved != nil && (moved.From != from || moved.To != step.want) {
+					t.Errorf("step %d (%s): transition %s -> %s, want %s -> %s", i, step.event, moved.From, moved.To, from, step.want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewHostGrace(t *testing.T) {
+	s := New(Config{StalePolls: 1, RecoverPolls: 1, Grace: 10 * time.Minute, GraceHeartbeats: 3})
+	// Hosts found by the first poll may have been around for long.
+	if moved := s.Found(testNow, "ip-10-0-0-1", true, time.Hour, testNow.Add(-time.Hour), 1); moved == nil || moved.To != Stale {
+		t.Errorf("host found by the first poll: transition = %+v, want stale", moved)
+	}
+	s.Polled()
+
+	tests := []struct {
+		after time.Duration
+		count int64
+		want  State
+	}{
+		{after: 0, count: 1, want: Unknown},
+		{after: 5 * time.Minute, count: 2, want: Unknown},
+		// Enough heartbeats end the grace early.
+		{after: 6 * time.Minute, count: 3, want: Stale},
+	}
+	for _, test := range tests {
+		now := testNow.Add(test.after)
+		s.Found(now, "ip-10-0-0-2", true, time.Hour, now.Add(-time.Hour), test.count)
+		if got := s.State("ip-10-0-0-2"); got != test.want {
+			t.Errorf("after %s with %d heartbeats: state = %s, want %s", test.after, test.count, got, test.want)
+		}
+	}
+
+	s.Found(testNow, "ip-10-0-0-3", true, time.Hour, testNow.Add(-time.Hour), 1)
+	later := testNow.Add(10 * time.Minute)
+	s.Found(later, "ip-10-0-0-3", true, time.Hour, later.Add(-time.Hour), 1)
+	if got := s.State("ip-10-0-0-3"); got != Stale {
+		t.Errorf("after the grace: state = %s, want stale", got)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hoststate")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	config := Config{StalePolls: 1, RecoverPolls: 1, File: filepath.Join(dir, "states.json")}
+
+	s, err := Load(config)
+	if err != nil || len(s.Hosts()) != 0 {
+		t.Fatalf("Load of no file = %v, %v, want no hosts", s.Hosts(), err)
+	}
+	s.Found(testNow, "ip-10-0-0-1", true, time.Hour, testNow.Add(-time.Hour), 1)
+	s.Found(testNow, "ip-10-0-0-2", false, time.Second, testNow.Add(-time.Second), 1)
+	if err := s.Save(); err != nil {
+		t.Fatalf("Save: %s", err)
+	}
+
+	loaded, err := Load(config)
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if got := loaded.State("ip-10-0-0-1"); got != Stale {
+		t.Errorf("ip-10-0-0-1 state = %s, want stale", got)
+	}
+	if got := loaded.State("ip-10-0-0-2"); got != Healthy {
+		t.Errorf("ip-10-0-0-2 state = %s, want healthy", got)
+	}
+	// Hosts not in the loaded states are new, so get the grace.
+	loaded.config.Grace = 10 * time.Minute
+	later := testNow.Add(time.Minute)
+	loaded.Found(later, "ip-10-0-0-3", true, time.Hour, later.Add(-time.Hour), 1)
+	if got := loaded.State("ip-10-0-0-3"); got != Unknown {
+		t.Errorf("host new since the loaded states: state = %s, want unknown in its grace", got)
+	}
+
+	if err := ioutil.WriteFile(config.File, []byte("{not json"), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	if s, err := Load(config); err == nil || len(s.Hosts()) != 0 {
+		t.Errorf("Load of a corrupt file = %v, %v, want an error and no hosts", s.Hosts(), err)
+	}
+}
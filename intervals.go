@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// intervalRule is the expected heartbeat interval of the hosts matching a
+// pattern.
+type intervalRule struct {
+	pattern  string
+	match    func(host string) bool
+	interval time.Duration
+}
+
+// parseIntervalRules parses lines of the form "<pattern> <interval>", e.g.
+// "web-* 10s". Patterns are globs, or regular expressions between slashes,
+// e.g. "/^worker-[0-9]+$/". Blank lines and lines starting with "#" are
+// ignored.
+func parseIntervalRules(r io.Reader) ([]intervalRule, error) {
+	rules := []intervalRule{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: must be a pattern and an interval", line)
+		}
+		rule, err := newIntervalRule(fields[0], fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+func newIntervalRule(pattern, interval string) (intervalRule, error) {
+	rule := intervalRule{pattern: pattern}
+	d, err := time.ParseDuration(interval)
+	if err != nil {
+		return rule, err
+	}
+	if d <= 0 {
+		return rule, fmt.Errorf("interval %s must be positive", interval)
+	}
+	rule.interval = d
+	rule.match, err = hostMatcher(pattern)
+	return rule, err
+}
+
+// hostMatcher returns a func matching hostnames against pattern, a glob, or
+// a regular expression between slashes.
+func hostMatcher(pattern string) (func(host string) bool, error) {
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("bad glob %q: %w", pattern, err)
+	}
+	return func(host string) bool {
+		matched, _ := path.Match(pattern, host)
+		return matched
+	}, nil
+}
+
+// hostIntervals maps hostnames to their expected heartbeat intervals, by the
+// first rule matching. The rules are re-read from their file on reload.
+type hostIntervals struct {
+	file string
+
+	mu    sync.RWMutex
+	rules []intervalRule
+}
+
+// loadHostIntervals reads the rules in file.
+func loadHostIntervals(file string) (*hostIntervals, error) {
+	h := &hostIntervals{file: file}
+	if err := h.reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// reload re-reads the rules. Invalid rules are an error, and leave the
+// current rules in place.
+func (h *hostIntervals) reload() error {
+	f, err := os.Open(h.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rules, err := parseIntervalRules(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", h.file, err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rules = rules
+	return nil
+}
+
+// interval returns the expected interval of host, if a rule matches it.
+func (h *hostIntervals) interval(host string) (time.Duration, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, rule := range h.rules {
+		if rule.match(host) {
+			return rule.interval, true
+		}
+	}
+	return 0, false
+}
+
+// count is how many rules there are.
+func (h *hostIntervals) count() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.rules)
+}
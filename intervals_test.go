@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHostIntervalsFirstMatchWins(t *testing.T) {
+	rules, err := parseIntervalRules(strings.NewReader(`
+# Specific rules go first, since the first matching rule wins.
+web-canary-* 5s
+/^web-[0-9]+$/ 10s
+web-* 30s
+* 1m
+`))
+	if err != nil {
+		t.Fatalf("parseIntervalRules: %s", err)
+	}
+	intervals := &hostIntervals{rules: rules}
+
+	tests := []struct {
+		host     string
+		interval time.Duration
+	}{
+		// Matched by every rule.
+		{host: "web-canary-1", interval: 5 * time.Second},
+		// Matched by the regular expression, web-* and *.
+		{host: "web-12", interval: 10 * time.Second},
+		// Matched by web-* and *.
+		{host: "web-blue", interval: 30 * time.Second},
+		{host: "worker-1", interval: time.Minute},
+	}
+	for _, test := range tests {
+		interval, ok := intervals.interval(test.host)
+		if !ok || interval != test.interval {
+			t.Errorf("interval(%q) = %s, %t, want %s", test.host, interval, ok, test.interval)
+		}
+	}
+
+	// Reversed, the catch-all shadows every other rule.
+	for i, j := 0, len(rules)-1; i < j; i, j = i+1, j-1 {
+		rules[i], rules[j] = rules[j], rules[i]
+	}
+	for _, test := range tests {
+		if interval, _ := intervals.interval(test.host); interval != time.Minute {
+			t.Errorf("reversed: interval(%q) = %s, want 1m", test.host, interval)
+		}
+	}
+}
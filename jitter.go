@@ -0,0 +1,70 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
+	"time"
+)
+
+// pollJitter spreads polls out, so that replicas started by the same deploy
+// don't all query Elasticsearch at the same instant. It is seeded once per
+// monitor, so the schedule it produces can be reconstructed from its seed.
+type pollJitter struct {
+	seed int64
+	// startOffset delays the first poll.
+	startOffset time.Duration
+	// tickPercent varies each interval by up to this percentage either way.
+	tickPercent int
+	// sleepSeconds delays each scheduled poll by a random number of whole
+	// seconds below it.
+	sleepSeconds int
+	rand         *rand.Rand
+}
+
+// newPollJitter returns the jitter for a monitor polling every interval. With
+// start set, the first poll is delayed by up to an interval.
+func newPollJitter(start bool, tickPercent, sleepSeconds int, interval time.Duration) *pollJitter {
+	seed := jitterSeed()
+	j := &pollJitter{
+		seed:         seed,
+		tickPercent:  tickPercent,
+		sleepSeconds: sleepSeconds,
+		rand:         rand.New(rand.NewSource(seed)),
+	}
+	if start {
+		j.startOffset = time.Duration(j.rand.Int63n(int64(interval)))
+	}
+	return j
+}
+
+// jitterSeed is cryptographically random, so monitors started together,
+// e.g. one per environment, don't share a schedule. It falls back to the
+// time if the system has no randomness to give.
+func jitterSeed() int64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.LittleEndian.Uint64(b[:]))
+}
+
+// sleep returns how long to wait before a scheduled poll. It is not safe for
+// concurrent use.
+func (j *pollJitter) sleep() time.Duration {
+	if j.sleepSeconds <= 0 {
+		return 0
+	}
+	return time.Duration(j.rand.Intn(j.sleepSeconds)) * time.Second
+}
+
+// next returns how long to wait until the poll after the one just started.
+// It is not safe for concurrent use.
+func (j *pollJitter) next(interval time.Duration) time.Duration {
+	if j.tickPercent <= 0 {
+		return interval
+	}
+	// A uniformly random fraction of the interval in [-tickPercent%, tickPercent%).
+	spread := (2*j.rand.Float64() - 1) * float64(j.tickPercent) / 100
+	return interval + time.Duration(spread*float64(interval))
+}
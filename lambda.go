@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// runLambda serves Lambda invocations, e.g. from an EventBridge schedule,
+// running one poll per invocation. It talks to the Lambda runtime API
+// directly, so the binary can be deployed as a custom runtime's bootstrap.
+//
+// The Monitor, and with it the EC2 cache, outlives each invocation, so warm
+// invocations reuse it.
+func runLambda(runtimeAPI string, monitor *Monitor) error {
+	base := fmt.Sprintf("http://%s/2018-06-01/runtime/invocation/", runtimeAPI)
+	// No timeout: fetching the next invocation blocks until there is one.
+	client := &http.Client{}
+
+	for {
+		resp, err := client.Get(base + "next")
+		if err != nil {
+			return err
+		}
+		// The event's payload doesn't matter: every invocation polls.
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status fetching next invocation: %s", resp.Status)
+		}
+
+		requestID := resp.Header.Get("Lambda-Runtime-Aws-Request-Id")
+		deadlineMS, err := strconv.ParseInt(resp.Header.Get("Lambda-Runtime-Deadline-Ms"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid invocation deadline: %s", err)
+		}
+
+		ctx, cancel := context.WithDeadline(context.Background(), time.Unix(0, deadlineMS*int64(time.Millisecond)))
+		pollErr := monitor.runTimed(ctx)
+		cancel()
+
+		// Failing the invocation lets Lambda's retries and error alarms see
+		// failed polls.
+		if pollErr != nil {
+			body, _ := json.Marshal(map[string]string{
+				"errorMessage": pollErr.Error(),
+				"errorType":    "PollFailed",
+			})
+			err = postLambda(client, base+requestID+"/error", body)
+		} else {
+			err = postLambda(client, base+requestID+"/response", []byte("{}"))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func postLambda(client *http.Client, url string, body []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("unexpected status from %s: %s", url, resp.Status)
+	}
+	return nil
+}
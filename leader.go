@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// LeaderChecker reports whether this replica should poll and send datapoints.
+type LeaderChecker interface {
+	IsLeader() bool
+}
+
+// leaderElector holds a lease on a lock item in a DynamoDB table, so that
+// only one of several replicas sends datapoints.
+//
+// The table must have a string hash key named "lock_id". The lease holder
+// records when its lease expires by its own clock. To tolerate clock skew of
+// up to maxSkew between replicas, the holder gives up leadership maxSkew before
+// its lease expires, and other replicas only take the lock over maxSkew after.
+type leaderElector struct {
+	db      dynamodbiface.DynamoDBAPI
+	table   string
+	lockID  string
+	owner   string
+	lease   time.Duration
+	maxSkew time.Duration
+	log     kv.KayveeLogger
+	now     func() time.Time
+
+	mu         sync.Mutex
+	validUntil time.Time
+}
+
+func (l *leaderElector) setClock(now func() time.Time) {
+	l.now = now
+}
+
+// IsLeader reports whether this replica currently holds the lease.
+func (l *leaderElector) IsLeader() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.now().Before(l.validUntil)
+}
+
+// Run campaigns for leadership until ctx is done, then resigns.
+func (l *leaderElector) Run(ctx context.Context) {
+	// Renew well before the lease expires, so a slow request or two doesn't
+	// lose it.
+	ticker := time.NewTicker(l.lease / 3)
+	defer ticker.Stop()
+
+	for {
+		if err := l.campaign(ctx); err != nil {
+			l.log.ErrorD("leader-election", kv.M{"error": err.Error()})
+		}
+
+		select {
+		case <-ctx.Done():
+			l.resign()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// campaign acquires the lock if it is free or expired, or renews it if this
+// replica already holds it.
+func (l *leaderElector) campaign(ctx context.Context) error {
+	start := l.now()
+	expires := start.Add(l.lease)
+	wasLeader := l.IsLeader()
+
+	_, err := l.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(l.table),
+		Item: map[string]*dynamodb.AttributeValue{
+			"lock_id":       {S: aws.String(l.lockID)},
+			"owner":         {S: aws.String(l.owner)},
+			"lease_expires": {N: aws.String(strconv.FormatInt(unixMillis(expires), 10))},
+		},
+		ConditionExpression: aws.String(
+			"attribute_not_exists(lock_id) OR #owner = :owner OR lease_expires < :stale"),
+		ExpressionAttributeNames: map[string]*string{"#owner": aws.String("owner")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner": {S: aws.String(l.owner)},
+			":stale": {N: aws.String(strconv.FormatInt(unixMillis(start.Add(-l.maxSkew)), 10))},
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		// Another replica holds the lock.
+		l.setValidUntil(time.Time{})
+		if wasLeader {
+			l.log.InfoD("leadership-lost", kv.M{"owner": l.owner})
+		}
+		return nil
+	} else if err != nil {
+		// Keep any lease we hold until it runs out: the lock may still be ours.
+		return err
+	}
+
+	// Measure validity from before the request was sent, since the lease may
+	// have been written at any point during it.
+	l.setValidUntil(expires.Add(-l.maxSkew))
+	if !wasLeader {
+		l.log.InfoD("leadership-acquired", kv.M{"owner": l.owner})
+	}
+	return nil
+}
+
+// resign releases the lock, if held, so another replica can take over
+// without waiting for the lease to expire.
+func (l *leaderElector) resign() {
+	l.setValidUntil(time.Time{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := l.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(l.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"lock_id": {S: aws.String(l.lockID)},
+		},
+		ConditionExpression:      aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]*string{"#owner": aws.String("owner")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner": {S: aws.String(l.owner)},
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return
+	} else if err != nil {
+		l.log.ErrorD("leader-resign", kv.M{"error": err.Error()})
+	}
+}
+
+func (l *leaderElector) setValidUntil(t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.validUntil = t
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
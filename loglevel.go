@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// logLevels are the levels LOG_LEVEL and /control/loglevel accept.
+var logLevels = map[string]kv.LogLevel{
+	"trace":    kv.Trace,
+	"debug":    kv.Debug,
+	"info":     kv.Info,
+	"warning":  kv.Warning,
+	"error":    kv.Error,
+	"critical": kv.Critical,
+}
+
+// logLevelHandler reports the log level on GET and changes it on POST, e.g.
+// to turn on debug logs during an incident without a redeploy.
+type logLevelHandler struct {
+	log kv.KayveeLogger
+
+	mu    sync.Mutex
+	level kv.LogLevel
+}
+
+func newLogLevelHandler(log kv.KayveeLogger, level kv.LogLevel) *logLevelHandler {
+	log.SetLogLevel(level)
+	return &logLevelHandler{log: log, level: level}
+}
+
+func (h *logLevelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		name := r.URL.Query().Get("level")
+		level, ok := logLevels[name]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown level %q", name), http.StatusBadRequest)
+			return
+		}
+		h.log.InfoD("log-level-changed", kv.M{"from": h.level.String(), "to": level.String()})
+		h.log.SetLogLevel(level)
+		h.level = level
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fmt.Fprintln(w, h.level.String())
+}
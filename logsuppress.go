@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// errorLogSuppressor collapses errors of the same type that repeat at the
+// same stage into a summary logged once per window, so a sustained outage
+// doesn't flood the logs. It is safe for concurrent use.
+type errorLogSuppressor struct {
+	log    kv.KayveeLogger
+	window time.Duration
+	now    func() time.Time
+
+	mu     sync.Mutex
+	errors map[suppressKey]*repeatedError
+	// counts are the errors at each stage since they were last taken,
+	// suppressed or not.
+	counts map[string]int
+}
+
+// suppressKey identifies the errors collapsed together: those at the same
+// stage with the same error_type. Unclassified errors must also have the same
+// message.
+type suppressKey struct {
+	title   string
+	errType string
+	msg     string
+}
+
+// repeatedError is the last error logged at a stage.
+type repeatedError struct {
+	msg     string
+	errType string
+	// since is when the current window started.
+	since time.Time
+	// count is the number of repeats not yet logged.
+	count int
+}
+
+func newErrorLogSuppressor(log kv.KayveeLogger, window time.Duration, now func() time.Time) *errorLogSuppressor {
+	return &errorLogSuppressor{
+		log:    log,
+		window: window,
+		now:    now,
+		errors: map[suppressKey]*repeatedError{},
+		counts: map[string]int{},
+	}
+}
+
+// Error logs err under title, the stage it happened at, unless an error of
+// the same type was already logged at that stage within the window. It logs
+// to the poll logger carried by ctx, if any.
+func (s *errorLogSuppressor) Error(ctx context.Context, title string, err error) {
+	msg, errType := err.Error(), errorType(err)
+	log := loggerFrom(ctx, s.log)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[title]++
+
+	if s.window <= 0 {
+		log.ErrorD(title, kv.M{"error": msg, "error_type": errType})
+		return
+	}
+
+	key := suppressKey{title: title, errType: errType}
+	if errType == "other" {
+		key.msg = msg
+	}
+
+	now := s.now()
+	if last, ok := s.errors[key]; ok {
+		last.msg = msg
+		last.count++
+		if now.Sub(last.since) >= s.window {
+			log.ErrorD(title, s.summary(last, now))
+			last.since = now
+			last.count = 0
+		}
+		return
+	}
+
+	log.ErrorD(title, kv.M{"error": msg, "error_type": errType})
+	s.errors[key] = &repeatedError{msg: msg, errType: errType, since: now}
+}
+
+// Clear records that the stage succeeded, logging a summary of the repeats of
+// its errors that weren't logged yet.
+func (s *errorLogSuppressor) Clear(ctx context.Context, title string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for key, last := range s.errors {
+		if key.title != title {
+			continue
+		}
+		delete(s.errors, key)
+		s.flush(loggerFrom(ctx, s.log), title, last, now)
+	}
+}
+
+// takeCounts returns the number of errors at each stage since the last call.
+func (s *errorLogSuppressor) takeCounts() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := s.counts
+	s.counts = map[string]int{}
+	return counts
+}
+
+func (s *errorLogSuppressor) flush(log kv.KayveeLogger, title string, last *repeatedError, now time.Time) {
+	if last.count == 0 {
+		return
+	}
+	data := s.summary(last, now)
+	data["stage"] = title
+	log.InfoD("error-cleared", data)
+}
+
+func (s *errorLogSuppressor) summary(last *repeatedError, now time.Time) kv.M {
+	minutes := int(math.Ceil(now.Sub(last.since).Minutes()))
+	return kv.M{
+		"error":      last.msg,
+		"error_type": last.errType,
+		"repeats":    last.count,
+		"summary":    fmt.Sprintf("suppressed %d identical errors in the last %dm", last.count, minutes),
+	}
+}
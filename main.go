@@ -2,62 +2,44 @@ package main
 
 import (
 	"context"
-	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"net/http"
+	"net/http/pprof"
 	"os"
+	"os/signal"
 	"path"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ec2"
-	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/Clever/log-monitor-es/hoststate"
 	"github.com/signalfx/golib/datapoint"
 	"github.com/signalfx/golib/sfxclient"
 	kv "gopkg.in/Clever/kayvee-go.v6/logger"
-	elastic "gopkg.in/olivere/elastic.v5"
 )
 
-var kvlog kv.KayveeLogger
-var sfxSink *sfxclient.HTTPSink
+// exitCodeTooManyFailures is the exit code when too many polls in a row fail,
+// distinct from crashes so task-failure alerts can tell them apart.
+const exitCodeTooManyFailures = 3
 
-var errNoResultsFound = errors.New("No search results found")
+// exitCodeTooManyPanics is the exit code when too many polls panic.
+const exitCodeTooManyPanics = 4
 
-type FailedSearchError struct {
-	originalErr error
-}
-
-func (e FailedSearchError) Error() string {
-	return "error while searching: " + e.originalErr.Error()
-}
-
-// Config vars
-var componentName, elasticsearchIndex, elasticsearchURI, environment, signalfxAPIKey, metricName string
-
-// getEnv looks up an environment variable given and exits if it does not exist.
-func getEnv(envVar string) string {
-	val := os.Getenv(envVar)
-	if val == "" {
-		log.Fatalf("Must specify env variable %s", envVar)
+func main() {
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
+	build := currentBuild()
+	if *showVersion {
+		fmt.Printf("log-monitor-es %s (commit %s, built %s)\n", build.Version, build.Commit, build.BuildDate)
+		return
 	}
-	return val
-}
-
-func init() {
-	elasticsearchURI = getEnv("ELASTICSEARCH_URI")
-	elasticsearchIndex = getEnv("ELASTICSEARCH_INDEX")
-	signalfxAPIKey = getEnv("SIGNALFX_API_KEY")
-	metricName = getEnv("METRIC_NAME")
-	componentName = getEnv("COMPONENT_NAME")
-	environment = getEnv("DEPLOY_ENV")
 
-	sfxSink = sfxclient.NewHTTPSink()
-	sfxSink.AuthToken = signalfxAPIKey
-
-	kvlog = kv.New("log-monitor-es")
+	cfg := loadConfig()
 
+	// Routing must be set up before anything is logged, startup lines
+	// included.
 	exePath, err := os.Executable()
 	if err != nil {
 		log.Fatal(err)
@@ -67,169 +49,342 @@ func init() {
 	if err != nil {
 		log.Fatal(err)
 	}
-}
-
-func getLatestTimestamps(esClient *elastic.Client) (map[string]time.Time, error) {
-	hostname := elastic.NewTermsAggregation().Field("hostname").Size(500)
-	timestamp := elastic.NewMaxAggregation().Field("timestamp")
-	// Increasing ShardSize should increase accuracy:
-	hostname = hostname.SubAggregation("latestTimes", timestamp).ShardSize(1500)
-
-	q := elastic.NewBoolQuery()
-	q = q.Must(elastic.NewTermQuery("title", "heartbeat"))
-	q = q.Must(elastic.NewRangeQuery("timestamp").Gte("now-1h").Lte("now"))
-
-	searchResult, err := esClient.Search().
-		Index(elasticsearchIndex).
-		Query(q).
-		Size(0).
-		Aggregation("hosts", hostname).
-		Pretty(true).
-		Timeout("30s").
-		Do(context.TODO())
 
+	kvlog := kv.New("log-monitor-es")
+	kvlog.AddContext("component", cfg.ComponentName)
+	kvlog.AddContext("environment", cfg.Environment)
+	kvlog.InfoD("startup", kv.M{
+		"version":    build.Version,
+		"commit":     build.Commit,
+		"build_date": build.BuildDate,
+	})
+	kvlog.InfoD("config", cfg.Redacted().logFields())
+	logLevel := newLogLevelHandler(kvlog, logLevels[cfg.LogLevel])
+
+	esClient, err := newESClient(cfg)
 	if err != nil {
-		return nil, FailedSearchError{err}
+		log.Fatalf("Failed to create ES client: %s\n", err)
 	}
 
-	agg, found := searchResult.Aggregations.Terms("hosts")
-	if !found {
-		return nil, errNoResultsFound
+	awsClients := newAWSClients(cfg, kvlog)
+
+	var sinks multiSink
+	// sfxToken is the SignalFX API key, however it was found.
+	sfxToken := cfg.SignalfxAPIKey
+	var memorySink *MemorySink
+	var sfxKeys *tokenSink
+	for _, name := range cfg.Sinks {
+		switch name {
+		case "memory":
+			if memorySink == nil {
+				memorySink = NewMemorySink(cfg.MemorySinkSize)
+				sinks = append(sinks, memorySink)
+			}
+		case "signalfx":
+			sfxSink := sfxclient.NewHTTPSink()
+			sfxSink.AuthToken = cfg.SignalfxAPIKey
+			if cfg.SignalfxEndpoint != "" {
+				sfxSink.DatapointEndpoint = cfg.SignalfxEndpoint
+			}
+			if cfg.SinkClientCert != "" || cfg.SinkCACert != "" {
+				tlsConfig, err := sinkTLSConfig(cfg.SinkClientCert, cfg.SinkClientKey, cfg.SinkCACert)
+				if err != nil {
+					log.Fatalf("Failed to configure sink TLS: %s\n", err)
+				}
+				sfxSink.Client.Transport = &http.Transport{
+					Proxy:           http.ProxyFromEnvironment,
+					TLSClientConfig: tlsConfig,
+				}
+			}
+			// Wrapped so the key can be rotated without a restart.
+			sfxKeys = &tokenSink{sink: sfxSink}
+			sinks = append(sinks, sfxKeys)
+			if cfg.SignalfxAPIKeySSMPath == "" {
+				break
+			}
+			ssmapi := awsClients.SSM()
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			token, err := getSSMParameter(ctx, ssmapi, cfg.SignalfxAPIKeySSMPath)
+			cancel()
+			if err != nil {
+				log.Fatalf("Failed to read the SignalFX API key: %s\n", err)
+			}
+			sfxSink.AuthToken = token
+			sfxToken = token
+			refresher := &ssmTokenRefresher{
+				ssm:      ssmapi,
+				name:     cfg.SignalfxAPIKeySSMPath,
+				interval: cfg.SignalfxAPIKeySSMRefresh,
+				sink:     sfxKeys,
+				log:      kvlog,
+			}
+			go refresher.Run(context.Background())
+		case "datadog":
+			ddSink, err := NewDatadogSink(cfg.DogStatsDAddr, cfg.DDMetricPrefix)
+			if err != nil {
+				log.Fatalf("Failed to create Datadog sink: %s\n", err)
+			}
+			sinks = append(sinks, ddSink)
+		}
+	}
+	var sink MetricSink = sinks
+	if len(sinks) == 1 {
+		sink = sinks[0]
 	}
 
-	results := map[string]time.Time{}
-	for _, hostBucket := range agg.Buckets {
-		// Every bucket should have the hostname field as key.
-		host := hostBucket.Key.(string)
+	ec2api := awsClients.EC2()
+	ec2ip := &ec2IPChecker{
+		ec2api:           ec2api,
+		log:              kvlog,
+		suppressTagKey:   cfg.EC2SuppressTagKey,
+		suppressTagValue: cfg.EC2SuppressTagValue,
+		filterTags:       cfg.EC2FilterTags,
+		checkStatus:      cfg.EC2CheckStatus,
+		now:              time.Now,
+	}
 
-		// The sub-aggregation latestTimes
-		maxTime, found := hostBucket.Max("latestTimes")
-		if found {
-			// Convert from milliseconds (as returned by Elasticsearch) to
-			// seconds (as needed by time.Unix()). Sub-second resolution
-			// does not matter for this monitor.
-			results[host] = time.Unix(int64(*maxTime.Value)/1000, 0)
+	searcher := &esSearcher{client: esClient, config: cfg, log: kvlog, now: time.Now}
+	monitor := NewMonitor(cfg, searcher, ec2ip, sink, kvlog)
+	if cfg.HostStateFile != "" {
+		states, err := hoststate.Load(hostStateConfig(cfg))
+		if err != nil {
+			// Start afresh rather than not monitoring.
+			kvlog.ErrorD("host-state-load", kv.M{"file": cfg.HostStateFile, "error": err.Error()})
 		}
+		monitor.states = states
 	}
-	return results, nil
-}
-
-func sendToSignalFX(timestamps map[string]time.Time) error {
-	points := []*datapoint.Datapoint{}
-	now := time.Now()
-	for host, timestamp := range timestamps {
-		dimensions := map[string]string{
-			"hostname":    host,
-			"component":   componentName,
-			"environment": environment,
+	// addNotifier adds n, sending its transitions in digests if channel is
+	// one of DigestChannels, and at most once per NotifyCooldown for each
+	// host.
+	addNotifier := func(channel string, n Notifier) {
+		for _, c := range cfg.DigestChannels {
+			if c == channel {
+				digest := newDigestNotifier(channel, n, cfg, kvlog)
+				go digest.Run(context.Background())
+				n = digest
+				break
+			}
 		}
-
-		datum := sfxclient.Gauge(metricName, dimensions, timestamp.Unix())
-		delta := now.Sub(timestamp).Seconds()
-		datumLag := sfxclient.GaugeF(fmt.Sprintf("%s-lag", metricName), dimensions, delta)
-		points = append(points, datum, datumLag)
+		if cfg.NotifyCooldown > 0 {
+			n = &cooldownNotifier{channel: channel, next: n, cooldown: cfg.NotifyCooldown, states: monitor.states, now: time.Now}
+		}
+		monitor.notifiers = append(monitor.notifiers, n)
 	}
-
-	return sfxSink.AddDatapoints(context.TODO(), points)
-}
-
-type ec2IPChecker struct {
-	ec2api            ec2iface.EC2API
-	lastCheck         time.Time
-	privateIPsRunning map[string]struct{}
-}
-
-func (e *ec2IPChecker) updateCache() error {
-	if e.privateIPsRunning != nil && time.Now().Sub(e.lastCheck) < 1*time.Minute {
-		return nil
-	}
-
-	privateIPsRunning := map[string]struct{}{}
-	if err := e.ec2api.DescribeInstancesPages(&ec2.DescribeInstancesInput{
-		Filters: []*ec2.Filter{{
-			Name:   aws.String("instance-state-name"),
-			Values: []*string{aws.String("running")},
-		}},
-	}, func(output *ec2.DescribeInstancesOutput, lastPage bool) bool {
-		for _, res := range output.Reservations {
-			for _, instance := range res.Instances {
-				if instance.PrivateIpAddress != nil {
-					privateIPsRunning[*instance.PrivateIpAddress] = struct{}{}
+	if cfg.SlackWebhookURL != "" {
+		addNotifier("slack", newSlackNotifier(cfg))
+	}
+	if cfg.PagerDutyRoutingKey != "" {
+		monitor.pagerDuty = newPagerDuty(cfg, kvlog)
+		monitor.pagerDuty.states = monitor.states
+	}
+	// loadConfig checked the regex already.
+	monitor.hostIPs, _ = newHostIPParser(cfg.HostnameIPRegex, cfg.HostnameIPSeparator)
+	if cfg.HostCountDropPercent > 0 {
+		monitor.hostCount = &hostCountWatch{percent: cfg.HostCountDropPercent, window: cfg.HostCountDropWindow}
+	}
+	if cfg.LagAnomalyWindow > 0 {
+		baseline, err := loadLagBaseline(cfg.LagAnomalyWindow, cfg.LagAnomalyStddevs, cfg.LagAnomalyMinSamples, cfg.LagAnomalyStateFile)
+		if err != nil {
+			// Start a new baseline rather than not monitoring.
+			kvlog.ErrorD("lag-baseline-load", kv.M{"file": cfg.LagAnomalyStateFile, "error": err.Error()})
+			baseline.samples = nil
+		}
+		monitor.lagBaseline = baseline
+	}
+	if cfg.HostIntervalsFile != "" {
+		intervals, err := loadHostIntervals(cfg.HostIntervalsFile)
+		if err != nil {
+			log.Fatalf("Invalid HOST_INTERVALS_FILE: %s\n", err)
+		}
+		monitor.intervals = intervals
+		kvlog.InfoD("host-intervals-loaded", kv.M{"rules": intervals.count()})
+
+		// SIGHUP re-reads the file. Invalid rules keep the current ones.
+		reloads := make(chan os.Signal, 1)
+		signal.Notify(reloads, syscall.SIGHUP)
+		go func() {
+			for range reloads {
+				if err := intervals.reload(); err != nil {
+					kvlog.ErrorD("host-intervals-reload", kv.M{"error": err.Error()})
+					continue
 				}
+				kvlog.InfoD("host-intervals-loaded", kv.M{"rules": intervals.count()})
 			}
+		}()
+	}
+	var expectedSource expectedHostSource
+	switch {
+	case len(cfg.ExpectedHosts) > 0:
+		expectedSource = staticHosts(cfg.ExpectedHosts)
+	case cfg.ExpectedHostsFile != "":
+		expectedSource = fileHosts(cfg.ExpectedHostsFile)
+	case cfg.ExpectedHostsASG != "":
+		expectedSource = &asgHosts{autoscaling: awsClients.AutoScaling(), ec2api: ec2api, name: cfg.ExpectedHostsASG, now: time.Now}
+	}
+	if expectedSource != nil {
+		monitor.expected = newExpectedHosts(expectedSource, cfg.ExpectedHostsGrace)
+	}
+	if cfg.SNSTopicARN != "" {
+		publisher := newSNSPublisher(awsClients.SNS(), cfg, kvlog)
+		go publisher.Run(context.Background())
+		addNotifier("sns", publisher)
+	}
+	if cfg.WebhookURL != "" {
+		hook := newWebhook(cfg, kvlog)
+		go hook.Run(context.Background())
+		addNotifier("webhook", hook)
+	}
+
+	// "log-monitor-es check" validates the config against each dependency
+	// once, e.g. as a container healthcheck or before promoting a change.
+	if flag.Arg(0) == "check" {
+		checks := []dependencyCheck{
+			{name: "elasticsearch", check: searcher.checkIndex},
+			{name: "ec2", check: func(ctx context.Context) error { return checkEC2(ctx, ec2api) }},
+			{name: "sink", check: monitor.checkSink},
 		}
-		return true
-	}); err != nil {
-		return err
+		if !runChecks(context.Background(), os.Stdout, checks) {
+			os.Exit(1)
+		}
+		return
 	}
 
-	e.privateIPsRunning = privateIPsRunning
-	e.lastCheck = time.Now()
-	return nil
-}
+	if cfg.MappingCheck != "off" {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		problems := searcher.selfTest(ctx)
+		cancel()
+		for _, problem := range problems {
+			kvlog.ErrorD("mapping-check", kv.M{"problem": problem})
+		}
+		if len(problems) > 0 && cfg.MappingCheck == "fail" {
+			log.Fatalf("Mapping check failed: %s\n", strings.Join(problems, "; "))
+		}
+	}
 
-func (e *ec2IPChecker) IsRunning(ip string) (bool, error) {
-	if err := e.updateCache(); err != nil {
-		return false, err
+	if cfg.SFXCreateDetector {
+		detectors := &sfxDetectors{
+			apiURL: cfg.SFXAPIURL,
+			token:  sfxToken,
+			client: &http.Client{Timeout: 10 * time.Second},
+		}
+		detector := monitor.lagDetector(cfg.SFXDetectorLagThreshold)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		created, err := detectors.ensure(ctx, detector)
+		cancel()
+		if err != nil {
+			// Alerting can be set up by hand, so keep monitoring.
+			kvlog.ErrorD("sfx-detector", kv.M{"detector": detector.Name, "error": err.Error()})
+		} else if created {
+			kvlog.InfoD("sfx-detector-created", kv.M{"detector": detector.Name})
+		}
 	}
-	_, ok := e.privateIPsRunning[ip]
-	return ok, nil
-}
 
-func main() {
-	// For AWS logs-* clusters, access is controlled by IP address so no signing is needed,
-	// but since AWS blocks some APIs, sniffing and healthchecks are disabled.
-	esClient, err := elastic.NewClient(
-		elastic.SetURL(elasticsearchURI),
-		elastic.SetScheme("https"),
-		elastic.SetSniff(false),
-		elastic.SetHealthcheck(false),
-	)
+	// In Lambda, each invocation runs one poll, and there's nothing to serve
+	// or elect a leader among.
+	if cfg.LambdaRuntimeAPI != "" {
+		if err := runLambda(cfg.LambdaRuntimeAPI, monitor); err != nil {
+			log.Fatalf("Lambda runtime failed: %s\n", err)
+		}
+		return
+	}
 
-	if err != nil {
-		log.Fatalf("Failed to create ES client: %s\n", err)
+	if cfg.WatchdogTimeout > 0 {
+		monitor.watchdog = &watchdog{timeout: cfg.WatchdogTimeout, log: kvlog, now: time.Now}
+		go monitor.watchdog.Run(context.Background())
 	}
 
-	sess := session.New()
-	ec2api := ec2.New(sess)
-	ec2ip := &ec2IPChecker{ec2api: ec2api}
-
-	for c := time.Tick(30 * time.Second); ; <-c {
-		timestamps, err := getLatestTimestamps(esClient)
-		if err == errNoResultsFound {
-			kvlog.WarnD("no-search-results", kv.M{"error": err.Error()})
-			continue
-		} else if ferr, ok := err.(FailedSearchError); ok {
-			kvlog.ErrorD("failed-search", kv.M{"error": ferr.Error()})
-			continue
-		} else if err != nil {
-			kvlog.ErrorD("timestamp", kv.M{"error": err.Error()})
-			continue
-		}
-
-		// correct the data for instances that aren't running
-		for hostname := range timestamps {
-			if strings.HasPrefix(hostname, "ip-") {
-				// parse IP address out of ES hostnames of the form ip-10-0-0-1
-				ip := strings.Replace(strings.TrimPrefix(hostname, "ip-"), "-", ".", -1)
-				running, err := ec2ip.IsRunning(ip)
-				if err != nil {
-					kvlog.ErrorD("ec2-ip-check", kv.M{"error": err.Error()})
-				} else if !running {
-					// set to now so that signalfx's last datapoint is ok
-					timestamps[hostname] = time.Now()
-				}
-			}
+	// SIGTERM, e.g. from ECS stopping the task, stops polling. The leader
+	// election outlives it, so a final flush can still send.
+	ctx, stop := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		kvlog.InfoD("shutdown", kv.M{"signal": sig.String()})
+		stop()
+	}()
+
+	if cfg.StartupMaxRetries > 0 {
+		checks := []dependencyCheck{
+			{name: "elasticsearch", check: func(ctx context.Context) error {
+				_, _, err := esClient.Ping(cfg.ElasticsearchURI).Do(ctx)
+				return err
+			}},
+			{name: "sink", check: func(ctx context.Context) error {
+				point := sfxclient.Gauge("monitor.startup", monitor.selfDimensions(), 1)
+				return sink.AddDatapoints(ctx, []*datapoint.Datapoint{point})
+			}},
+		}
+		if err := waitForDependencies(ctx, kvlog, cfg.StartupMaxRetries, checks); err != nil {
+			log.Fatalf("Startup check failed: %s\n", err)
 		}
+	}
 
-		// Log the number of hosts reported
-		kvlog.DebugD("timestamp", kv.M{"count": len(timestamps)})
+	if cfg.LeaderLockTable != "" {
+		elector := &leaderElector{
+			db:      awsClients.DynamoDB(),
+			table:   cfg.LeaderLockTable,
+			lockID:  fmt.Sprintf("%s-%s", cfg.ComponentName, cfg.Environment),
+			owner:   cfg.LeaderID,
+			lease:   cfg.LeaderLease,
+			maxSkew: cfg.LeaderMaxClockSkew,
+			log:     kvlog,
+			now:     time.Now,
+		}
+		electionCtx, resign := context.WithCancel(context.Background())
+		resigned := make(chan struct{})
+		go func() {
+			elector.Run(electionCtx)
+			close(resigned)
+		}()
+		defer func() {
+			resign()
+			<-resigned
+		}()
+		monitor.leader = elector
+	}
 
-		err = sendToSignalFX(timestamps)
-		if err != nil {
-			kvlog.ErrorD("send-to-signalfx", kv.M{"error": err.Error()})
-			continue
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sample", monitor.handleSample)
+	mux.HandleFunc("/status", monitor.handleStatus)
+	mux.HandleFunc("/health", monitor.handleHealth)
+	if memorySink != nil {
+		mux.Handle("/debug/metrics", memorySink)
+	}
+	if cfg.PprofEnabled {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	go func() {
+		log.Fatal(http.ListenAndServe(":"+cfg.HTTPPort, mux))
+	}()
+	if cfg.ControlPort != "" {
+		control := newControlHandler(monitor, cfg.ControlAPIToken, cfg.SFXKeyRotationEndpoint, sfxKeys, logLevel)
+		go func() {
+			log.Fatal(http.ListenAndServe(":"+cfg.ControlPort, control))
+		}()
+	}
+
+	switch monitor.Run(ctx) {
+	case errTooManyFailures:
+		os.Exit(exitCodeTooManyFailures)
+	case errTooManyPanics:
+		os.Exit(exitCodeTooManyPanics)
+	}
+
+	if cfg.FlushOnShutdown {
+		flushCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownFlushTimeout)
+		defer cancel()
+		if err := monitor.Flush(flushCtx); err != nil {
+			kvlog.ErrorD("shutdown-flush", kv.M{"error": err.Error()})
 		}
-		kvlog.Trace("sent-to-signalfx")
+	}
+	if len(cfg.DigestChannels) > 0 {
+		digestCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownFlushTimeout)
+		defer cancel()
+		monitor.flushDigests(digestCtx)
 	}
 }
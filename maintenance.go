@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// How hosts are reported in maintenance, by MaintenanceDatapoints.
+const (
+	maintenanceReportNow = "now"
+	maintenanceTag       = "tag"
+	maintenanceWithhold  = "withhold"
+)
+
+// maintenanceWindow is a planned maintenance, from Start up to End.
+type maintenanceWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// parseMaintenanceWindows parses comma-separated RFC3339 ranges, e.g.
+// "2024-05-01T22:00:00Z/2024-05-02T02:00:00Z".
+func parseMaintenanceWindows(s string) ([]maintenanceWindow, error) {
+	var windows []maintenanceWindow
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		bounds := strings.SplitN(part, "/", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("maintenance window %q must be of the form start/end", part)
+		}
+		start, err := time.Parse(time.RFC3339, strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, err
+		}
+		end, err := time.Parse(time.RFC3339, strings.TrimSpace(bounds[1]))
+		if err != nil {
+			return nil, err
+		}
+		if !end.After(start) {
+			return nil, fmt.Errorf("maintenance window %q ends before it starts", part)
+		}
+		windows = append(windows, maintenanceWindow{Start: start, End: end})
+	}
+	return windows, nil
+}
+
+func (w maintenanceWindow) contains(t time.Time) bool {
+	return !t.Before(w.Start) && t.Before(w.End)
+}
+
+// maintenance pauses alerting, e.g. during planned cluster maintenance, while
+// it is on. It is on during the configured windows, and can also be turned on
+// and off with POST requests, optionally turning itself off after a while.
+type maintenance struct {
+	log     kv.KayveeLogger
+	now     func() time.Time
+	windows []maintenanceWindow
+
+	mu sync.Mutex
+	on bool
+	// until is when maintenance turns itself off, or zero if it doesn't.
+	until time.Time
+	// window is the window in progress, if any.
+	window *maintenanceWindow
+}
+
+// maintenanceState is the JSON body of /control/maintenance responses.
+type maintenanceState struct {
+	Enabled bool       `json:"enabled"`
+	Until   *time.Time `json:"until,omitempty"`
+	// Window is the configured window in progress, if any.
+	Window *maintenanceWindow `json:"window,omitempty"`
+}
+
+// active reports whether maintenance is on, either turned on or in a window.
+func (m *maintenance) active() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	if m.on && !m.until.IsZero() && !now.Before(m.until) {
+		m.on = false
+		m.log.InfoD("maintenance-expired", kv.M{"until": m.until.Format(time.RFC3339)})
+	}
+	m.updateWindow(now)
+	return m.on || m.window != nil
+}
+
+// updateWindow logs entering and leaving the configured windows.
+func (m *maintenance) updateWindow(now time.Time) {
+	var current *maintenanceWindow
+	for i := range m.windows {
+		if m.windows[i].contains(now) {
+			current = &m.windows[i]
+			break
+		}
+	}
+	if current == m.window {
+		return
+	}
+	if m.window != nil {
+		m.log.InfoD("maintenance-window-ended", kv.M{
+			"start": m.window.Start.Format(time.RFC3339),
+			"end":   m.window.End.Format(time.RFC3339),
+		})
+	}
+	if current != nil {
+		m.log.InfoD("maintenance-window-started", kv.M{
+			"start": current.Start.Format(time.RFC3339),
+			"end":   current.End.Format(time.RFC3339),
+		})
+	}
+	m.window = current
+}
+
+// state returns whether maintenance is on, and why.
+func (m *maintenance) state() maintenanceState {
+	state := maintenanceState{Enabled: m.active()}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.on && !m.until.IsZero() {
+		until := m.until
+		state.Until = &until
+	}
+	if m.window != nil {
+		window := *m.window
+		state.Window = &window
+	}
+	return state
+}
+
+// ServeHTTP reports whether maintenance is on on GET, and turns it on or off
+// on POST with ?enabled=true|false (default true), and optionally
+// ?duration=2h after which it turns itself off.
+func (m *maintenance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		enabled := true
+		if param := r.URL.Query().Get("enabled"); param != "" {
+			var err error
+			if enabled, err = strconv.ParseBool(param); err != nil {
+				http.Error(w, "enabled must be a boolean", http.StatusBadRequest)
+				return
+			}
+		}
+		var until time.Time
+		if param := r.URL.Query().Get("duration"); param != "" && enabled {
+			duration, err := time.ParseDuration(param)
+			if err != nil || duration <= 0 {
+				http.Error(w, "duration must be a positive duration, e.g. 2h", http.StatusBadRequest)
+				return
+			}
+			until = m.now().Add(duration)
+		}
+		m.set(enabled, until)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.state())
+}
+
+func (m *maintenance) set(on bool, until time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.on = on
+	m.until = until
+	data := kv.M{"enabled": on}
+	if !until.IsZero() {
+		data["until"] = until.Format(time.RFC3339)
+	}
+	m.log.InfoD("maintenance-changed", data)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// fieldMapping is how a field is mapped in one index.
+type fieldMapping struct {
+	Type string `json:"type"`
+	// Fields are the field's sub-fields, e.g. a keyword version of a text
+	// field.
+	Fields map[string]struct {
+		Type string `json:"type"`
+	} `json:"fields"`
+}
+
+// fieldMappingResponse is the body of a get field mapping request, keyed by
+// index, then type, then field.
+type fieldMappingResponse map[string]struct {
+	Mappings map[string]map[string]struct {
+		// Mapping is keyed by the last part of the field's name.
+		Mapping map[string]fieldMapping `json:"mapping"`
+	} `json:"mappings"`
+}
+
+// fieldMappings returns how each of fields is mapped in every index and type
+// of the configured index pattern. Unmapped fields are left out.
+func (s *esSearcher) fieldMappings(ctx context.Context, fields ...string) (map[string][]fieldMapping, error) {
+	raw, err := s.getClient().GetFieldMapping().
+		Index(s.config.ElasticsearchIndex).
+		Field(fields...).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Decode the generic response into its known shape.
+	body, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var resp fieldMappingResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+
+	mappings := map[string][]fieldMapping{}
+	for _, index := range resp {
+		for _, types := range index.Mappings {
+			for field, m := range types {
+				leaf := field[strings.LastIndex(field, ".")+1:]
+				if mapping, ok := m.Mapping[leaf]; ok {
+					mappings[field] = append(mappings[field], mapping)
+				}
+			}
+		}
+	}
+	return mappings, nil
+}
+
+// checkMappings verifies that hosts can be aggregated by their hostname and
+// heartbeats by their timestamp, and returns the problems found. Where the
+// hostname is analyzed text with a keyword sub-field, the sub-field is used
+// instead.
+func (s *esSearcher) checkMappings(ctx context.Context) ([]string, error) {
+	hostname, timestamp := s.hostnameField(), s.config.ESTimestampField
+	mappings, err := s.fieldMappings(ctx, hostname, timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	problems := []string{}
+	switch {
+	case len(mappings[hostname]) == 0:
+		problems = append(problems, fmt.Sprintf("%s is not mapped", hostname))
+	case allMapped(mappings[hostname], isKeyword):
+	case allMapped(mappings[hostname], hasKeywordField):
+		s.hostField = hostname + ".keyword"
+		s.log.InfoD("mapping-check", kv.M{"hostname_field": s.hostField})
+	default:
+		problems = append(problems, fmt.Sprintf(
+			"%s is not a keyword, so hostnames would be split into words", hostname))
+	}
+
+	isDate := func(m fieldMapping) bool { return m.Type == "date" }
+	if len(mappings[timestamp]) == 0 {
+		problems = append(problems, fmt.Sprintf("%s is not mapped", timestamp))
+	} else if !allMapped(mappings[timestamp], isDate) {
+		problems = append(problems, fmt.Sprintf("%s is not a date", timestamp))
+	}
+	return problems, nil
+}
+
+func isKeyword(m fieldMapping) bool {
+	return m.Type == "keyword"
+}
+
+func hasKeywordField(m fieldMapping) bool {
+	return m.Fields["keyword"].Type == "keyword"
+}
+
+// allMapped reports whether every one of mappings satisfies ok.
+func allMapped(mappings []fieldMapping, ok func(fieldMapping) bool) bool {
+	for _, m := range mappings {
+		if !ok(m) {
+			return false
+		}
+	}
+	return true
+}
+
+// probe runs the heartbeat search once and logs what it found, so a
+// misconfigured title or filter is obvious right after a deploy.
+func (s *esSearcher) probe(ctx context.Context) error {
+	result, err := s.heartbeatSearch().Do(ctx)
+	if err != nil {
+		return newFailedSearchError(err)
+	}
+	data := kv.M{"hosts": 0}
+	if result.Hits != nil {
+		data["documents"] = result.Hits.TotalHits
+	}
+	if agg, found := result.Aggregations.Terms("hosts"); found {
+		data["hosts"] = len(agg.Buckets)
+	}
+	s.log.InfoD("probe-query", data)
+	return nil
+}
+
+// selfTest checks the mappings and runs the probe query, returning the
+// problems found.
+func (s *esSearcher) selfTest(ctx context.Context) []string {
+	problems, err := s.checkMappings(ctx)
+	if err != nil {
+		return []string{fmt.Sprintf("fetching mappings: %s", err)}
+	}
+	if err := s.probe(ctx); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return problems
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/signalfx/golib/datapoint"
+)
+
+// MemorySink keeps the most recent datapoints in a circular buffer, for
+// developing without SignalFX credentials.
+type MemorySink struct {
+	mu     sync.Mutex
+	points []*datapoint.Datapoint
+	next   int
+	full   bool
+	now    func() time.Time
+}
+
+func (m *MemorySink) setClock(now func() time.Time) {
+	m.now = now
+}
+
+// NewMemorySink returns a MemorySink holding at most size datapoints.
+func NewMemorySink(size int) *MemorySink {
+	return &MemorySink{points: make([]*datapoint.Datapoint, size), now: time.Now}
+}
+
+// AddDatapoints stores points, overwriting the oldest datapoints once the
+// buffer is full.
+func (m *MemorySink) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.points) == 0 {
+		return nil
+	}
+
+	now := m.now()
+	for _, point := range points {
+		stored := *point
+		// Like sfxclient.HTTPSink, treat an unset timestamp as "now".
+		if stored.Timestamp.IsZero() {
+			stored.Timestamp = now
+		}
+		m.points[m.next] = &stored
+		m.next = (m.next + 1) % len(m.points)
+		if m.next == 0 {
+			m.full = true
+		}
+	}
+	return nil
+}
+
+// Datapoints returns the buffered datapoints, oldest first.
+func (m *MemorySink) Datapoints() []*datapoint.Datapoint {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.full {
+		return append([]*datapoint.Datapoint{}, m.points[:m.next]...)
+	}
+	return append(append([]*datapoint.Datapoint{}, m.points[m.next:]...), m.points[:m.next]...)
+}
+
+// ServeHTTP writes the buffered datapoints as JSON.
+func (m *MemorySink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(m.Datapoints()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
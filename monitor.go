@@ -0,0 +1,1103 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Clever/log-monitor-es/hoststate"
+	"github.com/signalfx/golib/datapoint"
+	"github.com/signalfx/golib/sfxclient"
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// pollInterval is how often Run polls Elasticsearch.
+const pollInterval = 30 * time.Second
+
+// sendBudgetDivisor reserves this fraction of a poll's deadline for sending
+// datapoints.
+const sendBudgetDivisor = 4
+
+// Monitor polls Elasticsearch for heartbeats and reports their lag.
+type Monitor struct {
+	config  Config
+	es      HeartbeatSearcher
+	checker RunningChecker
+	sink    MetricSink
+	log     kv.KayveeLogger
+	now     func() time.Time
+
+	// panics are the times of recent polls that panicked.
+	panics []time.Time
+
+	// consecutiveFailures counts the polls in a row that sent no datapoints.
+	consecutiveFailures int
+
+	// backoff pauses polling after MaxConsecutiveErrors polls in a row fail.
+	backoff *backoffPauser
+
+	// mu guards lastPoll and sinkAuthFailed.
+	mu       sync.Mutex
+	lastPoll PollStatus
+	// sinkAuthFailed is set while the sink rejects our API key, which retrying
+	// won't fix.
+	sinkAuthFailed bool
+
+	// errLog logs errors, collapsing ones that repeat poll after poll.
+	errLog *errorLogSuppressor
+
+	// leader, if set, elects the one replica that polls and sends datapoints.
+	leader LeaderChecker
+
+	// jitter spreads out the polls of monitors querying the same cluster.
+	jitter *pollJitter
+
+	// hosts tracks the hosts seen since the monitor started.
+	hosts *hostTracker
+
+	// maintenance, while on, reports every host as up to date.
+	maintenance *maintenance
+
+	// stats describes the poll in progress.
+	stats *pollStats
+
+	// trigger starts a poll outside the schedule.
+	trigger chan struct{}
+
+	// notifiers are told about hosts that change state, as tracked by
+	// states.
+	notifiers []Notifier
+	states    *hoststate.Store
+
+	// pagerDuty, if set, pages for hosts stale for long.
+	pagerDuty *pagerDuty
+
+	// expected, if set, lists the hosts that should be heartbeating.
+	expected *expectedHosts
+
+	// hostIPs parses the IP addresses of EC2-backed hosts out of their names.
+	hostIPs *hostIPParser
+
+	// hostCount, if set, watches for sudden drops in the number of hosts.
+	hostCount *hostCountWatch
+
+	// lagBaseline, if set, flags polls whose p95 lag is unusual.
+	lagBaseline *lagBaseline
+
+	// intervals, if set, are the expected heartbeat intervals of hosts
+	// matching patterns.
+	intervals *hostIntervals
+
+	// watchdog, if set, exits when a poll hangs.
+	watchdog *watchdog
+}
+
+var errLeadershipLost = errors.New("leadership lost before sending datapoints")
+
+// errTooManyFailures is returned by Run when MaxConsecutiveFailures polls in a
+// row fail, so the orchestrator can restart the monitor.
+var errTooManyFailures = errors.New("too many consecutive failed polls")
+
+// NewMonitor returns a Monitor using the real clock.
+func NewMonitor(config Config, es HeartbeatSearcher, checker RunningChecker, sink MetricSink, log kv.KayveeLogger) *Monitor {
+	return &Monitor{
+		config:  config,
+		es:      es,
+		checker: checker,
+		sink:    sink,
+		log:     log,
+		now:     time.Now,
+		errLog:  newErrorLogSuppressor(log, config.LogSuppressWindow, time.Now),
+		jitter:  newPollJitter(config.PollStartJitter, config.PollTickJitterPercent, config.PollJitterSeconds, pollInterval),
+
+		hostIPs:     &hostIPParser{},
+		hosts:       newHostTracker(),
+		maintenance: &maintenance{log: log, now: time.Now, windows: config.MaintenanceWindows},
+		stats:       newPollStats(time.Now),
+		backoff:     &backoffPauser{max: config.MaxConsecutiveErrors, pause: config.BackoffPauseDuration},
+		trigger:     make(chan struct{}, 1),
+		states:      hoststate.New(hostStateConfig(config)),
+	}
+}
+
+// clockSetter is implemented by the parts of a Monitor that keep time, and
+// by those wrapping them.
+type clockSetter interface {
+	setClock(now func() time.Time)
+}
+
+// setClock makes the Monitor and the parts of it that keep time use now
+// rather than the real clock, so tests can control time. Call it once the
+// Monitor is fully set up.
+func (m *Monitor) setClock(now func() time.Time) {
+	m.now = now
+	m.errLog.now = now
+	m.maintenance.now = now
+	m.stats.now = now
+
+	parts := []interface{}{m.es, m.checker, m.sink, m.leader}
+	for _, n := range m.notifiers {
+		parts = append(parts, n)
+	}
+	if m.expected != nil {
+		parts = append(parts, m.expected.source)
+	}
+	if m.pagerDuty != nil {
+		parts = append(parts, m.pagerDuty)
+	}
+	if m.watchdog != nil {
+		parts = append(parts, m.watchdog)
+	}
+	for _, part := range parts {
+		if c, ok := part.(clockSetter); ok {
+			c.setClock(now)
+		}
+	}
+}
+
+// errTooManyPanics is returned by Run when MaxPanics polls panic within
+// PanicWindow, since a persistent panic probably needs a restart.
+var errTooManyPanics = errors.New("too many polls panicked")
+
+// Run polls after the jitter's start offset and then every pollInterval,
+// jittered, until ctx is done, or until too many polls in a row fail.
+// Polls never overlap: a tick that comes while a poll is in progress is
+// skipped.
+func (m *Monitor) Run(ctx context.Context) error {
+	m.log.InfoD("poll-schedule", kv.M{
+		"jitter_seed":     m.jitter.seed,
+		"start_offset_ms": m.jitter.startOffset.Milliseconds(),
+		"tick_jitter_pct": m.jitter.tickPercent,
+	})
+	timer := time.NewTimer(m.jitter.startOffset)
+	defer timer.Stop()
+
+	// slot is taken while a poll is in progress, including while its result
+	// is checked.
+	slot := make(chan struct{}, 1)
+	done := make(chan error, 1)
+	poll := func() {
+		select {
+		case slot <- struct{}{}:
+		default:
+			m.skipTick(ctx)
+			return
+		}
+		go func() { done <- m.runTimed(ctx) }()
+	}
+
+	// sleeping fires when a tick's jitter sleep is over, and is nil
+	// otherwise. The slot isn't taken until then, so a sleeping tick never
+	// makes a poll asked for by hand be skipped.
+	var sleepTimer *time.Timer
+	var sleeping <-chan time.Time
+	defer func() {
+		if sleepTimer != nil {
+			sleepTimer.Stop()
+		}
+	}()
+
+	// countdown ticks while polling is paused after too many failures, and
+	// is nil otherwise.
+	var countdown *time.Ticker
+	var countdownC <-chan time.Time
+	defer func() {
+		if countdown != nil {
+			countdown.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if len(slot) > 0 {
+				<-done
+			}
+			return nil
+		case <-timer.C:
+			if m.backoff.paused() {
+				countdown.Stop()
+				countdown, countdownC = nil, nil
+				m.endBackoff(ctx)
+			}
+			timer.Reset(m.jitter.next(pollInterval))
+			if sleeping != nil {
+				// The last tick is still sleeping, so this one comes too
+				// soon after it.
+				m.skipTick(ctx)
+			} else if sleep := m.jitter.sleep(); sleep > 0 {
+				m.log.TraceD("poll-jitter", kv.M{"sleep_ms": sleep.Milliseconds()})
+				sleepTimer = time.NewTimer(sleep)
+				sleeping = sleepTimer.C
+			} else {
+				poll()
+			}
+		case <-sleeping:
+			sleepTimer, sleeping = nil, nil
+			poll()
+		case <-countdownC:
+			m.backoffCountdown(ctx)
+		case <-m.trigger:
+			// Polls asked for by hand start right away.
+			poll()
+		case err := <-done:
+			// Errors are logged by RunOnce; the next tick retries.
+			if m.tooManyPanics() {
+				m.log.CriticalD("too-many-panics", kv.M{
+					"panics": len(m.panics),
+					"window": m.config.PanicWindow.String(),
+				})
+				return errTooManyPanics
+			}
+			if m.tooManyFailures(err) {
+				m.log.CriticalD("too-many-failures", kv.M{
+					"error":    err.Error(),
+					"failures": m.consecutiveFailures,
+				})
+				return errTooManyFailures
+			}
+			if m.backoff.record(err) && !m.backoff.paused() {
+				until := m.startBackoff(ctx, err)
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(until.Sub(m.now()))
+				// A tick already sleeping mustn't poll during the backoff.
+				if sleepTimer != nil {
+					sleepTimer.Stop()
+					sleepTimer, sleeping = nil, nil
+				}
+				countdown = time.NewTicker(pollInterval)
+				countdownC = countdown.C
+			}
+			<-slot
+		}
+	}
+}
+
+// Flush polls once more after Run returns, so the hosts' latest state isn't
+// lost with the rest of the interval when the monitor is stopped.
+func (m *Monitor) Flush(ctx context.Context) error {
+	m.log.InfoD("shutdown-flush", kv.M{})
+	return m.runTimed(ctx)
+}
+
+// triggerPoll asks Run to poll now, and reports false if a poll was already
+// asked for.
+func (m *Monitor) triggerPoll() bool {
+	select {
+	case m.trigger <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// skipTick counts a tick skipped because the previous poll was still in
+// progress.
+func (m *Monitor) skipTick(ctx context.Context) {
+	m.log.WarnD("tick-skipped", kv.M{"interval_ms": pollInterval.Milliseconds()})
+	skipped := sfxclient.Counter(m.metricName("-tick-skipped"), m.selfDimensions(), 1)
+	if err := m.send(ctx, []*datapoint.Datapoint{skipped}); err != nil {
+		m.errLog.Error(ctx, "send-to-signalfx", err)
+	}
+}
+
+// tooManyFailures records the result of a poll and reports whether
+// MaxConsecutiveFailures polls in a row have failed. A poll fails when it
+// sends no datapoints; EC2 errors alone don't fail it.
+func (m *Monitor) tooManyFailures(err error) bool {
+	if err == nil || err == errLeadershipLost {
+		m.consecutiveFailures = 0
+		return false
+	}
+	m.consecutiveFailures++
+	max := m.config.MaxConsecutiveFailures
+	return max > 0 && m.consecutiveFailures >= max
+}
+
+// newPollID returns a random ID for a poll.
+func newPollID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// tooManyPanics reports whether MaxPanics polls have panicked within
+// PanicWindow.
+func (m *Monitor) tooManyPanics() bool {
+	cutoff := m.now().Add(-m.config.PanicWindow)
+	for len(m.panics) > 0 && m.panics[0].Before(cutoff) {
+		m.panics = m.panics[1:]
+	}
+	return m.config.MaxPanics > 0 && len(m.panics) >= m.config.MaxPanics
+}
+
+// runRecovered runs a poll, recovering from any panic so that the next tick
+// can try again.
+func (m *Monitor) runRecovered(ctx context.Context) (err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		err = fmt.Errorf("poll panicked: %v", r)
+		m.panics = append(m.panics, m.now())
+		m.logger(ctx).CriticalD("poll-panic", kv.M{
+			"panic": fmt.Sprint(r),
+			"stack": string(debug.Stack()),
+		})
+		panics := sfxclient.Counter("monitor.panics", m.selfDimensions(), 1)
+		if sendErr := m.send(ctx, []*datapoint.Datapoint{panics}); sendErr != nil {
+			m.errLog.Error(ctx, "send-to-signalfx", sendErr)
+		}
+	}()
+	return m.RunOnce(ctx)
+}
+
+// runTimed runs a poll, summarizes it, and reports when it overran
+// pollInterval.
+func (m *Monitor) runTimed(ctx context.Context) error {
+	// Tag every log line with the poll it came from, so one poll's lines can
+	// be found together.
+	ctx = withPollLogger(ctx, m.log)
+	if m.watchdog != nil {
+		m.watchdog.start()
+		defer m.watchdog.stop()
+	}
+
+	m.stats.reset()
+	// Errors between polls, e.g. from the last summary's send, aren't the
+	// poll's.
+	m.errLog.takeCounts()
+	start := m.now()
+	pollCtx, cancel := context.WithTimeout(ctx, m.config.PollTimeout)
+	err := m.runRecovered(pollCtx)
+	timedOut := pollCtx.Err() == context.DeadlineExceeded
+	cancel()
+	duration := m.now().Sub(start)
+	if timedOut {
+		m.logger(ctx).ErrorD("poll-timeout", kv.M{
+			"timeout_ms":  m.config.PollTimeout.Milliseconds(),
+			"duration_ms": duration.Milliseconds(),
+		})
+	}
+	m.recordPoll(start, duration, err)
+	// A follower's poll does nothing, so summarizing it would only skew the
+	// poll metrics.
+	if !m.stats.follower {
+		if sendErr := m.send(ctx, m.summarizePoll(ctx, duration, err, m.errLog.takeCounts())); sendErr != nil {
+			m.errLog.Error(ctx, "send-to-signalfx", sendErr)
+		}
+	}
+
+	if duration <= pollInterval {
+		return err
+	}
+	m.logger(ctx).WarnD("poll-overrun", kv.M{
+		"duration_ms": duration.Milliseconds(),
+		"interval_ms": pollInterval.Milliseconds(),
+	})
+	overrun := sfxclient.Counter(m.metricName("-poll-overrun"), m.selfDimensions(), 1)
+	if err := m.send(ctx, []*datapoint.Datapoint{overrun}); err != nil {
+		m.errLog.Error(ctx, "send-to-signalfx", err)
+	}
+	return err
+}
+
+// sendIsLeader reports whether this replica is the leader.
+func (m *Monitor) sendIsLeader(ctx context.Context, leader bool) {
+	var value int64
+	if leader {
+		value = 1
+	}
+	dimensions := m.selfDimensions()
+	dimensions["replica"] = m.config.LeaderID
+	isLeader := sfxclient.Gauge("monitor.is_leader", dimensions, value)
+	if err := m.send(ctx, []*datapoint.Datapoint{isLeader}); err != nil {
+		m.errLog.Error(ctx, "send-to-signalfx", err)
+	}
+}
+
+// trackHosts counts another poll for each known host missing from found,
+// and forgets hosts missing for MaxStaleCycles polls in a row so that hosts
+// that are gone for good stop being reported, returning them. If more than
+// MaxTrackedHosts are then tracked, the least recently seen are forgotten,
+// and left out of found if they are in it.
+func (m *Monitor) trackHosts(ctx context.Context, found map[string]Heartbeat) (forgotten []string) {
+	for host := range m.hosts.staleCycles() {
+		if _, ok := found[host]; ok {
+			continue
+		}
+		if max := m.config.MaxStaleCycles; m.hosts.missed(host) >= max && max > 0 {
+			m.hosts.forget(host)
+			forgotten = append(forgotten, host)
+			m.logger(ctx).InfoD("host-forgotten", kv.M{"hostname": host, "stale_cycles": max})
+		}
+	}
+
+	// Of the hosts found, those that heartbeat most recently are seen last,
+	// so they are the last to be evicted.
+	seen := make([]string, 0, len(found))
+	for host := range found {
+		seen = append(seen, host)
+	}
+	sort.Slice(seen, func(i, j int) bool {
+		return found[seen[i]].Latest.Before(found[seen[j]].Latest)
+	})
+	for _, host := range seen {
+		m.hosts.seen(host)
+	}
+
+	if m.config.MaxTrackedHosts <= 0 {
+		return forgotten
+	}
+	evicted := m.hosts.evict(m.config.MaxTrackedHosts)
+	if len(evicted) == 0 {
+		return forgotten
+	}
+	for _, host := range evicted {
+		delete(found, host)
+	}
+	m.logger(ctx).WarnD("cardinality-limit-reached", kv.M{
+		"max_tracked_hosts": m.config.MaxTrackedHosts,
+		"evicted":           len(evicted),
+	})
+	return forgotten
+}
+
+// maxLoggedCollisions is the most colliding hostnames logged per poll.
+const maxLoggedCollisions = 10
+
+// reportCollisions logs and counts the hosts found in more than one index.
+// Their latest timestamp across the indices is the one reported.
+func (m *Monitor) reportCollisions(ctx context.Context, heartbeats map[string]Heartbeat) {
+	collisions := []string{}
+	for hostname, heartbeat := range heartbeats {
+		if len(heartbeat.Indices) > 1 {
+			collisions = append(collisions, hostname)
+		}
+	}
+	if len(collisions) == 0 {
+		return
+	}
+	sort.Strings(collisions)
+	logged := collisions
+	if len(logged) > maxLoggedCollisions {
+		logged = logged[:maxLoggedCollisions]
+	}
+	m.logger(ctx).InfoD("host-collisions", kv.M{
+		"count":     len(collisions),
+		"hostnames": strings.Join(logged, ","),
+	})
+	counter := sfxclient.Counter(m.metricName("-host-collisions"), m.selfDimensions(), int64(len(collisions)))
+	if err := m.send(ctx, []*datapoint.Datapoint{counter}); err != nil {
+		m.errLog.Error(ctx, "send-to-signalfx", err)
+	}
+}
+
+// pollDeadline is how long a poll may take in all: PollDeadline, but no more
+// than pollInterval so polls don't fall behind.
+func (m *Monitor) pollDeadline() time.Duration {
+	if m.config.PollDeadline <= 0 || m.config.PollDeadline > pollInterval {
+		return pollInterval
+	}
+	return m.config.PollDeadline
+}
+
+// sendClientRebuilds counts the times the ES client was rebuilt, so frequent
+// rebuilds are visible.
+func (m *Monitor) sendClientRebuilds(ctx context.Context) {
+	r, ok := m.es.(clientRebuilder)
+	if !ok {
+		return
+	}
+	rebuilds := r.takeClientRebuilds()
+	if rebuilds == 0 {
+		return
+	}
+	counter := sfxclient.Counter("monitor.es_client_rebuilds", m.selfDimensions(), rebuilds)
+	if err := m.send(ctx, []*datapoint.Datapoint{counter}); err != nil {
+		m.errLog.Error(ctx, "send-to-signalfx", err)
+	}
+}
+
+// sendDistinctComponents reports the number of component/environment pairs
+// the search found, when they are counted.
+func (m *Monitor) sendDistinctComponents(ctx context.Context) {
+	c, ok := m.es.(componentCounter)
+	if !ok || !m.config.TrackDistinctComponents {
+		return
+	}
+	gauge := sfxclient.Gauge(m.metricName("-distinct-components"), m.selfDimensions(), int64(c.distinctComponents()))
+	if err := m.send(ctx, []*datapoint.Datapoint{gauge}); err != nil {
+		m.errLog.Error(ctx, "send-to-signalfx", err)
+	}
+}
+
+// selfDimensions are the dimensions of metrics describing the monitor itself
+// rather than a host. Unlike host metrics, they carry the monitor's version:
+// there are few enough of them that a deploy starting new series is fine.
+func (m *Monitor) selfDimensions() map[string]string {
+	return map[string]string{
+		"component":       m.config.ComponentName,
+		"environment":     m.config.Environment,
+		"monitor_version": currentBuild().Version,
+	}
+}
+
+// RunOnce runs a single poll: it fetches the latest heartbeat timestamps,
+// corrects them for instances that aren't running, and sends them to the sink.
+func (m *Monitor) RunOnce(ctx context.Context) error {
+	if m.leader != nil {
+		leader := m.leader.IsLeader()
+		m.sendIsLeader(ctx, leader)
+		if !leader {
+			m.stats.follower = true
+			return nil
+		}
+	}
+
+	// Bound the whole poll, not just each request, so slow phases can't add
+	// up to more than an interval. The queries leave part of the deadline
+	// for the send, so whatever was computed still gets sent.
+	deadline := m.pollDeadline()
+	pollCtx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+	queryCtx, cancelQuery := context.WithTimeout(pollCtx, deadline-deadline/sendBudgetDivisor)
+	defer cancelQuery()
+
+	// The EC2 cache doesn't depend on the ES results, so refresh it while ES
+	// is queried rather than after.
+	prefetched := make(chan struct{})
+	go func() {
+		defer close(prefetched)
+		if p, ok := m.checker.(prefetcher); ok {
+			// Errors resurface, and are logged, when hosts are checked.
+			p.prefetch(queryCtx)
+		}
+	}()
+
+	done := m.stats.measure(phaseES)
+	heartbeats, err := m.es.LatestHeartbeats(queryCtx)
+	done()
+	m.sendClientRebuilds(ctx)
+	if err == errNoResultsFound {
+		m.logger(ctx).WarnD("no-search-results", kv.M{"error": err.Error(), "error_type": errorType(err)})
+		return err
+	} else if ferr, ok := err.(FailedSearchError); ok {
+		m.errLog.Error(ctx, "failed-search", ferr)
+		return err
+	} else if err != nil {
+		m.errLog.Error(ctx, "timestamp", err)
+		return err
+	}
+	m.errLog.Clear(ctx, "failed-search")
+	m.errLog.Clear(ctx, "timestamp")
+	m.sendDistinctComponents(ctx)
+
+	done = m.stats.measure(phaseProcess)
+	// ES returns at most HostnameAggSize hosts, so a full page may be missing
+	// some.
+	truncated := len(heartbeats) >= m.config.HostnameAggSize
+	if truncated {
+		m.logger(ctx).WarnD("possible-truncation", kv.M{
+			"count":    len(heartbeats),
+			"agg_size": m.config.HostnameAggSize,
+		})
+	}
+
+	hostCountDropped := false
+	if m.hostCount != nil {
+		var event *pollEvent
+		hostCountDropped, event = m.hostCount.observe(m.logger(ctx), len(heartbeats))
+		if event != nil {
+			m.stats.events = append(m.stats.events, *event)
+		}
+	}
+
+	m.reportCollisions(ctx, heartbeats)
+	forgotten := m.trackHosts(ctx, heartbeats)
+
+	hosts := map[string]HostStatus{}
+	for hostname, heartbeat := range heartbeats {
+		hosts[hostname] = HostStatus{Timestamp: heartbeat.Latest}
+	}
+	defer func() {
+		now := m.now()
+		for hostname, host := range hosts {
+			if heartbeat, ok := heartbeats[hostname]; ok {
+				host.LagSeconds = m.lag(now, heartbeat.Latest).Seconds()
+			}
+			if host.Correction != "" {
+				m.stats.corrections[host.Correction]++
+			}
+			host.State = m.states.State(hostname).String()
+			host.CooldownUntil = m.states.Cooldowns(now, hostname)
+			hosts[hostname] = host
+		}
+		m.recordHosts(hosts)
+	}()
+	done()
+
+	// correct the data for instances that aren't running or are suppressed
+	done = m.stats.measure(phaseEC2)
+	<-prefetched
+	ec2Failed, ec2Throttled := false, false
+	// running records the EC2 check's verdict for each host it checked.
+	running := map[string]bool{}
+	unchecked := 0
+	for hostname, heartbeat := range heartbeats {
+		ip, ok := m.hostIPs.ip(hostname)
+		if !ok {
+			continue
+		}
+		if queryCtx.Err() != nil {
+			unchecked++
+			continue
+		}
+		isRunning, err := m.checker.IsRunning(queryCtx, ip)
+		if err != nil {
+			m.errLog.Error(ctx, "ec2-ip-check", err)
+			ec2Failed = true
+			ec2Throttled = ec2Throttled || errors.Is(err, errEC2Throttled)
+			continue
+		}
+		suppressed, err := m.checker.IsSuppressed(queryCtx, ip)
+		if err != nil {
+			m.errLog.Error(ctx, "ec2-ip-check", err)
+			ec2Failed = true
+			continue
+		}
+		running[hostname] = isRunning
+		host := hosts[hostname]
+		if !isRunning && m.config.TerminatedMode == "omit" {
+			// Deleting while ranging over a map is safe.
+			delete(heartbeats, hostname)
+			host.Correction = correctionOmitted
+		} else if !isRunning || suppressed {
+			// set to now so that signalfx's last datapoint is ok
+			heartbeat.Latest = m.now()
+			heartbeats[hostname] = heartbeat
+			host.Correction = correctionNotRunning
+			if isRunning {
+				host.Correction = correctionSuppressed
+			}
+		}
+		hosts[hostname] = host
+	}
+	done()
+	if unchecked > 0 {
+		// Send the hosts as they are rather than nothing.
+		m.stats.partial = true
+		m.logger(ctx).WarnD("poll-partial", kv.M{
+			"unchecked":   unchecked,
+			"deadline_ms": deadline.Milliseconds(),
+		})
+	}
+	if !ec2Failed {
+		m.errLog.Clear(ctx, "ec2-ip-check")
+	}
+	if ec2Throttled {
+		throttled := sfxclient.Counter(m.metricName("-aws-throttled"), m.selfDimensions(), 1)
+		if err := m.send(ctx, []*datapoint.Datapoint{throttled}); err != nil {
+			m.errLog.Error(ctx, "send-to-signalfx", err)
+		}
+	}
+
+	inMaintenance := m.maintenance.active()
+	// Outside the active hours, e.g. overnight for batch workloads, hosts
+	// aren't expected to heartbeat.
+	offHours := !m.config.ActiveHours.contains(m.now())
+	// Otherwise hosts in maintenance are tagged or withheld as they are sent.
+	reportNow := inMaintenance && m.config.MaintenanceDatapoints == maintenanceReportNow
+	if reportNow || offHours {
+		correction := correctionMaintenance
+		if !reportNow {
+			correction = correctionOffHours
+		}
+		for hostname, heartbeat := range heartbeats {
+			heartbeat.Latest = m.now()
+			heartbeats[hostname] = heartbeat
+			host := hosts[hostname]
+			host.Correction = correction
+			hosts[hostname] = host
+		}
+	}
+
+	m.stats.hosts = len(heartbeats)
+	m.logLaggingHosts(ctx, heartbeats, running)
+
+	// Another replica may have taken over while we queried; sending as well
+	// would duplicate its datapoints.
+	if m.leader != nil && !m.leader.IsLeader() {
+		m.logger(ctx).WarnD("leadership-lost", kv.M{"error": errLeadershipLost.Error()})
+		return errLeadershipLost
+	}
+
+	// Maintenance and off hours hide which hosts are stale, so leave their
+	// state as it was.
+	var transitions []hostTransition
+	if !inMaintenance && !offHours {
+		transitions = m.hostTransitions(ctx, heartbeats, running, forgotten)
+		if m.expected != nil {
+			transitions = append(transitions, m.checkExpectedHosts(pollCtx, heartbeats)...)
+		}
+	}
+	// Hosts going stale together with a drop are most likely the pipeline's
+	// fault, so one alert on the drop beats a page per host.
+	suppressHosts := hostCountDropped && m.config.HostCountDropSuppress
+	if suppressHosts {
+		transitions = withoutStale(transitions)
+	}
+
+	err = m.sendToSignalFX(pollCtx, heartbeats, pollFlags{
+		truncated:     truncated,
+		maintenance:   inMaintenance,
+		offHours:      offHours,
+		hostCountDrop: hostCountDropped,
+	})
+	// Notify once the datapoints are sent, so a slow webhook can't hold them
+	// up. Held transitions wait while alerts are off, like PagerDuty.
+	alerting := !inMaintenance && !offHours && !suppressHosts
+	m.notify(ctx, transitions, alerting)
+	m.notifyPoll(ctx, m.stats.events)
+	m.sendPublishFailures(ctx)
+	if m.pagerDuty != nil && alerting {
+		if err := m.pagerDuty.update(ctx, heartbeats, running); err != nil {
+			m.errLog.Error(ctx, "pagerduty", err)
+		} else {
+			m.errLog.Clear(ctx, "pagerduty")
+		}
+	}
+	// Save once notified, so the cooldowns saved are the ones started.
+	if !inMaintenance && !offHours {
+		m.saveHostStates(ctx)
+	}
+	m.setSinkAuthFailed(isAuthFailure(err))
+	if isAuthFailure(err) {
+		m.errLog.Error(ctx, "sfx-auth-failure", err)
+		return err
+	} else if err != nil {
+		m.errLog.Error(ctx, "send-to-signalfx", err)
+		return err
+	}
+	m.errLog.Clear(ctx, "sfx-auth-failure")
+	m.errLog.Clear(ctx, "send-to-signalfx")
+	return nil
+}
+
+// pollFlags are conditions of a poll reported alongside its hosts.
+type pollFlags struct {
+	// truncated is set when ES may have left hosts out.
+	truncated bool
+	// maintenance is set while alerting is paused.
+	maintenance bool
+	// offHours is set outside the active hours.
+	offHours bool
+	// hostCountDrop is set while the number of hosts found has dropped.
+	hostCountDrop bool
+}
+
+// sendToSignalFX sends the datapoints for heartbeats in batches of
+// SFXBatchSize as they are built.
+func (m *Monitor) sendToSignalFX(ctx context.Context, heartbeats map[string]Heartbeat, flags pollFlags) error {
+	start := m.now()
+	batch := newPointBatcher(ctx, m.config.SFXBatchSize, m.send, m.now)
+	now := m.now()
+	// In maintenance, unless hosts were reported as up to date, their lag is
+	// tagged or withheld.
+	tag := flags.maintenance && m.config.MaintenanceDatapoints == maintenanceTag
+	withhold := flags.maintenance && m.config.MaintenanceDatapoints == maintenanceWithhold
+	sampledOut := map[string]bool{}
+	lags := make([]float64, 0, len(heartbeats))
+	lagsByZone := map[string][]float64{}
+	for host, heartbeat := range heartbeats {
+		lag := m.lag(now, heartbeat.Latest)
+		lags = append(lags, lag.Seconds())
+		zone := m.availabilityZone(host)
+		lagsByZone[zone] = append(lagsByZone[zone], lag.Seconds())
+		overdue := lag > m.downThreshold(host, heartbeat)
+		if withhold || (!overdue && !m.sampled(host, now)) {
+			sampledOut[host] = true
+			continue
+		}
+
+		dimensions := map[string]string{
+			"hostname":    host,
+			"component":   m.config.ComponentName,
+			"environment": m.config.Environment,
+		}
+		if tag {
+			dimensions["maintenance"] = "true"
+		}
+		if instanceType, ok := m.instanceType(host); ok {
+			dimensions["instance_type"] = instanceType
+		}
+		dimensions["az"] = zone
+
+		datum := sfxclient.Gauge(m.metricName(""), dimensions, heartbeat.Latest.Unix())
+		if m.config.EventTimestamps {
+			// Lag and overdue are measured now, so keep the send time for them.
+			datum.Timestamp = heartbeat.Latest
+		}
+		datumLag := sfxclient.GaugeF(m.metricName("-lag"), dimensions, lag.Seconds())
+		datumOverdue := sfxclient.Gauge(m.metricName("-overdue"), dimensions, boolValue(overdue))
+		datumState := sfxclient.Gauge(m.metricName("-state"), dimensions, int64(m.states.State(host)))
+		batch.add(datum, datumLag, datumOverdue, datumState)
+		if m.config.TrackDocCount {
+			batch.add(sfxclient.Gauge(m.metricName("-heartbeat-count"), dimensions, heartbeat.Count))
+		}
+	}
+	for host, cycles := range m.hosts.staleCycles() {
+		// Hosts left out on purpose, e.g. by TERMINATED_MODE=omit, aren't
+		// missing. Hosts sampled out or withheld are left out here too.
+		if _, sent := heartbeats[host]; (!sent && cycles == 0) || sampledOut[host] {
+			continue
+		}
+		dimensions := map[string]string{
+			"hostname":    host,
+			"component":   m.config.ComponentName,
+			"environment": m.config.Environment,
+		}
+		if tag {
+			dimensions["maintenance"] = "true"
+		}
+		batch.add(sfxclient.Gauge(m.metricName("-stale-cycles"), dimensions, int64(cycles)))
+	}
+	if len(lags) > 0 && !withhold {
+		sort.Float64s(lags)
+		fleet := map[string]string{
+			"component":   m.config.ComponentName,
+			"environment": m.config.Environment,
+		}
+		if tag {
+			fleet["maintenance"] = "true"
+		}
+		batch.add(
+			sfxclient.GaugeF(m.metricName("-lag-p50"), fleet, percentile(lags, 50)),
+			sfxclient.GaugeF(m.metricName("-lag-p95"), fleet, percentile(lags, 95)),
+			sfxclient.GaugeF(m.metricName("-lag-p99"), fleet, percentile(lags, 99)),
+		)
+		if m.config.LagByAZ {
+			for zone, zoneLags := range lagsByZone {
+				sort.Float64s(zoneLags)
+				dimensions := map[string]string{"az": zone}
+				for name, value := range fleet {
+					dimensions[name] = value
+				}
+				batch.add(
+					sfxclient.GaugeF(m.metricName("-az-lag-max"), dimensions, zoneLags[len(zoneLags)-1]),
+					sfxclient.GaugeF(m.metricName("-az-lag-p50"), dimensions, percentile(zoneLags, 50)),
+				)
+			}
+		}
+		// Lag is hidden in maintenance and off hours, which would drag the
+		// baseline down.
+		if m.lagBaseline != nil && !flags.maintenance && !flags.offHours {
+			batch.add(m.checkLagAnomaly(ctx, now, percentile(lags, 95))...)
+		}
+	}
+	batch.add(
+		sfxclient.Gauge(m.metricName("-host-count"), m.selfDimensions(), int64(len(heartbeats))),
+		sfxclient.Gauge(m.metricName("-truncation-suspected"), m.selfDimensions(), boolValue(flags.truncated)),
+		sfxclient.Gauge(m.metricName("-maintenance"), m.selfDimensions(), boolValue(flags.maintenance)),
+		sfxclient.Gauge(m.metricName("-off-hours"), m.selfDimensions(), boolValue(flags.offHours)),
+	)
+	if m.hostCount != nil {
+		batch.add(sfxclient.Gauge("monitor.host_count_drop", m.selfDimensions(), boolValue(flags.hostCountDrop)))
+	}
+	err := batch.close()
+
+	// Building and sending interleave, so tell them apart afterwards.
+	m.stats.record(phaseBuild, m.now().Sub(start)-batch.sending)
+	m.stats.record(phaseSend, batch.sending)
+	return err
+}
+
+// lag is how far behind latest a host is as of now. Heartbeats only become
+// searchable once ingested, so the ingest lag compensation is taken off, down
+// to zero.
+func (m *Monitor) lag(now, latest time.Time) time.Duration {
+	lag := now.Sub(latest) - m.config.IngestLagCompensation
+	if lag < 0 {
+		return 0
+	}
+	return lag
+}
+
+// sampled reports whether host's datapoints are sent in the minute of now,
+// given SFXSampleRate. Hashing the host with the minute keeps the choice
+// stable within a minute, rather than flickering from poll to poll.
+func (m *Monitor) sampled(host string, now time.Time) bool {
+	if m.config.SFXSampleRate >= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	io.WriteString(h, host+"|"+now.UTC().Format("2006-01-02T15:04"))
+	return float64(h.Sum32())/(1<<32) < m.config.SFXSampleRate
+}
+
+// instanceType returns the EC2 instance type of host, for hosts backed by a
+// running instance.
+func (m *Monitor) instanceType(host string) (string, bool) {
+	t, ok := m.checker.(instanceTyper)
+	if !ok {
+		return "", false
+	}
+	ip, ok := m.hostIPs.ip(host)
+	if !ok {
+		return "", false
+	}
+	return t.instanceType(ip)
+}
+
+// availabilityZone returns the availability zone of host's EC2 instance, or
+// "unknown" for hosts not matched to a running instance.
+func (m *Monitor) availabilityZone(host string) string {
+	z, ok := m.checker.(zoner)
+	if !ok {
+		return "unknown"
+	}
+	ip, ok := m.hostIPs.ip(host)
+	if !ok {
+		return "unknown"
+	}
+	if zone, ok := z.availabilityZone(ip); ok {
+		return zone
+	}
+	return "unknown"
+}
+
+// percentile returns the p-th percentile of sorted, which must not be empty,
+// by the nearest-rank method.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// boolValue is the value of a gauge that is 1 when b is true, and 0 otherwise.
+func boolValue(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// logLaggingHosts logs the hosts lagging more than LogLagThreshold, worst
+// first, up to LogLagMaxHosts of them so a fleet-wide outage doesn't flood the
+// logs.
+func (m *Monitor) logLaggingHosts(ctx context.Context, heartbeats map[string]Heartbeat, running map[string]bool) {
+	if m.config.LogLagThreshold <= 0 {
+		return
+	}
+
+	now := m.now()
+	lagging := []string{}
+	for host, heartbeat := range heartbeats {
+		if m.lag(now, heartbeat.Latest) > m.config.LogLagThreshold {
+			lagging = append(lagging, host)
+		}
+	}
+	sort.Slice(lagging, func(i, j int) bool {
+		return heartbeats[lagging[i]].Latest.Before(heartbeats[lagging[j]].Latest)
+	})
+
+	for i, host := range lagging {
+		if i == m.config.LogLagMaxHosts {
+			m.logger(ctx).WarnD("lagging-hosts", kv.M{
+				"count":  len(lagging),
+				"logged": m.config.LogLagMaxHosts,
+			})
+			return
+		}
+		data := kv.M{
+			"hostname":    host,
+			"lag_seconds": m.lag(now, heartbeats[host].Latest).Seconds(),
+			"timestamp":   heartbeats[host].Latest.Format(time.RFC3339),
+			"running":     "unknown",
+		}
+		if isRunning, ok := running[host]; ok {
+			data["running"] = isRunning
+		}
+		m.logger(ctx).WarnD("lagging-host", data)
+	}
+}
+
+// downThreshold is how long a host can go without heartbeating before it is
+// overdue: two of its expected intervals, so a single late heartbeat is
+// tolerated. Intervals carried by heartbeats win over those matched by
+// HOST_INTERVALS_FILE, and hosts with neither have DownThreshold.
+func (m *Monitor) downThreshold(host string, heartbeat Heartbeat) time.Duration {
+	if heartbeat.ExpectedInterval > 0 {
+		return 2 * heartbeat.ExpectedInterval
+	}
+	if m.intervals != nil {
+		if interval, ok := m.intervals.interval(host); ok {
+			return 2 * interval
+		}
+	}
+	return m.config.DownThreshold
+}
+
+// metricName returns the name of the metric with the given suffix, e.g.
+// "-lag", including the configured prefix, suffix and metric version.
+func (m *Monitor) metricName(suffix string) string {
+	return m.config.MetricNamePrefix + m.config.MetricName + suffix + m.config.MetricNameSuffix + m.versionSuffix()
+}
+
+// versionSuffix is appended to metric names so that SignalFX detectors can
+// be migrated when the metric schema changes. Version 1 has no suffix.
+func (m *Monitor) versionSuffix() string {
+	if m.config.MetricVersion <= 1 {
+		return ""
+	}
+	return fmt.Sprintf("-v%d", m.config.MetricVersion)
+}
+
+// sendLegacyNames reports whether metrics should also be sent under their
+// unversioned names, during a migration window.
+func (m *Monitor) sendLegacyNames() bool {
+	if !m.config.MetricLegacyNames || m.versionSuffix() == "" {
+		return false
+	}
+	deprecation := m.config.MetricLegacyDeprecationDate
+	return deprecation.IsZero() || m.now().Before(deprecation)
+}
+
+// send sends points to the sink, duplicating those with versioned names
+// under their legacy names if needed. Others, e.g. the monitor.* metrics,
+// have the same name in every version, so duplicating them would count them
+// twice.
+func (m *Monitor) send(ctx context.Context, points []*datapoint.Datapoint) error {
+	if m.sendLegacyNames() {
+		all := make([]*datapoint.Datapoint, 0, 2*len(points))
+		for _, point := range points {
+			all = append(all, point)
+			if !strings.HasSuffix(point.Metric, m.versionSuffix()) {
+				continue
+			}
+			legacy := *point
+			legacy.Metric = strings.TrimSuffix(point.Metric, m.versionSuffix())
+			all = append(all, &legacy)
+		}
+		points = all
+	}
+	return classifySinkError(m.sink.AddDatapoints(ctx, points))
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/datapoint"
+	"github.com/signalfx/golib/sfxclient"
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// fakeSearcher is a HeartbeatSearcher returning fixed heartbeats, or err.
+type fakeSearcher struct {
+	heartbeats map[string]Heartbeat
+	err        error
+	// delay is how long each search takes, unless its context is done
+	// first.
+	delay time.Duration
+	// onSearch, if set, is called as each search starts.
+	onSearch func()
+}
+
+func (s *fakeSearcher) LatestHeartbeats(ctx context.Context) (map[string]Heartbeat, error) {
+	if s.onSearch != nil {
+		s.onSearch()
+	}
+	if s.delay > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, newFailedSearchError(ctx.Err())
+		case <-time.After(s.delay):
+		}
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	// RunOnce corrects the heartbeats in place, so don't share them between
+	// polls.
+	heartbeats := map[string]Heartbeat{}
+	for host, heartbeat := range s.heartbeats {
+		heartbeats[host] = heartbeat
+	}
+	return heartbeats, nil
+}
+
+func (s *fakeSearcher) LatestSample(ctx context.Context, host string) (*json.RawMessage, error) {
+	return nil, errNoResultsFound
+}
+
+// fakeChecker is a RunningChecker reporting the IPs in running as running,
+// or err.
+type fakeChecker struct {
+	running map[string]bool
+	err     error
+}
+
+func (c *fakeChecker) IsRunning(ctx context.Context, ip string) (bool, error) {
+	if c.err != nil {
+		return false, c.err
+	}
+	return c.running[ip], nil
+}
+
+func (c *fakeChecker) IsSuppressed(ctx context.Context, ip string) (bool, error) {
+	return false, c.err
+}
+
+// fakeSink is a MetricSink recording the datapoints sent to it, and failing
+// with err if set.
+type fakeSink struct {
+	mu     sync.Mutex
+	points []*datapoint.Datapoint
+	err    error
+}
+
+func (s *fakeSink) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.points = append(s.points, points...)
+	return nil
+}
+
+// point returns the last datapoint sent of metric for host, or nil.
+func (s *fakeSink) point(metric, host string) *datapoint.Datapoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found *datapoint.Datapoint
+	for _, p := range s.points {
+		if p.Metric == metric && p.Dimensions["hostname"] == host {
+			found = p
+		}
+	}
+	return found
+}
+
+// value returns the value of p as a float.
+func value(p *datapoint.Datapoint) float64 {
+	switch v := p.Value.(type) {
+	case datapoint.IntValue:
+		return float64(v.Int())
+	case datapoint.FloatValue:
+		return v.Float()
+	}
+	return 0
+}
+
+// newTestLogger returns a logger writing its lines to the returned buffer.
+func newTestLogger() (kv.KayveeLogger, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	log := kv.New("log-monitor-es")
+	log.SetOutput(buf)
+	return log, buf
+}
+
+// logLines returns the lines logged to buf with title.
+func logLines(t *testing.T, buf *bytes.Buffer, title string) []map[string]interface{} {
+	t.Helper()
+	lines := []map[string]interface{}{}
+	scanner := bufio.NewScanner(bytes.NewReader(buf.Bytes()))
+	for scanner.Scan() {
+		line := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("log line %q isn't JSON: %s", scanner.Text(), err)
+		}
+		if line["title"] == title {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// testNow is the fake clock's time in tests.
+var testNow = time.Date(2020, 1, 31, 12, 0, 0, 0, time.UTC)
+
+// fakeClock is a clock starting at testNow that only moves when advanced.
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: testNow}
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func testConfig() Config {
+	return Config{
+		ComponentName:         "log-monitor-es",
+		Environment:           "test",
+		MetricName:            "heartbeat",
+		MetricVersion:         1,
+		DownThreshold:         5 * time.Minute,
+		HostnameAggSize:       1000,
+		SFXBatchSize:          100,
+		SFXSampleRate:         1,
+		TerminatedMode:        "now",
+		HostStateStalePolls:   1,
+		HostStateRecoverPolls: 1,
+		PollTimeout:           20 * time.Second,
+		SuccessLog:            "info",
+	}
+}
+
+// newTestMonitor returns a Monitor on a fake clock stopped at testNow.
+func newTestMonitor(config Config, es HeartbeatSearcher, checker RunningChecker, sink MetricSink) (*Monitor, *bytes.Buffer) {
+	log, buf := newTestLogger()
+	m := NewMonitor(config, es, checker, sink, log)
+	m.setClock(func() time.Time { return testNow })
+	return m, buf
+}
+
+func TestRunOnce(t *testing.T) {
+	es := &fakeSearcher{heartbeats: map[string]Heartbeat{
+		"ip-10-0-0-1": {Latest: testNow.Add(-90 * time.Second)},
+		"ip-10-0-0-2": {Latest: testNow.Add(-10 * time.Minute)},
+		"ip-10-0-0-3": {Latest: testNow.Add(-time.Hour)},
+	}}
+	checker := &fakeChecker{running: map[string]bool{"10.0.0.1": true, "10.0.0.2": true}}
+	sink := &fakeSink{}
+	m, _ := newTestMonitor(testConfig(), es, checker, sink)
+
+	if err := m.RunOnce(context.Background()); err != nil {
+		t.Fatalf("RunOnce: %s", err)
+	}
+
+	tests := []struct {
+		host      string
+		timestamp time.Time
+		lag       float64
+		overdue   float64
+	}{
+		{host: "ip-10-0-0-1", timestamp: testNow.Add(-90 * time.Second), lag: 90, overdue: 0},
+		{host: "ip-10-0-0-2", timestamp: testNow.Add(-10 * time.Minute), lag: 600, overdue: 1},
+		// The instance isn't running, so it's reported as up to date.
+		{host: "ip-10-0-0-3", timestamp: testNow, lag: 0, overdue: 0},
+	}
+	for _, test := range tests {
+		timestamp := sink.point("heartbeat", test.host)
+		if timestamp == nil {
+			t.Errorf("%s: no heartbeat datapoint sent", test.host)
+			continue
+		}
+		if got := value(timestamp); got != float64(test.timestamp.Unix()) {
+			t.Errorf("%s: heartbeat = %v, want %v", test.host, got, test.timestamp.Unix())
+		}
+		if got := value(sink.point("heartbeat-lag", test.host)); got != test.lag {
+			t.Errorf("%s: heartbeat-lag = %v, want %v", test.host, got, test.lag)
+		}
+		if got := value(sink.point("heartbeat-overdue", test.host)); got != test.overdue {
+			t.Errorf("%s: heartbeat-overdue = %v, want %v", test.host, got, test.overdue)
+		}
+		if got := timestamp.Dimensions["component"]; got != "log-monitor-es" {
+			t.Errorf("%s: component = %q, want log-monitor-es", test.host, got)
+		}
+	}
+
+	hosts := m.Status().LastPoll.Hosts
+	if got := hosts["ip-10-0-0-3"].Correction; got != correctionNotRunning {
+		t.Errorf("ip-10-0-0-3 correction = %q, want %q", got, correctionNotRunning)
+	}
+	if got := hosts["ip-10-0-0-2"].State; got != "stale" {
+		t.Errorf("ip-10-0-0-2 state = %q, want stale", got)
+	}
+}
+
+func TestRunOnceESFailure(t *testing.T) {
+	searchErr := newFailedSearchError(errors.New("connection refused"))
+	es := &fakeSearcher{err: searchErr}
+	sink := &fakeSink{}
+	m, logs := newTestMonitor(testConfig(), es, &fakeChecker{}, sink)
+
+	err := m.RunOnce(context.Background())
+	var failed FailedSearchError
+	if !errors.As(err, &failed) {
+		t.Fatalf("RunOnce = %v, want a FailedSearchError", err)
+	}
+	if len(sink.points) != 0 {
+		t.Errorf("sent %d datapoints, want none", len(sink.points))
+	}
+	if len(logLines(t, logs, "failed-search")) != 1 {
+		t.Errorf("failed-search not logged once")
+	}
+}
+
+func TestRunOnceEC2Failure(t *testing.T) {
+	es := &fakeSearcher{heartbeats: map[string]Heartbeat{
+		"ip-10-0-0-1": {Latest: testNow.Add(-10 * time.Minute)},
+	}}
+	checker := &fakeChecker{err: errEC2Throttled}
+	sink := &fakeSink{}
+	m, logs := newTestMonitor(testConfig(), es, checker, sink)
+
+	// EC2 failing doesn't fail the poll: the hosts are sent uncorrected.
+	if err := m.RunOnce(context.Background()); err != nil {
+		t.Fatalf("RunOnce: %s", err)
+	}
+	if got := value(sink.point("heartbeat-lag", "ip-10-0-0-1")); got != 600 {
+		t.Errorf("heartbeat-lag = %v, want 600", got)
+	}
+	if len(logLines(t, logs, "ec2-ip-check")) != 1 {
+		t.Errorf("ec2-ip-check not logged once")
+	}
+	if sink.point("heartbeat-aws-throttled", "") == nil {
+		t.Errorf("heartbeat-aws-throttled not sent")
+	}
+}
+
+func TestRunOnceSinkFailure(t *testing.T) {
+	es := &fakeSearcher{heartbeats: map[string]Heartbeat{
+		"ip-10-0-0-1": {Latest: testNow.Add(-time.Minute)},
+	}}
+	checker := &fakeChecker{running: map[string]bool{"10.0.0.1": true}}
+
+	t.Run("unreachable", func(t *testing.T) {
+		sinkErr := errors.New("connection refused")
+		m, logs := newTestMonitor(testConfig(), es, checker, &fakeSink{err: sinkErr})
+		if err := m.RunOnce(context.Background()); err != sinkErr {
+			t.Fatalf("RunOnce = %v, want %v", err, sinkErr)
+		}
+		if len(logLines(t, logs, "send-to-signalfx")) == 0 {
+			t.Errorf("send-to-signalfx not logged")
+		}
+		if ok, _ := m.healthy(); !ok {
+			t.Errorf("unhealthy after the sink couldn't be reached")
+		}
+	})
+
+	t.Run("rejected key", func(t *testing.T) {
+		sinkErr := sfxclient.SFXAPIError{StatusCode: http.StatusUnauthorized}
+		m, logs := newTestMonitor(testConfig(), es, checker, &fakeSink{err: sinkErr})
+		err := m.RunOnce(context.Background())
+		if !isAuthFailure(err) || !errors.Is(err, errSinkRejected) {
+			t.Fatalf("RunOnce = %v, want an auth failure", err)
+		}
+		if len(logLines(t, logs, "sfx-auth-failure")) != 1 {
+			t.Errorf("sfx-auth-failure not logged once")
+		}
+		if ok, _ := m.healthy(); ok {
+			t.Errorf("healthy after the sink rejected the key")
+		}
+	})
+}
+
+func TestSendLegacyNames(t *testing.T) {
+	config := testConfig()
+	config.MetricVersion = 2
+	config.MetricLegacyNames = true
+	sink := &fakeSink{}
+	m, _ := newTestMonitor(config, &fakeSearcher{}, &fakeChecker{}, sink)
+
+	err := m.send(context.Background(), []*datapoint.Datapoint{
+		sfxclient.Gauge(m.metricName("-lag"), nil, 1),
+		sfxclient.Counter("monitor.panics", nil, 1),
+	})
+	if err != nil {
+		t.Fatalf("send: %s", err)
+	}
+	sent := map[string]int{}
+	for _, p := range sink.points {
+		sent[p.Metric]++
+	}
+	want := map[string]int{"heartbeat-lag-v2": 1, "heartbeat-lag": 1, "monitor.panics": 1}
+	if len(sent) != len(want) {
+		t.Errorf("sent %v, want %v", sent, want)
+	}
+	for metric, count := range want {
+		if sent[metric] != count {
+			t.Errorf("sent %s %d times, want %d", metric, sent[metric], count)
+		}
+	}
+}
+
+func TestRunTimedPollID(t *testing.T) {
+	es := &fakeSearcher{heartbeats: map[string]Heartbeat{
+		"ip-10-0-0-1": {Latest: testNow.Add(-time.Minute)},
+	}}
+	checker := &fakeChecker{running: map[string]bool{"10.0.0.1": true}}
+	m, logs := newTestMonitor(testConfig(), es, checker, &fakeSink{})
+
+	for i := 0; i < 2; i++ {
+		if err := m.runTimed(context.Background()); err != nil {
+			t.Fatalf("runTimed: %s", err)
+		}
+	}
+	m.log.Info("between-polls")
+
+	summaries := logLines(t, logs, "tick-summary")
+	if len(summaries) != 2 {
+		t.Fatalf("logged %d tick-summary lines, want 2", len(summaries))
+	}
+	first, second := summaries[0]["poll_id"], summaries[1]["poll_id"]
+	if first == nil || second == nil || first == second {
+		t.Errorf("poll_ids = %v, %v, want two distinct IDs", first, second)
+	}
+	if id, ok := logLines(t, logs, "between-polls")[0]["poll_id"]; ok {
+		t.Errorf("line logged between polls has poll_id %v", id)
+	}
+}
+
+// fakeLeader is a LeaderChecker with a fixed verdict.
+type fakeLeader bool
+
+func (l fakeLeader) IsLeader() bool { return bool(l) }
+
+// sentMetrics counts the datapoints sent of each metric.
+func (s *fakeSink) sentMetrics() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sent := map[string]int{}
+	for _, p := range s.points {
+		sent[p.Metric]++
+	}
+	return sent
+}
+
+func TestRunTimedPhases(t *testing.T) {
+	es := &fakeSearcher{heartbeats: map[string]Heartbeat{
+		"ip-10-0-0-1": {Latest: testNow.Add(-time.Minute)},
+	}}
+	checker := &fakeChecker{running: map[string]bool{"10.0.0.1": true}}
+	sink := &fakeSink{}
+	m, logs := newTestMonitor(testConfig(), es, checker, sink)
+
+	if err := m.runTimed(context.Background()); err != nil {
+		t.Fatalf("runTimed: %s", err)
+	}
+
+	phases := map[string]bool{}
+	for _, p := range sink.points {
+		if p.Metric == "monitor.poll_phase_ms" {
+			phases[p.Dimensions["phase"]] = true
+		}
+	}
+	summaries := logLines(t, logs, "tick-summary")
+	if len(summaries) != 1 {
+		t.Fatalf("logged %d tick-summary lines, want 1", len(summaries))
+	}
+	for _, phase := range []string{phaseES, phaseProcess, phaseEC2, phaseBuild, phaseSend} {
+		if !phases[phase] {
+			t.Errorf("no monitor.poll_phase_ms sent for phase %s", phase)
+		}
+		if _, ok := summaries[0][phase+"_ms"]; !ok {
+			t.Errorf("tick-summary has no %s_ms", phase)
+		}
+	}
+	if sink.sentMetrics()["monitor.poll_duration_ms"] != 1 {
+		t.Errorf("monitor.poll_duration_ms not sent once")
+	}
+}
+
+func TestRunTimedFollower(t *testing.T) {
+	es := &fakeSearcher{heartbeats: map[string]Heartbeat{
+		"ip-10-0-0-1": {Latest: testNow.Add(-time.Minute)},
+	}}
+	sink := &fakeSink{}
+	m, logs := newTestMonitor(testConfig(), es, &fakeChecker{}, sink)
+	m.leader = fakeLeader(false)
+
+	if err := m.runTimed(context.Background()); err != nil {
+		t.Fatalf("runTimed: %s", err)
+	}
+	sent := sink.sentMetrics()
+	if sent["monitor.is_leader"] != 1 || len(sent) != 1 {
+		t.Errorf("follower sent %v, want only monitor.is_leader", sent)
+	}
+	if lines := logLines(t, logs, "tick-summary"); len(lines) != 0 {
+		t.Errorf("follower logged %d tick-summary lines, want none", len(lines))
+	}
+}
+
+func TestSetClock(t *testing.T) {
+	config := testConfig()
+	config.WebhookMaxAttempts = 1
+	log, _ := newTestLogger()
+	checker := newTestEC2Checker(&fakeEC2{})
+	memory := NewMemorySink(10)
+	searcher := &esSearcher{config: config, log: log, now: time.Now}
+	m := NewMonitor(config, searcher, checker, multiSink{memory}, log)
+	hook := newWebhook(config, log)
+	digest := newDigestNotifier("webhook", hook, config, log)
+	m.notifiers = append(m.notifiers, &cooldownNotifier{channel: "webhook", next: digest, states: m.states, now: time.Now})
+	asg := &asgHosts{now: time.Now}
+	m.expected = newExpectedHosts(asg, time.Minute)
+	m.pagerDuty = newPagerDuty(config, log)
+	m.watchdog = &watchdog{log: log, now: time.Now}
+
+	clock := newFakeClock()
+	clock.advance(-time.Hour)
+	m.setClock(clock.now)
+
+	want := testNow.Add(-time.Hour)
+	clocks := map[string]func() time.Time{
+		"monitor":   m.now,
+		"searcher":  searcher.now,
+		"ec2":       checker.now,
+		"memory":    memory.now,
+		"webhook":   hook.now,
+		"asg":       asg.now,
+		"pagerDuty": m.pagerDuty.now,
+		"watchdog":  m.watchdog.now,
+	}
+	for name, now := range clocks {
+		if got := now(); !got.Equal(want) {
+			t.Errorf("%s clock = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestEC2CacheTTL(t *testing.T) {
+	api := &fakeEC2{ips: []string{"10.0.0.1"}}
+	checker := newTestEC2Checker(api)
+	clock := newFakeClock()
+	m, _ := newTestMonitor(testConfig(), &fakeSearcher{}, checker, &fakeSink{})
+	m.setClock(clock.now)
+	ctx := context.Background()
+
+	tests := []struct {
+		advance time.Duration
+		calls   int
+	}{
+		{advance: 0, calls: 1},
+		{advance: 59 * time.Second, calls: 1},
+		{advance: time.Second, calls: 2},
+		{advance: 30 * time.Second, calls: 2},
+	}
+	for _, test := range tests {
+		clock.advance(test.advance)
+		if _, err := checker.IsRunning(ctx, "10.0.0.1"); err != nil {
+			t.Fatalf("IsRunning: %s", err)
+		}
+		if got := api.describeCalls(); got != test.calls {
+			t.Errorf("after %s more: described instances %d times, want %d", test.advance, got, test.calls)
+		}
+	}
+}
+
+func TestLagFollowsClock(t *testing.T) {
+	es := &fakeSearcher{heartbeats: map[string]Heartbeat{
+		"ip-10-0-0-1": {Latest: testNow},
+	}}
+	checker := &fakeChecker{running: map[string]bool{"10.0.0.1": true}}
+	sink := &fakeSink{}
+	clock := newFakeClock()
+	m, _ := newTestMonitor(testConfig(), es, checker, sink)
+	m.setClock(clock.now)
+
+	tests := []struct {
+		advance time.Duration
+		lag     float64
+	}{
+		{advance: 0, lag: 0},
+		{advance: 30 * time.Second, lag: 30},
+		{advance: time.Minute, lag: 90},
+	}
+	for _, test := range tests {
+		clock.advance(test.advance)
+		if err := m.RunOnce(context.Background()); err != nil {
+			t.Fatalf("RunOnce: %s", err)
+		}
+		if got := value(sink.point("heartbeat-lag", "ip-10-0-0-1")); got != test.lag {
+			t.Errorf("at %s: heartbeat-lag = %v, want %v", clock.now(), got, test.lag)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/Clever/log-monitor-es/hoststate"
+	"github.com/signalfx/golib/datapoint"
+	"github.com/signalfx/golib/sfxclient"
+)
+
+// Events of hostTransitions.
+const (
+	// transitionStale is a host becoming overdue.
+	transitionStale = "stale"
+	// transitionRecovered is a stale, terminated or disappeared host
+	// heartbeating on time again.
+	transitionRecovered = "recovered"
+	// transitionDisappeared is a host no longer found in ES.
+	transitionDisappeared = "disappeared"
+	// transitionTerminated is a host whose EC2 instance stopped running.
+	transitionTerminated = "terminated"
+	// transitionSilent is a host forgotten after going missing for
+	// MaxStaleCycles polls.
+	transitionSilent = "silent"
+)
+
+// transitionEvents are the hostTransition events of entering each state.
+// Becoming healthy isn't notified, since every host does when first seen.
+var transitionEvents = map[hoststate.State]string{
+	hoststate.Stale:       transitionStale,
+	hoststate.Recovered:   transitionRecovered,
+	hoststate.Terminated:  transitionTerminated,
+	hoststate.Disappeared: transitionDisappeared,
+}
+
+// hostTransition is a change in a host's state found by a poll, worth
+// notifying.
+type hostTransition struct {
+	Host  string
+	Event string
+	// Lag is as of the poll, or of the last poll to find the host for hosts
+	// no longer found.
+	Lag    time.Duration
+	Latest time.Time
+	// Suppressed counts the host's transitions held back by a cooldown since
+	// it was last notified about.
+	Suppressed int
+}
+
+// Notifier tells people or tools about hosts that changed state.
+type Notifier interface {
+	// Notify reports the transitions found by one poll, together.
+	Notify(ctx context.Context, transitions []hostTransition) error
+}
+
+// hostTransitions moves the hosts between states by what a poll found, and
+// returns the transitions, sorted by host. running is the EC2 check's verdict
+// for each host checked, and forgotten are the hosts the poll forgot about.
+func (m *Monitor) hostTransitions(ctx context.Context, heartbeats map[string]Heartbeat, running map[string]bool, forgotten []string) []hostTransition {
+	now := m.now()
+	transitions := []hostTransition{}
+	add := func(t *hoststate.Transition) {
+		if t == nil {
+			return
+		}
+		if event, ok := transitionEvents[t.To]; ok {
+			transitions = append(transitions, hostTransition{Host: t.Host, Event: event, Lag: t.Lag, Latest: t.Latest})
+		}
+	}
+	// The heartbeats of hosts whose instances aren't running were corrected
+	// to now, or left out, so their state is by EC2's verdict alone.
+	for host, isRunning := range running {
+		if !isRunning {
+			add(m.states.Terminated(now, host))
+		}
+	}
+	for host, heartbeat := range heartbeats {
+		if isRunning, checked := running[host]; checked && !isRunning {
+			continue
+		}
+		lag := m.lag(now, heartbeat.Latest)
+		overdue := lag > m.downThreshold(host, heartbeat)
+		add(m.states.Found(now, host, overdue, lag, heartbeat.Latest, heartbeat.Count))
+	}
+	for _, host := range m.states.Hosts() {
+		if _, found := heartbeats[host]; found {
+			continue
+		}
+		if _, checked := running[host]; checked {
+			continue
+		}
+		add(m.states.Missing(now, host))
+	}
+	for _, host := range forgotten {
+		if r, ok := m.states.Forget(host); ok {
+			transitions = append(transitions, hostTransition{Host: host, Event: transitionSilent, Lag: r.Lag, Latest: r.Latest})
+		}
+	}
+	// Hosts evicted by MaxTrackedHosts are no longer reported at all.
+	for _, host := range m.states.Hosts() {
+		if !m.hosts.tracked(host) {
+			m.states.Forget(host)
+		}
+	}
+	m.states.Polled()
+	sort.Slice(transitions, func(i, j int) bool { return transitions[i].Host < transitions[j].Host })
+	return transitions
+}
+
+// withoutStale returns transitions without the hosts going stale or
+// disappearing.
+func withoutStale(transitions []hostTransition) []hostTransition {
+	kept := []hostTransition{}
+	for _, t := range transitions {
+		if t.Event != transitionStale && t.Event != transitionDisappeared {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// notify passes transitions to every Notifier, then, with release, lets
+// those holding transitions back pass on any held long enough. Failures are
+// logged, and don't fail the poll.
+func (m *Monitor) notify(ctx context.Context, transitions []hostTransition, release bool) {
+	failed := false
+	for _, n := range m.notifiers {
+		if len(transitions) > 0 {
+			if err := n.Notify(ctx, transitions); err != nil {
+				m.errLog.Error(ctx, "notify", err)
+				failed = true
+			}
+		}
+		if h, ok := n.(transitionHolder); ok && release {
+			if err := h.release(ctx); err != nil {
+				m.errLog.Error(ctx, "notify", err)
+				failed = true
+			}
+		}
+	}
+	if !failed {
+		m.errLog.Clear(ctx, "notify")
+	}
+}
+
+// saveHostStates saves the host states, with the cooldowns notifying
+// updated.
+func (m *Monitor) saveHostStates(ctx context.Context) {
+	if err := m.states.Save(); err != nil {
+		m.errLog.Error(ctx, "host-state-save", err)
+	} else {
+		m.errLog.Clear(ctx, "host-state-save")
+	}
+}
+
+// notifyPoll passes events to every Notifier that takes poll events.
+// Failures are logged, and don't fail the poll.
+func (m *Monitor) notifyPoll(ctx context.Context, events []pollEvent) {
+	if len(events) == 0 {
+		return
+	}
+	for _, n := range m.notifiers {
+		if p, ok := n.(pollEventNotifier); ok {
+			if err := p.NotifyPoll(ctx, events); err != nil {
+				m.errLog.Error(ctx, "notify", err)
+			}
+		}
+	}
+}
+
+// sendPublishFailures counts the notifications given up on since the last
+// poll.
+func (m *Monitor) sendPublishFailures(ctx context.Context) {
+	var failures int64
+	for _, n := range m.notifiers {
+		if c, ok := n.(publishFailureCounter); ok {
+			failures += c.takePublishFailures()
+		}
+	}
+	if failures == 0 {
+		return
+	}
+	counter := sfxclient.Counter("monitor.notify_failures", m.selfDimensions(), failures)
+	if err := m.send(ctx, []*datapoint.Datapoint{counter}); err != nil {
+		m.errLog.Error(ctx, "send-to-signalfx", err)
+	}
+}
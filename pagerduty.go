@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Clever/log-monitor-es/hoststate"
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// pagerDuty pages through the PagerDuty Events API v2 when a host has been
+// stale for staleAfter, and resolves the incident when it recovers or its
+// instance is found not to be running.
+//
+// Incidents are deduplicated by component and hostname, so triggering a host
+// again, e.g. after a restart, doesn't open another one. With a cooldown, a
+// host is triggered at most once per cooldown, so a flapping host doesn't
+// page over and over; the triggers held back are counted, and the host is
+// triggered once the cooldown ends if it is still stale. Resolves are never
+// held back.
+type pagerDuty struct {
+	routingKey  string
+	eventsURL   string
+	component   string
+	environment string
+	staleAfter  time.Duration
+	client      *http.Client
+	log         kv.KayveeLogger
+	now         func() time.Time
+
+	// open are the hosts with an incident triggered and not yet resolved.
+	// They are kept in states too, if set, so incidents opened before a
+	// restart are still resolved, and loaded from them by the first update.
+	open   map[string]bool
+	loaded bool
+
+	// cooldown, if positive, is how often a host can be triggered, kept in
+	// states.
+	cooldown time.Duration
+	states   *hoststate.Store
+}
+
+// pdCooldownChannel is PagerDuty's channel among the hosts' cooldowns.
+const pdCooldownChannel = "pagerduty"
+
+// pdTrigger is the event of PagerDuty cooldowns.
+const pdTrigger = "trigger"
+
+func (p *pagerDuty) setClock(now func() time.Time) {
+	p.now = now
+}
+
+func newPagerDuty(config Config, log kv.KayveeLogger) *pagerDuty {
+	return &pagerDuty{
+		routingKey:  config.PagerDutyRoutingKey,
+		eventsURL:   config.PagerDutyEventsURL,
+		component:   config.ComponentName,
+		environment: config.Environment,
+		staleAfter:  config.PagerDutyStaleAfter,
+		client:      &http.Client{Timeout: 5 * time.Second},
+		log:         log,
+		now:         time.Now,
+		open:        map[string]bool{},
+		cooldown:    config.NotifyCooldown,
+	}
+}
+
+// pdEvent is a PagerDuty Events API v2 event.
+type pdEvent struct {
+	RoutingKey  string     `json:"routing_key"`
+	EventAction string     `json:"event_action"`
+	DedupKey    string     `json:"dedup_key"`
+	Payload     *pdPayload `json:"payload,omitempty"`
+}
+
+type pdPayload struct {
+	Summary       string                 `json:"summary"`
+	Source        string                 `json:"source"`
+	Severity      string                 `json:"severity"`
+	Component     string                 `json:"component"`
+	Group         string                 `json:"group"`
+	CustomDetails map[string]interface{} `json:"custom_details"`
+}
+
+// update triggers or resolves incidents for the hosts found by a poll.
+// running holds the EC2 check's verdict for the hosts it checked. Events that
+// fail are sent again by the next update.
+func (p *pagerDuty) update(ctx context.Context, heartbeats map[string]Heartbeat, running map[string]bool) error {
+	if !p.loaded {
+		p.loadOpen()
+	}
+	now := p.now()
+	var errs []error
+	for host, heartbeat := range heartbeats {
+		lag := now.Sub(heartbeat.Latest)
+		isRunning, checked := running[host]
+		terminated := checked && !isRunning
+		switch {
+		case p.open[host] && (terminated || lag <= p.staleAfter):
+			if err := p.resolve(ctx, host); err != nil {
+				errs = append(errs, err)
+			}
+		case !p.open[host] && !terminated && lag > p.staleAfter:
+			cd := p.hostCooldown(host)
+			if cd != nil && now.Before(cd.Until) {
+				// Each poll finds the host stale, so count it held back
+				// once.
+				if cd.Held == "" {
+					cd.Held = pdTrigger
+					cd.Suppressed++
+				}
+				continue
+			}
+			if err := p.trigger(ctx, host, heartbeat, lag, cd); err != nil {
+				errs = append(errs, err)
+			}
+		case !p.open[host]:
+			// A host no longer stale has no trigger to hold back.
+			if cd := p.hostCooldown(host); cd != nil {
+				cd.Held = ""
+			}
+		}
+	}
+	// Hosts left out because their instances aren't running are done with.
+	// Others still open are no longer found in ES, so are still stale.
+	for host := range p.open {
+		if _, found := heartbeats[host]; found {
+			continue
+		}
+		if isRunning, checked := running[host]; checked && !isRunning {
+			if err := p.resolve(ctx, host); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%d PagerDuty events failed, the first with: %w", len(errs), errs[0])
+	}
+	return nil
+}
+
+// loadOpen adds the hosts whose incidents are open as of states.
+func (p *pagerDuty) loadOpen() {
+	p.loaded = true
+	if p.states == nil {
+		return
+	}
+	for _, host := range p.states.Hosts() {
+		if r, _ := p.states.Record(host); r.Incident {
+			p.open[host] = true
+		}
+	}
+}
+
+// setOpen records whether host has an incident open.
+func (p *pagerDuty) setOpen(host string, open bool) {
+	if open {
+		p.open[host] = true
+	} else {
+		delete(p.open, host)
+	}
+	if p.states == nil {
+		return
+	}
+	if r, ok := p.states.Record(host); ok {
+		r.Incident = open
+	}
+}
+
+// hostCooldown returns the PagerDuty cooldown of host, or nil without a
+// cooldown.
+func (p *pagerDuty) hostCooldown(host string) *hoststate.Cooldown {
+	if p.cooldown <= 0 || p.states == nil {
+		return nil
+	}
+	r, ok := p.states.Record(host)
+	if !ok {
+		return nil
+	}
+	return r.Cooldown(pdCooldownChannel)
+}
+
+// trigger opens an incident for host, starting its cooldown cd, if any.
+func (p *pagerDuty) trigger(ctx context.Context, host string, heartbeat Heartbeat, lag time.Duration, cd *hoststate.Cooldown) error {
+	event := pdEvent{
+		RoutingKey:  p.routingKey,
+		EventAction: "trigger",
+		DedupKey:    p.dedupKey(host),
+		Payload: &pdPayload{
+			Summary:   fmt.Sprintf("%s has not heartbeat for %s (%s, %s)", host, lag.Round(time.Second), p.component, p.environment),
+			Source:    host,
+			Severity:  "critical",
+			Component: p.component,
+			Group:     p.environment,
+			CustomDetails: map[string]interface{}{
+				"lag_seconds":    lag.Seconds(),
+				"last_heartbeat": heartbeat.Latest.Format(time.RFC3339),
+			},
+		},
+	}
+	if cd != nil && cd.Suppressed > 0 {
+		event.Payload.CustomDetails["flaps"] = cd.Suppressed
+	}
+	if err := p.send(ctx, event); err != nil {
+		return err
+	}
+	p.setOpen(host, true)
+	if cd != nil {
+		cd.Suppressed = 0
+		cd.Notified = pdTrigger
+		cd.Held = ""
+		cd.Until = p.now().Add(p.cooldown)
+	}
+	loggerFrom(ctx, p.log).InfoD("pagerduty-triggered", kv.M{"hostname": host, "lag_seconds": lag.Seconds()})
+	return nil
+}
+
+func (p *pagerDuty) resolve(ctx context.Context, host string) error {
+	event := pdEvent{
+		RoutingKey:  p.routingKey,
+		EventAction: "resolve",
+		DedupKey:    p.dedupKey(host),
+	}
+	if err := p.send(ctx, event); err != nil {
+		return err
+	}
+	p.setOpen(host, false)
+	loggerFrom(ctx, p.log).InfoD("pagerduty-resolved", kv.M{"hostname": host})
+	return nil
+}
+
+func (p *pagerDuty) dedupKey(host string) string {
+	return p.component + "/" + host
+}
+
+func (p *pagerDuty) send(ctx context.Context, event pdEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.eventsURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("sending PagerDuty %s event: %w", event.EventAction, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("sending PagerDuty %s event: status %d", event.EventAction, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Clever/log-monitor-es/hoststate"
+)
+
+func TestPagerDutyOpenAcrossRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pagerduty")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	receiver := &pdReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	config := testConfig()
+	config.PagerDutyEventsURL = server.URL
+	config.PagerDutyStaleAfter = 15 * time.Minute
+	config.HostStateFile = filepath.Join(dir, "states.json")
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		running map[string]bool
+		lag     time.Duration
+	}{
+		{name: "recovered", lag: time.Second},
+		{name: "terminated", running: map[string]bool{"ip-10-0-0-1": false}, lag: time.Hour},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Remove(config.HostStateFile)
+			// restart returns a PagerDuty on the states saved, as after a
+			// restart.
+			restart := func() *pagerDuty {
+				states, err := hoststate.Load(hostStateConfig(config))
+				if err != nil {
+					t.Fatalf("Load: %s", err)
+				}
+				log, _ := newTestLogger()
+				p := newPagerDuty(config, log)
+				p.states = states
+				p.setClock(func() time.Time { return testNow })
+				states.Found(testNow, "ip-10-0-0-1", false, time.Second, testNow, 1)
+				return p
+			}
+
+			p := restart()
+			stale := map[string]Heartbeat{"ip-10-0-0-1": {Latest: testNow.Add(-time.Hour)}}
+			if err := p.update(ctx, stale, nil); err != nil {
+				t.Fatalf("update: %s", err)
+			}
+			if err := p.states.Save(); err != nil {
+				t.Fatalf("Save: %s", err)
+			}
+			receiver.take()
+
+			p = restart()
+			heartbeats := map[string]Heartbeat{"ip-10-0-0-1": {Latest: testNow.Add(-test.lag)}}
+			if err := p.update(ctx, heartbeats, test.running); err != nil {
+				t.Fatalf("update: %s", err)
+			}
+			events := receiver.take()
+			if len(events) != 1 || events[0].EventAction != "resolve" {
+				t.Errorf("after a restart, sent %+v, want the incident resolved", events)
+			}
+			if r, _ := p.states.Record("ip-10-0-0-1"); r.Incident {
+				t.Errorf("resolved incident still open in the host states")
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// pollLogKey is the context key of a poll's logger.
+type pollLogKey struct{}
+
+// pollLogger is a KayveeLogger tagging every line with the poll it came from,
+// so one poll's lines can be found together. It wraps the shared logger
+// rather than adding to its context, so lines logged between or outside polls
+// aren't tagged with a stale poll_id.
+type pollLogger struct {
+	kv.KayveeLogger
+	pollID string
+}
+
+// withPollLogger returns a context carrying a logger for a new poll, built
+// on log.
+func withPollLogger(ctx context.Context, log kv.KayveeLogger) context.Context {
+	return context.WithValue(ctx, pollLogKey{}, &pollLogger{KayveeLogger: log, pollID: newPollID()})
+}
+
+// loggerFrom returns the poll logger carried by ctx, or fallback outside a
+// poll.
+func loggerFrom(ctx context.Context, fallback kv.KayveeLogger) kv.KayveeLogger {
+	if log, ok := ctx.Value(pollLogKey{}).(*pollLogger); ok {
+		return log
+	}
+	return fallback
+}
+
+// logger returns the logger for lines about the poll running under ctx, if
+// any.
+func (m *Monitor) logger(ctx context.Context) kv.KayveeLogger {
+	return loggerFrom(ctx, m.log)
+}
+
+// with returns a copy of data tagged with the poll's ID.
+func (l *pollLogger) with(data map[string]interface{}) map[string]interface{} {
+	tagged := make(map[string]interface{}, len(data)+1)
+	for k, v := range data {
+		tagged[k] = v
+	}
+	tagged["poll_id"] = l.pollID
+	return tagged
+}
+
+func (l *pollLogger) Counter(title string)  { l.CounterD(title, 1, nil) }
+func (l *pollLogger) Critical(title string) { l.CriticalD(title, nil) }
+func (l *pollLogger) Trace(title string)    { l.TraceD(title, nil) }
+func (l *pollLogger) Debug(title string)    { l.DebugD(title, nil) }
+func (l *pollLogger) Error(title string)    { l.ErrorD(title, nil) }
+func (l *pollLogger) Info(title string)     { l.InfoD(title, nil) }
+func (l *pollLogger) Warn(title string)     { l.WarnD(title, nil) }
+
+func (l *pollLogger) GaugeFloat(title string, value float64) { l.GaugeFloatD(title, value, nil) }
+func (l *pollLogger) GaugeInt(title string, value int)       { l.GaugeIntD(title, value, nil) }
+
+func (l *pollLogger) CounterD(title string, value int, data map[string]interface{}) {
+	l.KayveeLogger.CounterD(title, value, l.with(data))
+}
+
+func (l *pollLogger) CriticalD(title string, data map[string]interface{}) {
+	l.KayveeLogger.CriticalD(title, l.with(data))
+}
+
+func (l *pollLogger) TraceD(title string, data map[string]interface{}) {
+	l.KayveeLogger.TraceD(title, l.with(data))
+}
+
+func (l *pollLogger) DebugD(title string, data map[string]interface{}) {
+	l.KayveeLogger.DebugD(title, l.with(data))
+}
+
+func (l *pollLogger) ErrorD(title string, data map[string]interface{}) {
+	l.KayveeLogger.ErrorD(title, l.with(data))
+}
+
+func (l *pollLogger) GaugeFloatD(title string, value float64, data map[string]interface{}) {
+	l.KayveeLogger.GaugeFloatD(title, value, l.with(data))
+}
+
+func (l *pollLogger) GaugeIntD(title string, value int, data map[string]interface{}) {
+	l.KayveeLogger.GaugeIntD(title, value, l.with(data))
+}
+
+func (l *pollLogger) InfoD(title string, data map[string]interface{}) {
+	l.KayveeLogger.InfoD(title, l.with(data))
+}
+
+func (l *pollLogger) WarnD(title string, data map[string]interface{}) {
+	l.KayveeLogger.WarnD(title, l.with(data))
+}
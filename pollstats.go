@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/signalfx/golib/datapoint"
+	"github.com/signalfx/golib/sfxclient"
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// Phases of a poll, in the order they run.
+const (
+	phaseES      = "es"
+	phaseProcess = "process"
+	phaseEC2     = "ec2"
+	phaseBuild   = "build"
+	phaseSend    = "send"
+)
+
+// pollStats describes the poll in progress, to be summarized when it ends.
+type pollStats struct {
+	now func() time.Time
+
+	// phases are how long each phase that ran took.
+	phases map[string]time.Duration
+	// partial is set when the poll ran out of time to correct every host.
+	partial bool
+	// hosts is the number of hosts reported.
+	hosts int
+	// corrections are the number of hosts given each correction.
+	corrections map[string]int
+	// events are what the poll found about the fleet as a whole.
+	events []pollEvent
+	// follower is set when the poll did nothing because this replica isn't
+	// the leader.
+	follower bool
+}
+
+func newPollStats(now func() time.Time) *pollStats {
+	return &pollStats{now: now, phases: map[string]time.Duration{}, corrections: map[string]int{}}
+}
+
+func (s *pollStats) reset() {
+	s.phases = map[string]time.Duration{}
+	s.partial = false
+	s.hosts = 0
+	s.corrections = map[string]int{}
+	s.events = nil
+	s.follower = false
+}
+
+// measure starts timing phase, until the returned function is called.
+func (s *pollStats) measure(phase string) (done func()) {
+	start := s.now()
+	return func() { s.record(phase, s.now().Sub(start)) }
+}
+
+// record adds d to the time taken by phase.
+func (s *pollStats) record(phase string, d time.Duration) {
+	s.phases[phase] += d
+}
+
+// summarizePoll logs one line describing the poll that just ended, and returns
+// the datapoints describing it. errors are the number of errors at each stage
+// during the poll. Polls without errors are logged at SuccessLog.
+func (m *Monitor) summarizePoll(ctx context.Context, duration time.Duration, err error, errors map[string]int) []*datapoint.Datapoint {
+	s := m.stats
+	data := kv.M{
+		"duration_ms": duration.Milliseconds(),
+		"overran":     duration > pollInterval,
+		"partial":     s.partial,
+		"hosts":       s.hosts,
+		"corrections": s.corrections,
+		"errors":      errors,
+	}
+	if err != nil {
+		data["error"] = err.Error()
+	}
+
+	points := []*datapoint.Datapoint{
+		sfxclient.Gauge("monitor.poll_duration_ms", m.selfDimensions(), duration.Milliseconds()),
+		sfxclient.Gauge("monitor.poll_partial", m.selfDimensions(), boolValue(s.partial)),
+	}
+	if m.config.MaxConsecutiveErrors > 0 {
+		points = append(points, sfxclient.Gauge(m.metricName("-in-backoff"), m.selfDimensions(), 0))
+	}
+	for _, phase := range []string{phaseES, phaseProcess, phaseEC2, phaseBuild, phaseSend} {
+		phaseDuration, ok := s.phases[phase]
+		if !ok {
+			continue
+		}
+		data[phase+"_ms"] = phaseDuration.Milliseconds()
+		dimensions := m.selfDimensions()
+		dimensions["phase"] = phase
+		points = append(points, sfxclient.Gauge("monitor.poll_phase_ms", dimensions, phaseDuration.Milliseconds()))
+	}
+	m.logTickSummary(ctx, err == nil && len(errors) == 0, data)
+	return points
+}
+
+// logTickSummary logs tick-summary at info, or at SuccessLog if the poll
+// succeeded, since polls that had errors should always be seen.
+func (m *Monitor) logTickSummary(ctx context.Context, succeeded bool, data kv.M) {
+	if !succeeded {
+		m.logger(ctx).InfoD("tick-summary", data)
+		return
+	}
+	switch m.config.SuccessLog {
+	case "off":
+	case "trace":
+		m.logger(ctx).TraceD("tick-summary", data)
+	case "debug":
+		m.logger(ctx).DebugD("tick-summary", data)
+	default:
+		m.logger(ctx).InfoD("tick-summary", data)
+	}
+}
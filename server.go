@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// handleSample serves the last heartbeat document for the host given in the
+// "host" query parameter, to save hand-crafting Kibana queries during incidents.
+func (m *Monitor) handleSample(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Query().Get("host")
+	if host == "" {
+		http.Error(w, "missing host parameter", http.StatusBadRequest)
+		return
+	}
+
+	source, err := m.es.LatestSample(r.Context(), host)
+	if err == errNoResultsFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		m.log.ErrorD("sample", kv.M{"hostname": host, "error": err.Error()})
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(*source)
+}
+
+// handleStatus serves the monitor's Status as JSON.
+func (m *Monitor) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(m.Status()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleHealth serves 200 while the monitor is healthy, and 503 with the
+// reason otherwise, so orchestration can surface misconfiguration.
+func (m *Monitor) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if ok, reason := m.healthy(); !ok {
+		http.Error(w, reason, http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
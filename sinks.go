@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/signalfx/golib/datapoint"
+	"github.com/signalfx/golib/sfxclient"
+)
+
+// MetricSink is where datapoints are sent. It is satisfied by
+// sfxclient.HTTPSink.
+type MetricSink interface {
+	AddDatapoints(ctx context.Context, points []*datapoint.Datapoint) error
+}
+
+// multiSink sends datapoints to every one of its sinks, e.g. to dual-write
+// during a migration between metrics providers.
+type multiSink []MetricSink
+
+// AddDatapoints sends points to every sink, even if some of them fail.
+func (s multiSink) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint) error {
+	var errs sinkErrors
+	for _, sink := range s {
+		if err := sink.AddDatapoints(ctx, points); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (s multiSink) setClock(now func() time.Time) {
+	for _, sink := range s {
+		if c, ok := sink.(clockSetter); ok {
+			c.setClock(now)
+		}
+	}
+}
+
+// sinkErrors are the errors returned by the sinks of a multiSink.
+type sinkErrors []error
+
+func (e sinkErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return "error while sending to sinks: " + strings.Join(msgs, "; ")
+}
+
+// errSinkRejected is matched by errors of sinks that responded with an error.
+var errSinkRejected = errors.New("sink rejected datapoints")
+
+// sinkRejectedError is returned when a sink, or any sink in a multiSink,
+// responds with an error, as opposed to failing to be reached.
+type sinkRejectedError struct {
+	err error
+}
+
+func (e sinkRejectedError) Error() string {
+	return e.err.Error()
+}
+
+func (e sinkRejectedError) Is(target error) bool {
+	return target == errSinkRejected
+}
+
+func (e sinkRejectedError) Unwrap() error {
+	return e.err
+}
+
+// classifySinkError wraps err in a sinkRejectedError if a sink rejected the
+// datapoints.
+func classifySinkError(err error) error {
+	if anySinkError(err, func(sfxclient.SFXAPIError) bool { return true }) {
+		return sinkRejectedError{err}
+	}
+	return err
+}
+
+// isAuthFailure reports whether err, or the error of any sink in a multiSink,
+// is SignalFX rejecting the API key.
+func isAuthFailure(err error) bool {
+	return anySinkError(err, func(err sfxclient.SFXAPIError) bool {
+		return err.StatusCode == http.StatusUnauthorized || err.StatusCode == http.StatusForbidden
+	})
+}
+
+// anySinkError reports whether err, or the error of any sink in a multiSink,
+// is an error response from SignalFX matching match.
+func anySinkError(err error, match func(sfxclient.SFXAPIError) bool) bool {
+	switch err := err.(type) {
+	case sfxclient.SFXAPIError:
+		return match(err)
+	case sinkRejectedError:
+		return anySinkError(err.err, match)
+	case sinkErrors:
+		for _, sinkErr := range err {
+			if anySinkError(sinkErr, match) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sinkTLSConfig builds the TLS config for the sinks' HTTP client from a client
+// certificate and key, for proxies requiring mutual TLS, and a CA certificate
+// to verify the proxy with. Any of the paths may be empty.
+func sinkTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA certificate: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
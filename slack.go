@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// slackNotifier posts host transitions to a Slack incoming webhook.
+type slackNotifier struct {
+	webhookURL string
+	// channel, if set, overrides the webhook's default channel.
+	channel     string
+	component   string
+	environment string
+	// linkTemplate, if set, links each host, with "{hostname}" replaced by
+	// the host's name.
+	linkTemplate string
+	client       *http.Client
+}
+
+func newSlackNotifier(config Config) *slackNotifier {
+	return &slackNotifier{
+		webhookURL:   config.SlackWebhookURL,
+		channel:      config.SlackChannel,
+		component:    config.ComponentName,
+		environment:  config.Environment,
+		linkTemplate: config.SlackLinkTemplate,
+		client:       &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+type slackMessage struct {
+	Channel string `json:"channel,omitempty"`
+	Text    string `json:"text"`
+}
+
+// Notify posts one message listing every host that went stale or recovered,
+// retrying once.
+func (s *slackNotifier) Notify(ctx context.Context, transitions []hostTransition) error {
+	text := s.text(transitions)
+	if text == "" {
+		return nil
+	}
+	body, err := json.Marshal(slackMessage{Channel: s.channel, Text: text})
+	if err != nil {
+		return err
+	}
+	if err = s.post(ctx, body); err != nil {
+		err = s.post(ctx, body)
+	}
+	return err
+}
+
+func (s *slackNotifier) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		// The error includes the webhook's URL, which is a secret.
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		return fmt.Errorf("posting to Slack: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("posting to Slack: status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// text lists the hosts that went stale, then those that are missing
+// entirely, then those that recovered, then those terminated.
+func (s *slackNotifier) text(transitions []hostTransition) string {
+	var stale, missing, recovered, terminated []string
+	for _, t := range transitions {
+		line := fmt.Sprintf("• %s, last heartbeat %s ago%s", s.hostLink(t.Host), t.Lag.Round(time.Second), flapped(t))
+		switch t.Event {
+		case transitionStale:
+			stale = append(stale, line)
+		case transitionMissing:
+			missing = append(missing, fmt.Sprintf("• %s, missing for %s", s.hostLink(t.Host), t.Lag.Round(time.Second)))
+		case transitionRecovered:
+			recovered = append(recovered, line)
+		case transitionTerminated:
+			terminated = append(terminated, fmt.Sprintf("• %s%s", s.hostLink(t.Host), flapped(t)))
+		}
+	}
+
+	var b strings.Builder
+	if len(stale) > 0 {
+		fmt.Fprintf(&b, ":red_circle: %d %s went stale in %s (%s):\n%s\n",
+			len(stale), hostsNoun(len(stale)), s.component, s.environment, strings.Join(stale, "\n"))
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(&b, ":red_circle: %d expected %s missing from %s (%s):\n%s\n",
+			len(missing), hostsNoun(len(missing)), s.component, s.environment, strings.Join(missing, "\n"))
+	}
+	if len(recovered) > 0 {
+		fmt.Fprintf(&b, ":large_green_circle: %d %s recovered in %s (%s):\n%s\n",
+			len(recovered), hostsNoun(len(recovered)), s.component, s.environment, strings.Join(recovered, "\n"))
+	}
+	if len(terminated) > 0 {
+		fmt.Fprintf(&b, ":white_circle: %d %s terminated in %s (%s):\n%s\n",
+			len(terminated), hostsNoun(len(terminated)), s.component, s.environment, strings.Join(terminated, "\n"))
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// hostLink formats host as a Slack link, if there is a link template.
+func (s *slackNotifier) hostLink(host string) string {
+	if s.linkTemplate == "" {
+		return host
+	}
+	link := strings.Replace(s.linkTemplate, "{hostname}", url.QueryEscape(host), -1)
+	return fmt.Sprintf("<%s|%s>", link, host)
+}
+
+// flapped describes the transitions held back by a cooldown, if any.
+func flapped(t hostTransition) string {
+	switch t.Suppressed {
+	case 0:
+		return ""
+	case 1:
+		return " (also flapped once since the last alert)"
+	}
+	return fmt.Sprintf(" (also flapped %d times since the last alert)", t.Suppressed)
+}
+
+func hostsNoun(n int) string {
+	if n == 1 {
+		return "host"
+	}
+	return "hosts"
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// snsQueueSize is how many polls' transitions can wait to be published
+// before more are dropped.
+const snsQueueSize = 100
+
+// snsMaxAttempts is how many times a message is published before it is
+// given up on.
+const snsMaxAttempts = 4
+
+var errSNSQueueFull = errors.New("SNS publish queue is full, dropping events")
+
+// snsPublisher is a Notifier publishing each host transition to an SNS
+// topic, for incident tooling. It publishes in the background, so a slow or
+// failing topic never holds up a poll.
+type snsPublisher struct {
+	// failures counts the messages given up on since takePublishFailures was
+	// last called. It is accessed atomically, so it comes first to be 64-bit
+	// aligned.
+	failures int64
+
+	sns         snsiface.SNSAPI
+	topicARN    string
+	component   string
+	environment string
+	log         kv.KayveeLogger
+	queue       chan []hostTransition
+	now         func() time.Time
+}
+
+func (p *snsPublisher) setClock(now func() time.Time) {
+	p.now = now
+}
+
+// snsEvent is the JSON message published for each transition. Its fields
+// are a stable schema: add to it, but don't rename or remove them.
+type snsEvent struct {
+	Event         string    `json:"event"`
+	Hostname      string    `json:"hostname"`
+	Component     string    `json:"component"`
+	Environment   string    `json:"environment"`
+	LagSeconds    float64   `json:"lag_seconds"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	// Suppressed counts the host's transitions held back by NOTIFY_COOLDOWN
+	// since the last message about it.
+	Suppressed int       `json:"suppressed,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+func newSNSPublisher(api snsiface.SNSAPI, config Config, log kv.KayveeLogger) *snsPublisher {
+	return &snsPublisher{
+		sns:         api,
+		topicARN:    config.SNSTopicARN,
+		component:   config.ComponentName,
+		environment: config.Environment,
+		log:         log,
+		queue:       make(chan []hostTransition, snsQueueSize),
+		now:         time.Now,
+	}
+}
+
+// publishFailureCounter is implemented by Notifiers that count the messages
+// they fail to deliver.
+type publishFailureCounter interface {
+	// takePublishFailures returns the number of failures since it was last
+	// called.
+	takePublishFailures() int64
+}
+
+// Notify queues transitions to be published, without waiting.
+func (p *snsPublisher) Notify(ctx context.Context, transitions []hostTransition) error {
+	select {
+	case p.queue <- transitions:
+		return nil
+	default:
+		atomic.AddInt64(&p.failures, int64(len(transitions)))
+		return errSNSQueueFull
+	}
+}
+
+func (p *snsPublisher) takePublishFailures() int64 {
+	return atomic.SwapInt64(&p.failures, 0)
+}
+
+// Run publishes queued transitions until ctx is done.
+func (p *snsPublisher) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case transitions := <-p.queue:
+			now := p.now()
+			for _, t := range transitions {
+				p.publish(ctx, snsEvent{
+					Event:         t.Event,
+					Hostname:      t.Host,
+					Component:     p.component,
+					Environment:   p.environment,
+					LagSeconds:    t.Lag.Seconds(),
+					LastHeartbeat: t.Latest,
+					Suppressed:    t.Suppressed,
+					Time:          now,
+				})
+			}
+		}
+	}
+}
+
+// publish publishes event, backing off from 1s between attempts.
+func (p *snsPublisher) publish(ctx context.Context, event snsEvent) {
+	message, err := json.Marshal(event)
+	if err != nil {
+		p.log.ErrorD("sns-publish", kv.M{"error": err.Error()})
+		return
+	}
+
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		_, err = p.sns.PublishWithContext(reqCtx, &sns.PublishInput{
+			TopicArn: aws.String(p.topicARN),
+			Message:  aws.String(string(message)),
+			MessageAttributes: map[string]*sns.MessageAttributeValue{
+				"event": {DataType: aws.String("String"), StringValue: aws.String(event.Event)},
+			},
+		})
+		cancel()
+		if err == nil {
+			return
+		}
+		if attempt == snsMaxAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	atomic.AddInt64(&p.failures, 1)
+	p.log.ErrorD("sns-publish", kv.M{
+		"hostname": event.Hostname,
+		"event":    event.Event,
+		"attempts": snsMaxAttempts,
+		"error":    err.Error(),
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/signalfx/golib/datapoint"
+	"github.com/signalfx/golib/sfxclient"
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// getSSMParameter reads and decrypts the SSM parameter name.
+func getSSMParameter(ctx context.Context, api ssmiface.SSMAPI, name string) (string, error) {
+	out, err := api.GetParameterWithContext(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", fmt.Errorf("reading SSM parameter %s: %w", name, err)
+	}
+	value := aws.StringValue(out.Parameter.Value)
+	if value == "" {
+		return "", fmt.Errorf("SSM parameter %s is empty", name)
+	}
+	return value, nil
+}
+
+// tokenSink is a SignalFX sink whose API key can be replaced while it is in
+// use, by the SSM refresher or the control API.
+type tokenSink struct {
+	mu   sync.Mutex
+	sink *sfxclient.HTTPSink
+}
+
+// AddDatapoints sends points with the current API key. Sends are serialized,
+// since HTTPSink reads its key without locking.
+func (t *tokenSink) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sink.AddDatapoints(ctx, points)
+}
+
+// setToken replaces the API key, once any send in progress is done.
+func (t *tokenSink) setToken(token string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sink.AuthToken = token
+}
+
+// ssmTokenRefresher re-reads the SignalFX API key from SSM, so a rotated key
+// is picked up without a restart.
+type ssmTokenRefresher struct {
+	ssm      ssmiface.SSMAPI
+	name     string
+	interval time.Duration
+	sink     *tokenSink
+	log      kv.KayveeLogger
+}
+
+// Run refreshes the key every interval until ctx is done. A failed refresh
+// keeps the previous key.
+func (r *ssmTokenRefresher) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reqCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		token, err := getSSMParameter(reqCtx, r.ssm, r.name)
+		cancel()
+		if err != nil {
+			r.log.ErrorD("ssm-refresh", kv.M{"parameter": r.name, "error": err.Error()})
+			continue
+		}
+		r.sink.setToken(token)
+	}
+}
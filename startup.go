@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+const (
+	minStartupBackoff = time.Second
+	maxStartupBackoff = 30 * time.Second
+)
+
+// dependencyCheck verifies that a dependency of the monitor can be reached.
+type dependencyCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// waitForDependencies runs each check until it passes, backing off
+// exponentially between attempts, so the monitor doesn't start serving (and
+// look healthy) while it can't reach what it monitors. It gives up after
+// maxRetries failures of any one check.
+func waitForDependencies(ctx context.Context, log kv.KayveeLogger, maxRetries int, checks []dependencyCheck) error {
+	for _, c := range checks {
+		backoff := minStartupBackoff
+		for attempt := 1; ; attempt++ {
+			err := c.check(ctx)
+			if err == nil {
+				log.InfoD("startup-check", kv.M{"dependency": c.name, "attempts": attempt})
+				break
+			}
+			log.ErrorD("startup-check", kv.M{
+				"dependency": c.name,
+				"attempt":    attempt,
+				"error":      err.Error(),
+			})
+			if attempt >= maxRetries {
+				return fmt.Errorf("%s unreachable after %d attempts: %s", c.name, attempt, err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > maxStartupBackoff {
+				backoff = maxStartupBackoff
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import "time"
+
+// Corrections made to a host's reported heartbeat.
+const (
+	correctionNotRunning  = "not-running"
+	correctionSuppressed  = "suppressed"
+	correctionOmitted     = "omitted"
+	correctionMaintenance = "maintenance"
+	correctionOffHours    = "off-hours"
+)
+
+// Status is a snapshot of the monitor's state, for debugging.
+type Status struct {
+	LastPoll PollStatus   `json:"last_poll"`
+	EC2Cache *CacheStatus `json:"ec2_cache,omitempty"`
+	// SinkAuthFailed is set while the sink rejects the API key.
+	SinkAuthFailed bool             `json:"sink_auth_failed"`
+	Maintenance    maintenanceState `json:"maintenance"`
+	Schedule       PollSchedule     `json:"schedule"`
+	Build          BuildInfo        `json:"build"`
+	Config         Config           `json:"config"`
+}
+
+// PollSchedule describes when the monitor polls.
+type PollSchedule struct {
+	IntervalMS int64 `json:"interval_ms"`
+	// JitterSeed seeds the random jitter, so the schedule can be reproduced.
+	JitterSeed    int64 `json:"jitter_seed"`
+	StartOffsetMS int64 `json:"start_offset_ms"`
+	TickJitterPct int   `json:"tick_jitter_pct"`
+}
+
+// PollStatus describes the most recent poll.
+type PollStatus struct {
+	Time       time.Time             `json:"time"`
+	DurationMS int64                 `json:"duration_ms"`
+	Error      string                `json:"error,omitempty"`
+	Hosts      map[string]HostStatus `json:"hosts"`
+}
+
+// HostStatus describes a host as of the most recent poll.
+type HostStatus struct {
+	// Timestamp is the host's latest heartbeat, as found in ES.
+	Timestamp time.Time `json:"timestamp"`
+	// LagSeconds is the lag reported for the host, after any correction.
+	LagSeconds float64 `json:"lag_seconds"`
+	// Correction, if set, is why the reported heartbeat differs from the one
+	// found in ES.
+	Correction string `json:"correction,omitempty"`
+	// State is the host's state, see hoststate.State.
+	State string `json:"state"`
+	// CooldownUntil is when each channel cooling down can next notify about
+	// the host, see NOTIFY_COOLDOWN.
+	CooldownUntil map[string]time.Time `json:"cooldown_until,omitempty"`
+}
+
+// CacheStatus describes the EC2 cache.
+type CacheStatus struct {
+	AgeSeconds float64 `json:"age_seconds"`
+	Size       int     `json:"size"`
+}
+
+// cacheStatuser is implemented by RunningCheckers that cache their state.
+type cacheStatuser interface {
+	cacheStatus() (lastRefresh time.Time, size int)
+}
+
+// Status returns a snapshot of the monitor's state.
+func (m *Monitor) Status() Status {
+	m.mu.Lock()
+	status := Status{
+		LastPoll:       m.lastPoll,
+		SinkAuthFailed: m.sinkAuthFailed,
+		Schedule: PollSchedule{
+			IntervalMS:    pollInterval.Milliseconds(),
+			JitterSeed:    m.jitter.seed,
+			StartOffsetMS: m.jitter.startOffset.Milliseconds(),
+			TickJitterPct: m.jitter.tickPercent,
+		},
+		Build:  currentBuild(),
+		Config: m.config.Redacted(),
+	}
+	m.mu.Unlock()
+
+	if c, ok := m.checker.(cacheStatuser); ok {
+		lastRefresh, size := c.cacheStatus()
+		if !lastRefresh.IsZero() {
+			status.EC2Cache = &CacheStatus{
+				AgeSeconds: m.now().Sub(lastRefresh).Seconds(),
+				Size:       size,
+			}
+		}
+	}
+	status.Maintenance = m.maintenance.state()
+	return status
+}
+
+// recordHosts records the hosts found by the current poll.
+func (m *Monitor) recordHosts(hosts map[string]HostStatus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastPoll.Hosts = hosts
+}
+
+// recordPoll records the outcome of the poll that just finished.
+func (m *Monitor) recordPoll(start time.Time, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastPoll.Time = start
+	m.lastPoll.DurationMS = duration.Milliseconds()
+	m.lastPoll.Error = ""
+	if err != nil {
+		m.lastPoll.Error = err.Error()
+	}
+}
+
+// setSinkAuthFailed records whether the last send was rejected for its API key.
+func (m *Monitor) setSinkAuthFailed(failed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sinkAuthFailed = failed
+}
+
+// healthy reports whether the monitor can deliver datapoints, as far as it
+// knows.
+func (m *Monitor) healthy() (ok bool, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sinkAuthFailed {
+		return false, "sink rejected the API key"
+	}
+	return true, ""
+}
@@ -0,0 +1,42 @@
+package main
+
+import "os"
+
+// Build metadata, set at build time with e.g.
+// -ldflags "-X main.version=v1.2.3 -X main.commit=abc123 -X main.buildDate=2020-01-31T00:00:00Z".
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+// BuildInfo identifies the build of the monitor that is running.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+}
+
+// currentBuild returns the build metadata, with "unknown" for any that
+// wasn't set at build time. The VERSION env variable stands in for a version
+// not set at build time, e.g. when the image is built by other tooling.
+func currentBuild() BuildInfo {
+	orUnknown := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+	return BuildInfo{
+		Version:   orUnknown(buildVersion()),
+		Commit:    orUnknown(commit),
+		BuildDate: orUnknown(buildDate),
+	}
+}
+
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	return os.Getenv("VERSION")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// setBuild sets the build metadata and VERSION for a test, returning a func
+// restoring them.
+func setBuild(t *testing.T, v, c, d, env string) func() {
+	t.Helper()
+	oldVersion, oldCommit, oldBuildDate := version, commit, buildDate
+	oldEnv, hadEnv := os.LookupEnv("VERSION")
+	version, commit, buildDate = v, c, d
+	if err := os.Setenv("VERSION", env); err != nil {
+		t.Fatalf("Setenv: %s", err)
+	}
+	return func() {
+		version, commit, buildDate = oldVersion, oldCommit, oldBuildDate
+		if hadEnv {
+			os.Setenv("VERSION", oldEnv)
+		} else {
+			os.Unsetenv("VERSION")
+		}
+	}
+}
+
+func TestCurrentBuild(t *testing.T) {
+	tests := []struct {
+		name                          string
+		version, commit, date, envVar string
+		want                          BuildInfo
+	}{
+		{
+			name: "unset",
+			want: BuildInfo{Version: "unknown", Commit: "unknown", BuildDate: "unknown"},
+		},
+		{
+			name:    "ldflags",
+			version: "v1.2.3", commit: "abc123", date: "2020-01-31T00:00:00Z",
+			want: BuildInfo{Version: "v1.2.3", Commit: "abc123", BuildDate: "2020-01-31T00:00:00Z"},
+		},
+		{
+			name:   "VERSION",
+			envVar: "v1.2.4",
+			want:   BuildInfo{Version: "v1.2.4", Commit: "unknown", BuildDate: "unknown"},
+		},
+		{
+			name:    "ldflags over VERSION",
+			version: "v1.2.3", envVar: "v1.2.4",
+			want: BuildInfo{Version: "v1.2.3", Commit: "unknown", BuildDate: "unknown"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer setBuild(t, test.version, test.commit, test.date, test.envVar)()
+			if got := currentBuild(); got != test.want {
+				t.Errorf("currentBuild() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+// TestUnsetBuildPlumbed checks that unset build metadata reaches the status
+// and the monitor's own metrics as "unknown" rather than empty.
+func TestUnsetBuildPlumbed(t *testing.T) {
+	defer setBuild(t, "", "", "", "")()
+	m, _ := newTestMonitor(testConfig(), &fakeSearcher{}, &fakeChecker{}, &fakeSink{})
+
+	want := BuildInfo{Version: "unknown", Commit: "unknown", BuildDate: "unknown"}
+	if got := m.Status().Build; got != want {
+		t.Errorf("Status().Build = %+v, want %+v", got, want)
+	}
+	if got := m.selfDimensions()["monitor_version"]; got != "unknown" {
+		t.Errorf("monitor_version = %q, want unknown", got)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// exitCodeWatchdog is the exit code when a poll hangs.
+const exitCodeWatchdog = 5
+
+// watchdog exits the process when a poll runs for longer than timeout, as a
+// last resort against hangs that the polls' contexts don't end, e.g. a
+// deadlock, so the orchestrator restarts the monitor.
+type watchdog struct {
+	// started is when the poll in progress started, in Unix nanoseconds, or
+	// zero between polls. It is accessed atomically, so it comes first to be
+	// 64-bit aligned.
+	started int64
+
+	timeout time.Duration
+	log     kv.KayveeLogger
+	now     func() time.Time
+}
+
+func (w *watchdog) setClock(now func() time.Time) {
+	w.now = now
+}
+
+// start records that a poll started.
+func (w *watchdog) start() {
+	atomic.StoreInt64(&w.started, w.now().UnixNano())
+}
+
+// stop records that the poll ended.
+func (w *watchdog) stop() {
+	atomic.StoreInt64(&w.started, 0)
+}
+
+// Run checks on the poll in progress until ctx is done, exiting if it has
+// run for too long.
+func (w *watchdog) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.timeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			started := atomic.LoadInt64(&w.started)
+			if started == 0 {
+				continue
+			}
+			if elapsed := w.now().Sub(time.Unix(0, started)); elapsed > w.timeout {
+				w.log.CriticalD("watchdog-timeout", kv.M{
+					"elapsed_ms": elapsed.Milliseconds(),
+					"timeout_ms": w.timeout.Milliseconds(),
+					"goroutines": goroutineDump(),
+				})
+				os.Exit(exitCodeWatchdog)
+			}
+		}
+	}
+}
+
+// goroutineDump returns the stacks of every goroutine, up to 16MB of them.
+func goroutineDump() string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= 16<<20 {
+			return string(buf[:n])
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	kv "gopkg.in/Clever/kayvee-go.v6/logger"
+)
+
+// webhookQueueSize is how many events can wait to be delivered before more
+// are dropped.
+const webhookQueueSize = 1000
+
+var errWebhookQueueFull = errors.New("webhook queue is full, dropping events")
+
+// webhookEvent is the JSON body posted for each event. Its fields are a
+// stable schema: add to it, but don't rename or remove them. Host events set
+// the host fields, and poll events set Details.
+type webhookEvent struct {
+	Event         string                 `json:"event"`
+	Component     string                 `json:"component"`
+	Environment   string                 `json:"environment"`
+	Hostname      string                 `json:"hostname,omitempty"`
+	LagSeconds    *float64               `json:"lag_seconds,omitempty"`
+	LastHeartbeat *time.Time             `json:"last_heartbeat,omitempty"`
+	Details       map[string]interface{} `json:"details,omitempty"`
+	Suppressed    int                    `json:"suppressed,omitempty"`
+	Time          time.Time              `json:"time"`
+}
+
+// pollEvent is something a poll found about the fleet as a whole, e.g. a
+// drop in the number of hosts.
+type pollEvent struct {
+	Event   string
+	Details map[string]interface{}
+}
+
+// pollEventNotifier is implemented by Notifiers that are also told about
+// poll events.
+type pollEventNotifier interface {
+	NotifyPoll(ctx context.Context, events []pollEvent) error
+}
+
+// webhook is a Notifier posting each event to a URL, for integrations we
+// don't build in. Bodies are signed with secret, if set, in the
+// X-Signature-256 header. It posts in the background, so a slow or failing
+// receiver never holds up a poll.
+type webhook struct {
+	// failures counts the events given up on since takePublishFailures was
+	// last called. It is accessed atomically, so it comes first to be 64-bit
+	// aligned.
+	failures int64
+
+	url         string
+	headers     map[string]string
+	secret      string
+	maxAttempts int
+	component   string
+	environment string
+	client      *http.Client
+	log         kv.KayveeLogger
+	queue       chan webhookEvent
+	now         func() time.Time
+	// backoff is the wait before the first retry, doubling after each.
+	backoff time.Duration
+}
+
+func (w *webhook) setClock(now func() time.Time) {
+	w.now = now
+}
+
+func newWebhook(config Config, log kv.KayveeLogger) *webhook {
+	return &webhook{
+		url:         config.WebhookURL,
+		headers:     config.WebhookHeaders,
+		secret:      config.WebhookSecret,
+		maxAttempts: config.WebhookMaxAttempts,
+		component:   config.ComponentName,
+		environment: config.Environment,
+		client:      &http.Client{Timeout: config.WebhookTimeout},
+		log:         log,
+		queue:       make(chan webhookEvent, webhookQueueSize),
+		now:         time.Now,
+		backoff:     time.Second,
+	}
+}
+
+// Notify queues an event for each transition, without waiting.
+func (w *webhook) Notify(ctx context.Context, transitions []hostTransition) error {
+	now := w.now()
+	for _, t := range transitions {
+		lag := t.Lag.Seconds()
+		event := webhookEvent{
+			Event:       t.Event,
+			Component:   w.component,
+			Environment: w.environment,
+			Hostname:    t.Host,
+			LagSeconds:  &lag,
+			Suppressed:  t.Suppressed,
+			Time:        now,
+		}
+		if !t.Latest.IsZero() {
+			latest := t.Latest
+			event.LastHeartbeat = &latest
+		}
+		if err := w.enqueue(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NotifyPoll queues an event for each poll event, without waiting.
+func (w *webhook) NotifyPoll(ctx context.Context, events []pollEvent) error {
+	now := w.now()
+	for _, e := range events {
+		err := w.enqueue(webhookEvent{
+			Event:       e.Event,
+			Component:   w.component,
+			Environment: w.environment,
+			Details:     e.Details,
+			Time:        now,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *webhook) enqueue(event webhookEvent) error {
+	select {
+	case w.queue <- event:
+		return nil
+	default:
+		atomic.AddInt64(&w.failures, 1)
+		return errWebhookQueueFull
+	}
+}
+
+func (w *webhook) takePublishFailures() int64 {
+	return atomic.SwapInt64(&w.failures, 0)
+}
+
+// Run delivers queued events until ctx is done.
+func (w *webhook) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-w.queue:
+			w.deliver(ctx, event)
+		}
+	}
+}
+
+// deliver posts event up to maxAttempts times, backing off between
+// attempts. An event given up on is logged in full, as a dead letter, so it
+// can be replayed by hand.
+func (w *webhook) deliver(ctx context.Context, event webhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		w.log.ErrorD("webhook", kv.M{"error": err.Error()})
+		return
+	}
+
+	backoff := w.backoff
+	attempt := 1
+	for ; ; attempt++ {
+		err = w.post(ctx, body)
+		if err == nil {
+			return
+		}
+		var rejected webhookRejectedError
+		if attempt == w.maxAttempts || (errors.As(err, &rejected) && !rejected.retryable()) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	atomic.AddInt64(&w.failures, 1)
+	w.log.ErrorD("webhook-dead-letter", kv.M{
+		"event":    event.Event,
+		"hostname": event.Hostname,
+		"attempts": attempt,
+		"error":    err.Error(),
+		"payload":  string(body),
+	})
+}
+
+// webhookRejectedError is a receiver responding with an error status.
+type webhookRejectedError struct {
+	status int
+}
+
+func (e webhookRejectedError) Error() string {
+	return fmt.Sprintf("webhook responded %d", e.status)
+}
+
+// retryable reports whether trying again might succeed: client errors other
+// than rate limiting won't.
+func (e webhookRejectedError) retryable() bool {
+	return e.status == http.StatusTooManyRequests || e.status >= 500
+}
+
+func (w *webhook) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range w.headers {
+		req.Header.Set(name, value)
+	}
+	if w.secret != "" {
+		req.Header.Set("X-Signature-256", "sha256="+signWebhook(w.secret, body))
+	}
+
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		// The URL may hold a token, so leave it out of logs.
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return webhookRejectedError{status: resp.StatusCode}
+	}
+	return nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of body keyed by secret.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the requests it receives, responding with statuses
+// in turn, then 200.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	bodies   [][]byte
+	headers  []http.Header
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bodies = append(r.bodies, body)
+	r.headers = append(r.headers, req.Header)
+	status := http.StatusOK
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (r *webhookReceiver) requests() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.bodies)
+}
+
+// newTestWebhook returns a webhook posting to url that retries without
+// waiting, and the buffer it logs to.
+func newTestWebhook(url string, configure func(*Config)) (*webhook, *bytes.Buffer) {
+	config := testConfig()
+	config.WebhookURL = url
+	config.WebhookMaxAttempts = 3
+	config.WebhookTimeout = 5 * time.Second
+	if configure != nil {
+		configure(&config)
+	}
+	log, buf := newTestLogger()
+	w := newWebhook(config, log)
+	w.backoff = time.Millisecond
+	w.setClock(func() time.Time { return testNow })
+	return w, buf
+}
+
+var testWebhookEvent = webhookEvent{
+	Event:     transitionStale,
+	Component: "log-monitor-es",
+	Hostname:  "ip-10-0-0-1",
+	Time:      testNow,
+}
+
+func TestWebhookSignature(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	w, _ := newTestWebhook(server.URL, func(config *Config) {
+		config.WebhookSecret = "webhook-secret"
+		config.WebhookHeaders = map[string]string{"X-Api-Key": "key"}
+	})
+
+	w.deliver(context.Background(), testWebhookEvent)
+
+	if receiver.requests() != 1 {
+		t.Fatalf("received %d requests, want 1", receiver.requests())
+	}
+	mac := hmac.New(sha256.New, []byte("webhook-secret"))
+	mac.Write(receiver.bodies[0])
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := receiver.headers[0].Get("X-Signature-256"); got != want {
+		t.Errorf("X-Signature-256 = %q, want %q", got, want)
+	}
+	if got := receiver.headers[0].Get("X-Api-Key"); got != "key" {
+		t.Errorf("X-Api-Key = %q, want key", got)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		requests int
+		failed   bool
+	}{
+		{name: "5xx then success", statuses: []int{503, 500}, requests: 3},
+		{name: "rate limited", statuses: []int{429}, requests: 2},
+		{name: "5xx every attempt", statuses: []int{502, 502, 502}, requests: 3, failed: true},
+		{name: "4xx isn't retried", statuses: []int{400}, requests: 1, failed: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			receiver := &webhookReceiver{statuses: test.statuses}
+			server := httptest.NewServer(receiver)
+			defer server.Close()
+			w, logs := newTestWebhook(server.URL, nil)
+
+			w.deliver(context.Background(), testWebhookEvent)
+
+			if got := receiver.requests(); got != test.requests {
+				t.Errorf("received %d requests, want %d", got, test.requests)
+			}
+			failures := w.takePublishFailures()
+			deadLetters := len(logLines(t, logs, "webhook-dead-letter"))
+			want := 0
+			if test.failed {
+				want = 1
+			}
+			if failures != int64(want) || deadLetters != want {
+				t.Errorf("%d failures and %d dead letters, want %d of each", failures, deadLetters, want)
+			}
+		})
+	}
+}
+
+func TestWebhookTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	w, logs := newTestWebhook(server.URL, func(config *Config) {
+		config.WebhookTimeout = 50 * time.Millisecond
+		config.WebhookMaxAttempts = 1
+	})
+
+	start := time.Now()
+	w.deliver(context.Background(), testWebhookEvent)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("delivery took %s, want it cut off by WEBHOOK_TIMEOUT", elapsed)
+	}
+	if w.takePublishFailures() != 1 {
+		t.Errorf("timed out delivery not counted as a failure")
+	}
+	if len(logLines(t, logs, "webhook-dead-letter")) != 1 {
+		t.Errorf("webhook-dead-letter not logged once")
+	}
+}